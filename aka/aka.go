@@ -0,0 +1,130 @@
+package aka
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+const (
+	AKAv1MD5 string = "AKAv1-MD5"
+	AKAv2MD5 string = "AKAv2-MD5"
+
+	// maximum accepted jump of SQN ahead of SQNms (TS 33.102 Annex C.2.2 - parameter delta)
+	sqnDelta uint64 = 1 << 28
+)
+
+var (
+	ErrBadNonce    = errors.New("nonce does not carry RAND and AUTN")
+	ErrMACFailure  = errors.New("AUTN MAC verification failed")
+	ErrSyncFailure = errors.New("AUTN SQN out of range")
+)
+
+// Result of running the AKA algorithms against a network challenge
+type Result struct {
+	RES  []byte
+	CK   []byte
+	IK   []byte
+	SQN  uint64 // network SQN recovered from AUTN
+	AUTS []byte // only set with ErrSyncFailure
+}
+
+// IsAKA checks whether the digest algorithm requires AKA i.e. AKAv1-MD5 or AKAv2-MD5
+func IsAKA(algorithm string) bool {
+	return strings.HasPrefix(strings.ToUpper(algorithm), "AKAV")
+}
+
+// Authenticate verifies the AUTN carried in a digest nonce (base64 of RAND||AUTN[||server data]) and computes RES, CK and IK.
+// sqnms is the highest SQN accepted so far by the UE (zero when unknown i.e. any SQN is accepted).
+// On SQN failure, ErrSyncFailure is returned together with a Result holding AUTS.
+func Authenticate(kihex, opchex, nonce string, sqnms uint64) (*Result, error) {
+	ki, err := hex.DecodeString(kihex)
+	if err != nil {
+		return nil, errors.New("invalid Ki hex string")
+	}
+	opc, err := hex.DecodeString(opchex)
+	if err != nil {
+		return nil, errors.New("invalid OPc hex string")
+	}
+	mil, err := NewMilenage(ki, opc)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(nonce)
+	if err != nil || len(data) < 32 {
+		return nil, ErrBadNonce
+	}
+	rand := data[0:16]
+	autn := data[16:32]
+
+	res, ck, ik, ak := mil.F2345(rand)
+
+	sqn := make([]byte, 6)
+	for i := range sqn {
+		sqn[i] = autn[i] ^ ak[i]
+	}
+	amf := autn[6:8]
+	mac := autn[8:16]
+
+	xmac, _ := mil.F1(rand, sqn, amf)
+	if !bytes.Equal(mac, xmac) {
+		return nil, ErrMACFailure
+	}
+
+	rslt := &Result{RES: res, CK: ck, IK: ik, SQN: sqnToUint(sqn)}
+
+	if sqnms != 0 && (rslt.SQN <= sqnms || rslt.SQN-sqnms > sqnDelta) {
+		rslt.AUTS = computeAUTS(mil, rand, sqnms)
+		return rslt, ErrSyncFailure
+	}
+
+	return rslt, nil
+}
+
+// AUTS = SQNms xor AK* || MAC-S where MAC-S is computed with the dummy AMF 0x0000
+func computeAUTS(mil *Milenage, rand []byte, sqnms uint64) []byte {
+	sqn := uintToSqn(sqnms)
+	_, macs := mil.F1(rand, sqn, []byte{0, 0})
+	akstar := mil.F5Star(rand)
+	auts := make([]byte, 0, 14)
+	for i := range sqn {
+		auts = append(auts, sqn[i]^akstar[i])
+	}
+	return append(auts, macs...)
+}
+
+// Password returns the digest password to be used with the given algorithm (RFC 3310 / RFC 4169)
+func (r *Result) Password(algorithm string) []byte {
+	if strings.EqualFold(algorithm, AKAv2MD5) {
+		key := make([]byte, 0, len(r.RES)+len(r.IK)+len(r.CK))
+		key = append(key, r.RES...)
+		key = append(key, r.IK...)
+		key = append(key, r.CK...)
+		mac := hmac.New(md5.New, key)
+		mac.Write([]byte("http-digest-akav2-password"))
+		return []byte(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	}
+	return r.RES
+}
+
+func (r *Result) AUTSString() string {
+	return base64.StdEncoding.EncodeToString(r.AUTS)
+}
+
+func sqnToUint(sqn []byte) uint64 {
+	buf := make([]byte, 8)
+	copy(buf[2:], sqn)
+	return binary.BigEndian.Uint64(buf)
+}
+
+func uintToSqn(sqn uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, sqn)
+	return buf[2:]
+}
@@ -0,0 +1,120 @@
+package aka
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+)
+
+// Milenage algorithm set as specified in 3GPP TS 35.206, keyed with the subscriber Ki and OPc
+type Milenage struct {
+	block cipher.Block
+	opc   [16]byte
+}
+
+var (
+	// rotation amounts (in bytes) r1..r5 and constants c1..c5 (only the last byte differs)
+	rotations = [5]int{8, 0, 4, 8, 12}
+	constants = [5]byte{0, 1, 2, 4, 8}
+)
+
+func NewMilenage(k, opc []byte) (*Milenage, error) {
+	if len(k) != 16 {
+		return nil, errors.New("invalid Ki length")
+	}
+	if len(opc) != 16 {
+		return nil, errors.New("invalid OPc length")
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	m := &Milenage{block: block}
+	copy(m.opc[:], opc)
+	return m, nil
+}
+
+// ComputeOPc derives OPc from the operator variant OP i.e. OPc = E[OP]K xor OP
+func ComputeOPc(k, op []byte) ([]byte, error) {
+	if len(op) != 16 {
+		return nil, errors.New("invalid OP length")
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	opc := make([]byte, 16)
+	block.Encrypt(opc, op)
+	xorInPlace(opc, op)
+	return opc, nil
+}
+
+// F1 returns MAC-A (f1) and MAC-S (f1*)
+func (m *Milenage) F1(rand, sqn, amf []byte) (macA, macS []byte) {
+	var in1 [16]byte
+	copy(in1[0:6], sqn)
+	copy(in1[6:8], amf)
+	copy(in1[8:14], sqn)
+	copy(in1[14:16], amf)
+
+	temp := m.temp(rand)
+
+	var tmp [16]byte
+	copy(tmp[:], in1[:])
+	xorInPlace(tmp[:], m.opc[:])
+	out := rotate(tmp[:], rotations[0])
+	out[15] ^= constants[0]
+	xorInPlace(out, temp)
+	m.block.Encrypt(out, out)
+	xorInPlace(out, m.opc[:])
+
+	return out[0:8], out[8:16]
+}
+
+// F2345 returns RES (f2), CK (f3), IK (f4) and AK (f5)
+func (m *Milenage) F2345(rand []byte) (res, ck, ik, ak []byte) {
+	temp := m.temp(rand)
+	out2 := m.out(temp, 1)
+	out3 := m.out(temp, 2)
+	out4 := m.out(temp, 3)
+	return out2[8:16], out3, out4, out2[0:6]
+}
+
+// F5Star returns AK used to conceal SQNms in re-synchronisation messages
+func (m *Milenage) F5Star(rand []byte) []byte {
+	return m.out(m.temp(rand), 4)[0:6]
+}
+
+func (m *Milenage) temp(rand []byte) []byte {
+	temp := make([]byte, 16)
+	copy(temp, rand)
+	xorInPlace(temp, m.opc[:])
+	m.block.Encrypt(temp, temp)
+	return temp
+}
+
+// OUTi = E[rot(TEMP xor OPc, ri) xor ci]K xor OPc
+func (m *Milenage) out(temp []byte, i int) []byte {
+	tmp := make([]byte, 16)
+	copy(tmp, temp)
+	xorInPlace(tmp, m.opc[:])
+	out := rotate(tmp, rotations[i])
+	out[15] ^= constants[i]
+	m.block.Encrypt(out, out)
+	xorInPlace(out, m.opc[:])
+	return out
+}
+
+func rotate(in []byte, r int) []byte {
+	out := make([]byte, len(in))
+	for i := range in {
+		out[i] = in[(i+r)%len(in)]
+	}
+	return out
+}
+
+func xorInPlace(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
@@ -0,0 +1,186 @@
+package aka
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// 3GPP TS 35.208 section 4.3 - test sets 1 to 6
+var milenageSets = []struct {
+	k, rand, sqn, amf, op, opc         string
+	f1, f1star, f2, f5, f3, f4, f5star string
+}{
+	{
+		k: "465b5ce8b199b49faa5f0a2ee238a6bc", rand: "23553cbe9637a89d218ae64dae47bf35", sqn: "ff9bb4d0b607", amf: "b9b9",
+		op: "cdc202d5123e20f62b6d676ac72cb318", opc: "cd63cb71954a9f4e48a5994e37a02baf",
+		f1: "4a9ffac354dfafb3", f1star: "01cfaf9ec4e871e9", f2: "a54211d5e3ba50bf", f5: "aa689c648370",
+		f3: "b40ba9a3c58b2a05bbf0d987b21bf8cb", f4: "f769bcd751044604127672711c6d3441", f5star: "451e8beca43b",
+	},
+	{
+		k: "0396eb317b6d1c36f19c1c84cd6ffd16", rand: "c00d603103dcee52c4478119494202e8", sqn: "fd8eef40df7d", amf: "af17",
+		op: "ff53bade17df5d4e793073ce9d7579fa", opc: "53c15671c60a4b731c55b4a441c0bde2",
+		f1: "5df5b31807e258b0", f1star: "a8c016e51ef4a343", f2: "d3a628ed988620f0", f5: "c47783995f72",
+		f3: "58c433ff7a7082acd424220f2b67c556", f4: "21a8c1f929702adb3e738488b9f5c5da", f5star: "30f1197061c1",
+	},
+	{
+		k: "fec86ba6eb707ed08905757b1bb44b8f", rand: "9f7c8d021accf4db213ccff0c7f71a6a", sqn: "9d0277595ffc", amf: "725c",
+		op: "dbc59adcb6f9a0ef735477b7fadf8374", opc: "1006020f0a478bf6b699f15c062e42b3",
+		f1: "9cabc3e99baf7281", f1star: "95814ba2b3044324", f2: "8011c48c0c214ed2", f5: "33484dc2136b",
+		f3: "5dbdbb2954e8f3cde665b046179a5098", f4: "59a92d3b476a0443487055cf88b2307b", f5star: "deacdd848cc6",
+	},
+	{
+		k: "9e5944aea94b81165c82fbf9f32db751", rand: "ce83dbc54ac0274a157c17f80d017bd6", sqn: "0b604a81eca8", amf: "9e09",
+		op: "223014c5806694c007ca1eeef57f004f", opc: "a64a507ae1a2a98bb88eb4210135dc87",
+		f1: "74a58220cba84c49", f1star: "ac2cc74a96871837", f2: "f365cd683cd92e96", f5: "f0b9c08ad02e",
+		f3: "e203edb3971574f5a94b0d61b816345d", f4: "0c4524adeac041c4dd830d20854fc46b", f5star: "6085a86c6f63",
+	},
+	{
+		k: "4ab1deb05ca6ceb051fc98e77d026a84", rand: "74b0cd6031a1c8339b2b6ce2b8c4a186", sqn: "e880a1b580b6", amf: "9f07",
+		op: "2d16c5cd1fdf6b22383584e3bef2a8d8", opc: "dcf07cbd51855290b92a07a9891e523e",
+		f1: "49e785dd12626ef2", f1star: "9e85790336bb3fa2", f2: "5860fc1bce351e7e", f5: "31e11a609118",
+		f3: "7657766b373d1c2138f307e3de9242f9", f4: "1c42e960d89b8fa99f2744e0708ccb53", f5star: "fe2555e54aa9",
+	},
+	{
+		k: "6c38a116ac280c454f59332ee35c8c4f", rand: "ee6466bc96202c5a557abbeff8babf63", sqn: "414b98222181", amf: "4464",
+		op: "1ba00a1a7c6700ac8c3ff3e96ad08725", opc: "3803ef5363b947c6aaa225e58fae3934",
+		f1: "078adfb488241a57", f1star: "80246b8d0186bcf1", f2: "16c8233f05a0ac28", f5: "45b0f69ab06c",
+		f3: "3f8c7587fe8e4b233af676aede30ba3b", f4: "a7466cc1e6b2a1337d49d3b66e95d7b4", f5star: "1f53cd2b1113",
+	},
+}
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("bad hex [%s]: %v", s, err)
+	}
+	return b
+}
+
+func checkHex(t *testing.T, name string, got []byte, want string) {
+	t.Helper()
+	if hex.EncodeToString(got) != want {
+		t.Errorf("%s = %x, want %s", name, got, want)
+	}
+}
+
+func TestMilenage(t *testing.T) {
+	for i, ts := range milenageSets {
+		k, rand := unhex(t, ts.k), unhex(t, ts.rand)
+		opc, err := ComputeOPc(k, unhex(t, ts.op))
+		if err != nil {
+			t.Fatalf("set %d: ComputeOPc: %v", i+1, err)
+		}
+		checkHex(t, "OPc", opc, ts.opc)
+
+		mil, err := NewMilenage(k, opc)
+		if err != nil {
+			t.Fatalf("set %d: NewMilenage: %v", i+1, err)
+		}
+		maca, macs := mil.F1(rand, unhex(t, ts.sqn), unhex(t, ts.amf))
+		checkHex(t, "f1", maca, ts.f1)
+		checkHex(t, "f1*", macs, ts.f1star)
+		res, ck, ik, ak := mil.F2345(rand)
+		checkHex(t, "f2", res, ts.f2)
+		checkHex(t, "f3", ck, ts.f3)
+		checkHex(t, "f4", ik, ts.f4)
+		checkHex(t, "f5", ak, ts.f5)
+		checkHex(t, "f5*", mil.F5Star(rand), ts.f5star)
+	}
+}
+
+// nonce builds the digest nonce RAND||AUTN of the network for the test set - AUTN = SQN xor AK || AMF || MAC-A
+func nonce(t *testing.T, ts int, corruptMAC bool) string {
+	t.Helper()
+	set := milenageSets[ts]
+	autn := unhex(t, set.sqn)
+	ak := unhex(t, set.f5)
+	for i := range autn {
+		autn[i] ^= ak[i]
+	}
+	autn = append(autn, unhex(t, set.amf)...)
+	mac := unhex(t, set.f1)
+	if corruptMAC {
+		mac[0] ^= 0x01
+	}
+	autn = append(autn, mac...)
+	return base64.StdEncoding.EncodeToString(append(unhex(t, set.rand), autn...))
+}
+
+func TestAuthenticate(t *testing.T) {
+	set := milenageSets[0]
+	sqn := sqnToUint(unhex(t, set.sqn))
+
+	tests := []struct {
+		name    string
+		nonce   string
+		sqnms   uint64
+		wantErr error
+	}{
+		{"any SQN accepted", nonce(t, 0, false), 0, nil},
+		{"fresh SQN", nonce(t, 0, false), sqn - 1, nil},
+		{"MAC failure", nonce(t, 0, true), 0, ErrMACFailure},
+		{"replayed SQN", nonce(t, 0, false), sqn, ErrSyncFailure},
+		{"SQN beyond delta", nonce(t, 0, false), sqn - sqnDelta - 1, ErrSyncFailure},
+		{"short nonce", base64.StdEncoding.EncodeToString(unhex(t, set.rand)), 0, ErrBadNonce},
+		{"not base64", "%%%", 0, ErrBadNonce},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rslt, err := Authenticate(set.k, set.opc, tt.nonce, tt.sqnms)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			switch tt.wantErr {
+			case nil:
+				checkHex(t, "RES", rslt.RES, set.f2)
+				checkHex(t, "CK", rslt.CK, set.f3)
+				checkHex(t, "IK", rslt.IK, set.f4)
+				if rslt.SQN != sqn || rslt.AUTS != nil {
+					t.Errorf("SQN = %x AUTS = %x, want %x and no AUTS", rslt.SQN, rslt.AUTS, sqn)
+				}
+			case ErrSyncFailure:
+				if len(rslt.AUTS) != 14 {
+					t.Fatalf("AUTS length = %d, want 14", len(rslt.AUTS))
+				}
+			case ErrMACFailure, ErrBadNonce:
+				if rslt != nil {
+					t.Errorf("result = %+v, want nil", rslt)
+				}
+			}
+		})
+	}
+}
+
+// the network resynchronises from AUTS: SQNms = AUTS[0:6] xor AK* and MAC-S is f1* over SQNms with AMF 0000
+func TestAUTSResync(t *testing.T) {
+	for i, set := range milenageSets {
+		sqnms := sqnToUint(unhex(t, set.sqn)) + 32
+		rslt, err := Authenticate(set.k, set.opc, nonce(t, i, false), sqnms)
+		if !errors.Is(err, ErrSyncFailure) {
+			t.Fatalf("set %d: err = %v, want %v", i+1, err, ErrSyncFailure)
+		}
+		auts, err := base64.StdEncoding.DecodeString(rslt.AUTSString())
+		if err != nil || !bytes.Equal(auts, rslt.AUTS) {
+			t.Fatalf("set %d: AUTS string does not decode back: %v", i+1, err)
+		}
+
+		mil, _ := NewMilenage(unhex(t, set.k), unhex(t, set.opc))
+		rand := unhex(t, set.rand)
+		akstar := mil.F5Star(rand)
+		sqn := make([]byte, 6)
+		for j := range sqn {
+			sqn[j] = auts[j] ^ akstar[j]
+		}
+		if got := sqnToUint(sqn); got != sqnms {
+			t.Errorf("set %d: SQNms = %x, want %x", i+1, got, sqnms)
+		}
+		_, macs := mil.F1(rand, sqn, []byte{0, 0})
+		if !bytes.Equal(auts[6:], macs) {
+			t.Errorf("set %d: MAC-S = %x, want %x", i+1, auts[6:], macs)
+		}
+	}
+}
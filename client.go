@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"sipclientgo/global"
 	"sipclientgo/sip"
@@ -14,11 +15,14 @@ import (
 //nolint:revive
 const (
 	OwnIPv4       string = "server_ipv4"
+	OwnIPv6       string = "server_ipv6"
 	OwnSIPUdpPort string = "sip_udp_port"
 
 	//nolint:stylecheck
 	PcscfUdpSocket string = "pcscf_udp_socket"
 	ImsDomain      string = "ims_domain"
+	SMSCAddress    string = "smsc_address"
+	XCAPRoot       string = "xcap_root"
 	Ki             string = "ki"
 	Opc            string = "opc"
 	Imsi           string = "imsi"
@@ -26,6 +30,18 @@ const (
 	//nolint:stylecheck
 	OwnHttpPort    string = "http_port"
 	MediaDirectory string = "media_dir"
+	ScenarioDir    string = "scenario_dir"
+	CDRDirectory   string = "cdr_dir"
+	CDRFormat      string = "cdr_format"
+	PcapDirectory  string = "pcap_dir"
+	PcapCapture    string = "pcap_capture"
+	RecordingDir   string = "recording_dir"
+
+	TLSCAFile     string = "tls_ca_file"
+	TLSCertFile   string = "tls_cert_file"
+	TLSKeyFile    string = "tls_key_file"
+	TLSServerName string = "tls_server_name"
+	WSPath        string = "ws_path"
 )
 
 func main() {
@@ -50,6 +66,16 @@ func checkArgs() (string, int) {
 		system.LogWarning(system.LTConfiguration, "No self IPv4 address provided - First available shall be used")
 	}
 
+	if ipv6, ok := os.LookupEnv(OwnIPv6); ok {
+		if ip := net.ParseIP(ipv6); ip != nil && ip.To4() == nil {
+			global.ClientIPv6 = ip
+		} else {
+			system.LogWarning(system.LTConfiguration, "Invalid self IPv6 address: "+ipv6)
+		}
+	} else if global.ClientIPv6 = system.GetLocalIPv6(); global.ClientIPv6 == nil {
+		system.LogWarning(system.LTConfiguration, "No self IPv6 address found - IPv6 UEs cannot be started")
+	}
+
 	var httpport int
 
 	hp, ok := os.LookupEnv(OwnHttpPort)
@@ -109,5 +135,49 @@ func checkArgs() (string, int) {
 		system.LogWarning(system.LTConfiguration, fmt.Sprintf("No media directory provided - [%s] shall be used", global.MediaPath))
 	}
 
+	if sd, ok := os.LookupEnv(ScenarioDir); ok {
+		global.ScenarioPath = sd
+	}
+
+	if cd, ok := os.LookupEnv(CDRDirectory); ok {
+		global.CDRPath = cd // empty disables CDRs
+	}
+
+	if cf, ok := os.LookupEnv(CDRFormat); ok {
+		switch cf = system.ASCIIToLower(cf); cf {
+		case global.CDRFormatCSV, global.CDRFormatJSONL:
+			global.CDRFormat = cf
+		default:
+			system.LogWarning(system.LTConfiguration, fmt.Sprintf("Invalid CDR format [%s] - [%s] shall be used", cf, global.CDRFormat))
+		}
+	}
+
+	if pd, ok := os.LookupEnv(PcapDirectory); ok {
+		global.PcapPath = pd
+	}
+
+	if pc, ok := os.LookupEnv(PcapCapture); ok {
+		global.CaptureOnStart = pc == "1" || system.ASCIIToLower(pc) == "true"
+	}
+
+	if rd, ok := os.LookupEnv(RecordingDir); ok {
+		global.RecordPath = rd
+	}
+
+	global.TLSCAFile = os.Getenv(TLSCAFile)
+	global.TLSCertFile = os.Getenv(TLSCertFile)
+	global.TLSKeyFile = os.Getenv(TLSKeyFile)
+	global.TLSServerName = os.Getenv(TLSServerName)
+
+	global.SMSCAddress = os.Getenv(SMSCAddress)
+	global.XCAPRoot = os.Getenv(XCAPRoot)
+
+	if wp, ok := os.LookupEnv(WSPath); ok && wp != "" {
+		if wp[0] != '/' {
+			wp = "/" + wp
+		}
+		global.WSPath = wp
+	}
+
 	return ipv4, httpport
 }
@@ -7,6 +7,8 @@ import (
 const (
 	// blockSize  = 480  // 3 RTP packets i.e. 160 x 3 = 480 bytes // Block size for DTMF detection (2 RTP packets = 320 samples)
 	threshold = 1e11 // Power threshold for DTMF detection 1e5
+
+	toneAmplitude = 10000 // per frequency of generated tones
 )
 
 var (
@@ -82,20 +84,22 @@ func maxIndex(power []float64) int {
 	return maxIndex
 }
 
-// TODO create DTMF Generator using the below
-
-// func main() {
-// 	// Example PCM data (replace with actual PCM data)
-// 	pcmData := make([]int16, blockSize)
-// 	for i := range pcmData {
-// 		// Simulate a DTMF tone (e.g., "1" = 697 Hz + 1209 Hz)
-// 		pcmData[i] = int16(32767 * (math.Sin(2*math.Pi*697*float64(i)/sampleRate) + math.Sin(2*math.Pi*1209*float64(i)/sampleRate)))
-// 	}
-
-// 	dtmf := detectDTMF(pcmData)
-// 	if dtmf != "" {
-// 		fmt.Printf("Detected DTMF: %s\n", dtmf)
-// 	} else {
-// 		fmt.Println("No DTMF detected")
-// 	}
-// }
+// GenerateTone returns the dual tone of the digit followed by silence - each tone at about -7 dBm0
+func GenerateTone(digit string, sr float64, toneMs, gapMs int) ([]int16, bool) {
+	for r, row := range dtmfMap {
+		for c, d := range row {
+			if d != digit {
+				continue
+			}
+			lo, hi := dtmfFrequencies[r], dtmfFrequencies[c+4]
+			n := int(sr) * toneMs / 1000
+			samples := make([]int16, n+int(sr)*gapMs/1000)
+			for i := range n {
+				t := float64(i) / sr
+				samples[i] = int16(toneAmplitude * (math.Sin(2*math.Pi*lo*t) + math.Sin(2*math.Pi*hi*t)))
+			}
+			return samples, true
+		}
+	}
+	return nil, false
+}
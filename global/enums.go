@@ -1,6 +1,9 @@
 package global
 
-import "slices"
+import (
+	"slices"
+	"strings"
+)
 
 // ==============================================================
 type Method int
@@ -64,10 +67,87 @@ const (
 	VndEtsiPstnXML
 	VndOrangeInData
 	ResourceListXML
+	ReginfoXML
+	VndSMS
+	VndUSSDXML
 	AnyXML
 	Unknown
 )
 
+// ==============================================================
+type Transport string
+
+const (
+	TransportUDP Transport = "udp"
+	TransportTCP Transport = "tcp"
+	TransportTLS Transport = "tls"
+	TransportWS  Transport = "ws"
+	TransportWSS Transport = "wss"
+)
+
+// IsStream reports a reliable transport - no retransmissions and responses go back on the same connection
+func (t Transport) IsStream() bool {
+	return t != TransportUDP
+}
+
+func (t Transport) IsWebSocket() bool {
+	return t == TransportWS || t == TransportWSS
+}
+
+// URIParam returns the transport as used in SIP URI transport parameter - WSS is signalled as ws (RFC 7118)
+func (t Transport) URIParam() string {
+	if t == TransportWSS {
+		return string(TransportWS)
+	}
+	return string(t)
+}
+
+// ViaName returns the transport as used in Via sent-protocol
+func (t Transport) ViaName() string {
+	return strings.ToUpper(string(t))
+}
+
+func ParseTransport(s string) (Transport, bool) {
+	switch t := Transport(strings.ToLower(strings.TrimSpace(s))); t {
+	case TransportUDP, TransportTCP, TransportTLS, TransportWS, TransportWSS:
+		return t, true
+	}
+	return "", false
+}
+
+// ==============================================================
+type IPFamily string
+
+const (
+	IPFamilyV4 IPFamily = "ipv4"
+	IPFamilyV6 IPFamily = "ipv6"
+)
+
+func ParseIPFamily(s string) (IPFamily, bool) {
+	switch f := IPFamily(strings.ToLower(strings.TrimSpace(s))); f {
+	case IPFamilyV4, IPFamilyV6:
+		return f, true
+	}
+	return "", false
+}
+
+// ==============================================================
+type RecordingMode string
+
+const (
+	RecordingNone   RecordingMode = "none"
+	RecordingStereo RecordingMode = "stereo" // left: transmitted by the UE, right: received
+	RecordingMixed  RecordingMode = "mixed"
+)
+
+func ParseRecordingMode(s string) (RecordingMode, bool) {
+	switch m := RecordingMode(strings.ToLower(strings.TrimSpace(s))); m {
+	case RecordingNone, RecordingStereo, RecordingMixed:
+		return m, true
+	}
+	return "", false
+}
+
 // ==============================================================
 type TimerType int
 
@@ -171,6 +251,7 @@ const (
 	FQDNPort
 	TransportProtocol
 	ViaIPv4Socket
+	ViaIPv6Socket
 	IP6
 	IP4
 	HeaderParameter
@@ -28,32 +28,57 @@ const (
 	PcmSamplingRate       = 16000 // Hz
 	DTMFPacketsCount  int = 3
 
+	MaxUDPMessageSize int = 1300 // bytes - larger requests are sent over TCP (RFC 3261 section 18.1.1)
+
+	CDRFormatCSV   string = "csv"
+	CDRFormatJSONL string = "jsonl"
+	CDRMaxFileSize int64  = 10 << 20 // bytes - CDR files also rotate daily
+
 	T1Timer              int    = 500
 	ReTXCount            int    = 5
 	MultipartBoundary    string = "unique-boundary-1"
 	SipVersion           string = "SIP/2.0"
 	MagicCookie          string = "z9hG4bK"
-	AllowedMethods       string = "INVITE, PRACK, ACK, CANCEL, BYE, OPTIONS, UPDATE, INFO, NOTIFY, MESSAGE"
+	AllowedMethods       string = "INVITE, PRACK, ACK, CANCEL, BYE, OPTIONS, UPDATE, INFO, NOTIFY, MESSAGE, REFER"
+	SupportedOptions     string = "100rel, precondition, replaces, norefersub"
 	SessionDropDelaySec  int    = 4
 	InDialogueProbingSec int    = 60
 	MaxCallDurationSec   int    = 7200
 	MinMaxFwds           int    = 0
 
-	NoAnswerTimeout int = 120
-	No18xTimeout    int = 20
+	NoAnswerTimeout     int = 120
+	No18xTimeout        int = 20
+	PreconditionTimeout int = 20
 )
 
 var (
 	ClientIPv4  net.IP
+	ClientIPv6  net.IP
 	HttpTcpPort int
 
-	PCSCFSocket *net.UDPAddr
-	ImsDomain   string
+	PCSCFSocket    *net.UDPAddr
+	PCSCFTransport Transport = TransportUDP
+	ImsDomain      string
+	SMSCAddress    string
+	XCAPRoot       string
+
+	TLSCAFile     string
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSServerName string
+
+	WSPath string = "/"
 
 	IsSystemBigEndian bool
 
-	MediaPath string
-	SoxPath   string = `C:\Program Files (x86)\sox-14-4-2`
+	MediaPath    string
+	ScenarioPath string = "./scenarios"
+	CDRPath      string = "./cdrs"
+	CDRFormat    string = CDRFormatCSV
+	PcapPath     string = "./pcaps"
+	RecordPath   string = "./recordings"
+
+	CaptureOnStart bool
 
 	BufferPool      *sync.Pool
 	RTPRXBufferPool *sync.Pool
@@ -115,9 +140,12 @@ var (
 		MSCPXML:              "application/mscp+xml",
 		MSCXML:               "application/mediaservercontrol+xml",
 		ResourceListXML:      "application/resource-lists+xml",
+		ReginfoXML:           "application/reginfo+xml",
 		VndEtsiPstnXML:       "application/vnd.etsi.pstn+xml",
 		VndOrangeInData:      "application/vnd.orange.indata",
 		AppJson:              "application/json",
+		VndSMS:               "application/vnd.3gpp.sms",
+		VndUSSDXML:           "application/vnd.3gpp.ussd+xml",
 		AnyXML:               "+xml",
 	}
 
@@ -153,6 +181,7 @@ var (
 		FQDNPort:                   regexp.MustCompile(`(?i)(?:sip|sips|tel):(?:[^@]+@)?([\w\-\.]+)(?::(\d+))?;?`),
 		TransportProtocol:          regexp.MustCompile(`(?i)transport\s*=\s*(\w+)`),
 		ViaIPv4Socket:              regexp.MustCompile(`(?i)\s*SIP/2\.0\/(\w+)\s+((?:\d{1,3}\.){3}\d{1,3})(:\d+)?\s*`),
+		ViaIPv6Socket:              regexp.MustCompile(`(?i)\s*SIP/2\.0\/(\w+)\s+\[([0-9a-f:\.]+)\](:\d+)?\s*`),
 		IP6:                        regexp.MustCompile(`(?i)((?:(?:(?:(?:(?:(?:(?:[0-9a-f]{1,4})):){6})(?:(?:(?:(?:(?:[0-9a-f]{1,4})):(?:(?:[0-9a-f]{1,4})))|(?:(?:(?:(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9]))\.){3}(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9])))))))|(?:(?:::(?:(?:(?:[0-9a-f]{1,4})):){5})(?:(?:(?:(?:(?:[0-9a-f]{1,4})):(?:(?:[0-9a-f]{1,4})))|(?:(?:(?:(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9]))\.){3}(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9])))))))|(?:(?:(?:(?:(?:[0-9a-f]{1,4})))?::(?:(?:(?:[0-9a-f]{1,4})):){4})(?:(?:(?:(?:(?:[0-9a-f]{1,4})):(?:(?:[0-9a-f]{1,4})))|(?:(?:(?:(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9]))\.){3}(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9])))))))|(?:(?:(?:(?:(?:(?:[0-9a-f]{1,4})):){0,1}(?:(?:[0-9a-f]{1,4})))?::(?:(?:(?:[0-9a-f]{1,4})):){3})(?:(?:(?:(?:(?:[0-9a-f]{1,4})):(?:(?:[0-9a-f]{1,4})))|(?:(?:(?:(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9]))\.){3}(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9])))))))|(?:(?:(?:(?:(?:(?:[0-9a-f]{1,4})):){0,2}(?:(?:[0-9a-f]{1,4})))?::(?:(?:(?:[0-9a-f]{1,4})):){2})(?:(?:(?:(?:(?:[0-9a-f]{1,4})):(?:(?:[0-9a-f]{1,4})))|(?:(?:(?:(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9]))\.){3}(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9])))))))|(?:(?:(?:(?:(?:(?:[0-9a-f]{1,4})):){0,3}(?:(?:[0-9a-f]{1,4})))?::(?:(?:[0-9a-f]{1,4})):)(?:(?:(?:(?:(?:[0-9a-f]{1,4})):(?:(?:[0-9a-f]{1,4})))|(?:(?:(?:(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9]))\.){3}(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9])))))))|(?:(?:(?:(?:(?:(?:[0-9a-f]{1,4})):){0,4}(?:(?:[0-9a-f]{1,4})))?::)(?:(?:(?:(?:(?:[0-9a-f]{1,4})):(?:(?:[0-9a-f]{1,4})))|(?:(?:(?:(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9]))\.){3}(?:(?:25[0-5]|(?:[1-9]|1[0-9]|2[0-4])?[0-9])))))))|(?:(?:(?:(?:(?:(?:[0-9a-f]{1,4})):){0,5}(?:(?:[0-9a-f]{1,4})))?::)(?:(?:[0-9a-f]{1,4})))|(?:(?:(?:(?:(?:(?:[0-9a-f]{1,4})):){0,6}(?:(?:[0-9a-f]{1,4})))?::)))))\s*$`),
 		IP4:                        regexp.MustCompile(`(?i)((?:(?:2(?:5[0-5]|[0-4]\d)|1?\d?\d)\.){3}(?:2(?:5[0-5]|[0-4]\d)|1?\d?\d))\s*$`),
 		HeaderParameter:            regexp.MustCompile(`(?i);([^=]+)=([^=;]+)`),
@@ -244,24 +273,24 @@ var (
 	// Request Headers
 
 	RequestHeaderCHs = []string{"Record-Route", "Route", "Via", "From", "To", "Call-ID", "CSeq", "Contact", "Supported", "Allow", "Max-Forwards", "Date", "User-Agent", "User-to-User", "Content-Type", "Content-Length", "Content-Disposition"}
-	OtherCHs         = []string{"Referred-By", "Diversion", "History-Info", "Privacy", "Geolocation", "Require", "Authorization", "Identity", "Proxy-Authorization", "Expires", "Session-Expires", "Min-SE", "Subject", "Allow-Events", "Accept", "MIME-Version"}
+	OtherCHs         = []string{"Referred-By", "Diversion", "History-Info", "Privacy", "Geolocation", "Require", "Authorization", "Identity", "Proxy-Authorization", "Expires", "Session-Expires", "Min-SE", "Subject", "Allow-Events", "Accept", "MIME-Version", "Proxy-Require", "Security-Verify"}
 
 	// returns proper case for headers
 	DicRequestHeaders = map[Method][]string{
-		INVITE:    append(RequestHeaderCHs, OtherCHs...),
+		INVITE:    append(append(RequestHeaderCHs, OtherCHs...), "Replaces", "Recv-Info", "Accept-Contact"),
 		ReINVITE:  append(RequestHeaderCHs, OtherCHs...),
 		ACK:       append(RequestHeaderCHs, "MIME-Version"),
 		OPTIONS:   append(RequestHeaderCHs, "Subject", "Accept", "MIME-Version"),
 		BYE:       append(RequestHeaderCHs, "Reason", "Warning"),
 		CANCEL:    append(RequestHeaderCHs, "Reason", "Warning"),
-		REFER:     append(RequestHeaderCHs, "Refer-Sub", "Refer-To"),
+		REFER:     append(RequestHeaderCHs, "Refer-Sub", "Refer-To", "Referred-By"),
 		PRACK:     append(RequestHeaderCHs, "RAck"),
 		NOTIFY:    append(RequestHeaderCHs, "Event", "Subscription-State", "Subscription-Expires"),
 		UPDATE:    append(RequestHeaderCHs, "Require", "Session-Expires", "Min-SE"),
-		INFO:      RequestHeaderCHs,
-		REGISTER:  append(RequestHeaderCHs, OtherCHs...),
-		SUBSCRIBE: RequestHeaderCHs,
-		MESSAGE:   RequestHeaderCHs,
+		INFO:      append(RequestHeaderCHs, "Info-Package"),
+		REGISTER:  append(append(RequestHeaderCHs, OtherCHs...), "Security-Client"),
+		SUBSCRIBE: append(RequestHeaderCHs, "Event", "Expires", "Accept", "Require", "Proxy-Require", "Security-Verify"),
+		MESSAGE:   append(RequestHeaderCHs, "In-Reply-To", "Accept-Contact", "Request-Disposition", "Require", "Proxy-Require", "Security-Verify", "MIME-Version"),
 	}
 
 	// =================================================================
@@ -538,6 +567,8 @@ func responsesHeadersInit() {
 			HDRs = append(ResponseHeaderCHs, "Require", "RSeq", "Allow", "Content-Type")
 		case Rspns == 200:
 			HDRs = append(ResponseHeaderCHs, "Supported", "Allow", "Require", "Session-Expires", "Min-SE", "Compression", "Refer-Sub", "Expires", "Content-Type", "MIME-Version")
+		case Rspns == 202:
+			HDRs = append(ResponseHeaderCHs, "Refer-Sub", "Expires", "Content-Type")
 		case Rspns >= 201 && Rspns <= 399:
 			HDRs = append(ResponseHeaderCHs, "Expires", "Content-Type")
 		case Rspns == 401:
@@ -9,4 +9,13 @@ require github.com/gotranspile/g722 v0.0.0-20240123003956-384a1bb16a19
 require (
 	github.com/Moatassem/sdp v0.2.89
 	github.com/gorilla/websocket v1.5.3
+	github.com/hajimehoshi/go-mp3 v0.3.4
+	github.com/mewkiz/flac v1.0.14
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/icza/bitio v1.1.0 // indirect
+	github.com/mewkiz/pkg v0.0.0-20250417130911-3f050ff8c56d // indirect
+	github.com/mewpkg/term v0.0.0-20241026122259-37a80af23985 // indirect
 )
@@ -0,0 +1,236 @@
+package rtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hajimehoshi/go-mp3"
+	"github.com/mewkiz/flac"
+)
+
+// native decoding of audio files to mono 16-bit PCM at the requested sampling rate
+
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatALaw       = 6
+	wavFormatULaw       = 7
+	wavFormatExtensible = 0xFFFE
+
+	resampleTaps = 16 // half width of the interpolation filter in output samples
+)
+
+// ReadAudioFile decodes a RAW, WAV, MP3 or FLAC file without modifying it
+// RAW files are headerless 16-bit little-endian mono PCM at rawrate
+func ReadAudioFile(filename string, rawrate, rate int) ([]int16, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var pcm []int16
+	srcrate := rawrate
+	switch ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), ".")); ext {
+	case "raw":
+		pcm = bytesToInt16s(data)
+	case "wav":
+		pcm, srcrate, err = DecodeWav(data)
+	case "mp3":
+		pcm, srcrate, err = DecodeMp3(bytes.NewReader(data))
+	case "flac":
+		pcm, srcrate, err = DecodeFlac(bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("unsupported audio format [%s]", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return Resample(pcm, srcrate, rate), nil
+}
+
+// DecodeWav supports integer PCM (8/16/24/32 bits), IEEE float, A-law and µ-law - channels are averaged to mono
+func DecodeWav(data []byte) ([]int16, int, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, 0, errors.New("not a RIFF/WAVE file")
+	}
+	var format, chnls, bits, align int
+	var rate int
+	var fmtFound bool
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		body := data[pos+8:]
+		if size > len(body) || size < 0 {
+			size = len(body) // streamed or truncated file
+		}
+		body = body[:size]
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, 0, errors.New("invalid WAV fmt chunk")
+			}
+			format = int(binary.LittleEndian.Uint16(body[0:]))
+			chnls = int(binary.LittleEndian.Uint16(body[2:]))
+			rate = int(binary.LittleEndian.Uint32(body[4:]))
+			align = int(binary.LittleEndian.Uint16(body[12:]))
+			bits = int(binary.LittleEndian.Uint16(body[14:]))
+			if format == wavFormatExtensible && size >= 26 {
+				format = int(binary.LittleEndian.Uint16(body[24:])) // first two bytes of the sub format GUID
+			}
+			fmtFound = true
+		case "data":
+			if !fmtFound {
+				return nil, 0, errors.New("WAV data chunk before fmt chunk")
+			}
+			pcm, err := decodeWavSamples(body, format, chnls, bits, align)
+			return pcm, rate, err
+		}
+		pos += 8 + size + size%2
+	}
+	return nil, 0, errors.New("no WAV data chunk")
+}
+
+func decodeWavSamples(body []byte, format, chnls, bits, align int) ([]int16, error) {
+	width := bits / 8
+	if chnls <= 0 || width <= 0 || align < chnls*width {
+		return nil, errors.New("invalid WAV sample layout")
+	}
+	var sample func(b []byte) int32
+	switch {
+	case format == wavFormatPCM && bits == 8:
+		sample = func(b []byte) int32 { return (int32(b[0]) - 128) << 8 }
+	case format == wavFormatPCM && bits == 16:
+		sample = func(b []byte) int32 { return int32(int16(binary.LittleEndian.Uint16(b))) }
+	case format == wavFormatPCM && bits == 24:
+		sample = func(b []byte) int32 { return int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 16 }
+	case format == wavFormatPCM && bits == 32:
+		sample = func(b []byte) int32 { return int32(binary.LittleEndian.Uint32(b)) >> 16 }
+	case format == wavFormatFloat && bits == 32:
+		sample = func(b []byte) int32 { return floatSample(float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))) }
+	case format == wavFormatFloat && bits == 64:
+		sample = func(b []byte) int32 { return floatSample(math.Float64frombits(binary.LittleEndian.Uint64(b))) }
+	case format == wavFormatALaw && bits == 8:
+		sample = func(b []byte) int32 { return int32(alawEngine.DecompressTable[b[0]]) }
+	case format == wavFormatULaw && bits == 8:
+		sample = func(b []byte) int32 { return int32(ulawEngine.DecompressTable[b[0]]) }
+	default:
+		return nil, fmt.Errorf("unsupported WAV encoding (format %d, %d bits)", format, bits)
+	}
+	pcm := make([]int16, len(body)/align)
+	for i := range pcm {
+		frame := body[i*align:]
+		var sum int32
+		for c := range chnls {
+			sum += sample(frame[c*width:])
+		}
+		pcm[i] = int16(sum / int32(chnls))
+	}
+	return pcm, nil
+}
+
+func floatSample(f float64) int32 {
+	return int32(max(-32768, min(32767, math.Round(f*32767))))
+}
+
+// DecodeMp3 decodes MPEG-1/2 Layer III - the decoder always outputs 16-bit stereo
+func DecodeMp3(r io.Reader) ([]int16, int, error) {
+	dec, err := mp3.NewDecoder(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := io.ReadAll(dec)
+	if err != nil {
+		return nil, 0, err
+	}
+	pcm := make([]int16, len(data)/4)
+	for i := range pcm {
+		l := int32(int16(binary.LittleEndian.Uint16(data[i*4:])))
+		r := int32(int16(binary.LittleEndian.Uint16(data[i*4+2:])))
+		pcm[i] = int16((l + r) / 2)
+	}
+	return pcm, dec.SampleRate(), nil
+}
+
+func DecodeFlac(r io.Reader) ([]int16, int, error) {
+	strm, err := flac.New(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	shift := int(strm.Info.BitsPerSample) - 16
+	pcm := make([]int16, 0, strm.Info.NSamples)
+	for {
+		frm, err := strm.ParseNext()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(frm.Subframes) == 0 {
+			continue
+		}
+		for i := range frm.Subframes[0].Samples {
+			var sum int64
+			for _, sf := range frm.Subframes {
+				sum += int64(sf.Samples[i])
+			}
+			sum /= int64(len(frm.Subframes))
+			if shift > 0 {
+				sum >>= shift
+			} else {
+				sum <<= -shift
+			}
+			pcm = append(pcm, int16(sum))
+		}
+	}
+	return pcm, int(strm.Info.SampleRate), nil
+}
+
+// Resample converts mono PCM between sampling rates by windowed sinc interpolation
+// the filter cut-off follows the lower of both rates so downsampling does not alias
+func Resample(pcm []int16, from, to int) []int16 {
+	if from == to || from <= 0 || to <= 0 || len(pcm) == 0 {
+		return pcm
+	}
+	ratio := float64(from) / float64(to)
+	cutoff := min(1, 1/ratio)
+	width := int(math.Ceil(resampleTaps / cutoff))
+	out := make([]int16, int(int64(len(pcm))*int64(to)/int64(from)))
+	for i := range out {
+		t := float64(i) * ratio
+		c := int(t)
+		var sum, wsum float64
+		for k := max(0, c-width+1); k <= c+width && k < len(pcm); k++ {
+			x := t - float64(k)
+			w := sinc(cutoff*x) * blackman(x/float64(width))
+			sum += float64(pcm[k]) * w
+			wsum += w
+		}
+		if wsum != 0 {
+			sum /= wsum
+		}
+		out[i] = int16(max(-32768, min(32767, math.Round(sum))))
+	}
+	return out
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	x *= math.Pi
+	return math.Sin(x) / x
+}
+
+func blackman(u float64) float64 {
+	if u <= -1 || u >= 1 {
+		return 0
+	}
+	return 0.42 + 0.5*math.Cos(math.Pi*u) + 0.08*math.Cos(2*math.Pi*u)
+}
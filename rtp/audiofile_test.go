@@ -0,0 +1,227 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func chunk(id string, body []byte) []byte {
+	c := append([]byte(id), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+	c = append(c, body...)
+	if len(body)%2 != 0 {
+		c = append(c, 0) // pad byte
+	}
+	return c
+}
+
+func fmtChunk(format, chnls, rate, bits int) []byte {
+	align := chnls * bits / 8
+	b := binary.LittleEndian.AppendUint16(nil, uint16(format))
+	b = binary.LittleEndian.AppendUint16(b, uint16(chnls))
+	b = binary.LittleEndian.AppendUint32(b, uint32(rate))
+	b = binary.LittleEndian.AppendUint32(b, uint32(rate*align))
+	b = binary.LittleEndian.AppendUint16(b, uint16(align))
+	b = binary.LittleEndian.AppendUint16(b, uint16(bits))
+	return chunk("fmt ", b)
+}
+
+// extensibleChunk is a WAVE_FORMAT_EXTENSIBLE fmt chunk with the sub format GUID of the format
+func extensibleChunk(format, chnls, rate, bits int) []byte {
+	c := fmtChunk(wavFormatExtensible, chnls, rate, bits)
+	ext := binary.LittleEndian.AppendUint16(nil, 22) // cbSize
+	ext = binary.LittleEndian.AppendUint16(ext, uint16(bits))
+	ext = binary.LittleEndian.AppendUint32(ext, 0x4) // front centre
+	ext = binary.LittleEndian.AppendUint16(ext, uint16(format))
+	ext = append(ext, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xAA, 0x00, 0x38, 0x9B, 0x71)
+	body := append(c[8:], ext...)
+	return chunk("fmt ", body)
+}
+
+func riff(chunks ...[]byte) []byte {
+	body := []byte("WAVE")
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+func le16(vals ...int16) []byte {
+	var b []byte
+	for _, v := range vals {
+		b = binary.LittleEndian.AppendUint16(b, uint16(v))
+	}
+	return b
+}
+
+func float32s(vals ...float32) []byte {
+	var b []byte
+	for _, v := range vals {
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(v))
+	}
+	return b
+}
+
+func TestDecodeWav(t *testing.T) {
+	streamed := chunk("data", le16(100, -100))
+	binary.LittleEndian.PutUint32(streamed[4:], 0xFFFFFFFF) // size unknown when written
+
+	tests := []struct {
+		name string
+		wav  []byte
+		rate int
+		want []int16
+	}{
+		{"8-bit unsigned", riff(fmtChunk(wavFormatPCM, 1, 8000, 8), chunk("data", []byte{128, 255, 0})), 8000, []int16{0, 32512, -32768}},
+		{"16-bit mono", riff(fmtChunk(wavFormatPCM, 1, 16000, 16), chunk("data", le16(1, -2, 32767))), 16000, []int16{1, -2, 32767}},
+		{"16-bit stereo averaged", riff(fmtChunk(wavFormatPCM, 2, 44100, 16), chunk("data", le16(1000, 3000, -4000, 0))), 44100, []int16{2000, -2000}},
+		{"24-bit", riff(fmtChunk(wavFormatPCM, 1, 48000, 24), chunk("data", []byte{0x56, 0x34, 0x12, 0x00, 0x00, 0x80})), 48000, []int16{0x1234, -32768}},
+		{"32-bit", riff(fmtChunk(wavFormatPCM, 1, 8000, 32), chunk("data", []byte{0x78, 0x56, 0x34, 0x12})), 8000, []int16{0x1234}},
+		{"32-bit float", riff(fmtChunk(wavFormatFloat, 1, 8000, 32), chunk("data", float32s(0.5, -1, 2))), 8000, []int16{16384, -32767, 32767}},
+		{"A-law", riff(fmtChunk(wavFormatALaw, 1, 8000, 8), chunk("data", []byte{0xD5, 0x55, 0xAA})), 8000, []int16{8, -8, 32256}},
+		{"µ-law", riff(fmtChunk(wavFormatULaw, 1, 8000, 8), chunk("data", []byte{0xFF, 0x80, 0x00})), 8000, []int16{0, 32124, -32124}},
+		{"extensible 16-bit", riff(extensibleChunk(wavFormatPCM, 1, 16000, 16), chunk("data", le16(7, -7))), 16000, []int16{7, -7}},
+		{"extensible 24-bit", riff(extensibleChunk(wavFormatPCM, 1, 96000, 24), chunk("data", []byte{0x00, 0x00, 0x40})), 96000, []int16{0x4000}},
+		{"extensible float", riff(extensibleChunk(wavFormatFloat, 1, 8000, 32), chunk("data", float32s(-0.5))), 8000, []int16{-16384}},
+		{"chunks before fmt and odd sized", riff(chunk("LIST", []byte("INFOabc")), fmtChunk(wavFormatPCM, 1, 8000, 16), chunk("fact", []byte{1, 0, 0, 0}), chunk("data", le16(5))), 8000, []int16{5}},
+		{"streamed data size", riff(fmtChunk(wavFormatPCM, 1, 8000, 16), streamed), 8000, []int16{100, -100}},
+		{"trailing partial frame", riff(fmtChunk(wavFormatPCM, 1, 8000, 16), chunk("data", []byte{1, 0, 2})), 8000, []int16{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pcm, rate, err := DecodeWav(tt.wav)
+			if err != nil {
+				t.Fatalf("DecodeWav: %v", err)
+			}
+			if rate != tt.rate {
+				t.Errorf("rate = %d, want %d", rate, tt.rate)
+			}
+			if !slices.Equal(pcm, tt.want) {
+				t.Errorf("samples = %v, want %v", pcm, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeWavInvalid(t *testing.T) {
+	shortFmt := chunk("fmt ", make([]byte, 14))
+	badAlign := fmtChunk(wavFormatPCM, 2, 8000, 16)
+	binary.LittleEndian.PutUint16(badAlign[8+12:], 2)
+
+	tests := []struct {
+		name, wantErr string
+		wav           []byte
+	}{
+		{"empty", "not a RIFF/WAVE", nil},
+		{"not RIFF", "not a RIFF/WAVE", append([]byte("RIFX\x00\x00\x00\x00WAVE"), fmtChunk(wavFormatPCM, 1, 8000, 16)...)},
+		{"not WAVE", "not a RIFF/WAVE", []byte("RIFF\x04\x00\x00\x00AVI ")},
+		{"short fmt", "invalid WAV fmt chunk", riff(shortFmt, chunk("data", le16(1)))},
+		{"data before fmt", "before fmt", riff(chunk("data", le16(1)), fmtChunk(wavFormatPCM, 1, 8000, 16))},
+		{"no data", "no WAV data chunk", riff(fmtChunk(wavFormatPCM, 1, 8000, 16))},
+		{"ADPCM", "unsupported WAV encoding", riff(fmtChunk(2, 1, 8000, 8), chunk("data", []byte{0}))},
+		{"12-bit", "unsupported WAV encoding", riff(fmtChunk(wavFormatPCM, 1, 8000, 12), chunk("data", []byte{0, 0}))},
+		{"no channels", "invalid WAV sample layout", riff(fmtChunk(wavFormatPCM, 0, 8000, 16), chunk("data", le16(1)))},
+		{"block align below frame", "invalid WAV sample layout", riff(badAlign, chunk("data", le16(1, 2)))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := DecodeWav(tt.wav)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func tone(freq float64, rate, n int) []int16 {
+	pcm := make([]int16, n)
+	for i := range pcm {
+		pcm[i] = int16(10000 * math.Sin(2*math.Pi*freq*float64(i)/float64(rate)))
+	}
+	return pcm
+}
+
+func rms(pcm []int16) float64 {
+	var sum float64
+	for _, s := range pcm {
+		sum += float64(s) * float64(s)
+	}
+	return math.Sqrt(sum / float64(len(pcm)))
+}
+
+// zeroCrossings counts sign changes - twice the frequency per second of signal
+func zeroCrossings(pcm []int16) int {
+	n := 0
+	for i := 1; i < len(pcm); i++ {
+		if (pcm[i-1] < 0) != (pcm[i] < 0) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestResample(t *testing.T) {
+	tests := []struct {
+		name      string
+		from, to  int
+		freq      float64
+		wantLen   int
+		wantFreq  float64 // 0 when the tone must be filtered out
+		tolerance float64
+	}{
+		{"8 to 16 kHz", 8000, 16000, 1000, 16000, 1000, 0.01},
+		{"16 to 8 kHz", 16000, 8000, 1000, 8000, 1000, 0.01},
+		{"44.1 to 8 kHz", 44100, 8000, 440, 8000, 440, 0.01},
+		{"48 to 16 kHz", 48000, 16000, 3000, 16000, 3000, 0.01},
+		{"tone above the new Nyquist filtered", 48000, 8000, 6000, 8000, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := tone(tt.freq, tt.from, tt.from) // one second
+			out := Resample(in, tt.from, tt.to)
+			if len(out) != tt.wantLen {
+				t.Fatalf("length = %d, want %d", len(out), tt.wantLen)
+			}
+			body := out[tt.to/10 : len(out)-tt.to/10] // edges without a full filter window
+			if tt.wantFreq == 0 {
+				if r := rms(body); r > 0.05*rms(in) {
+					t.Errorf("aliased tone RMS = %.0f, want below %.0f", r, 0.05*rms(in))
+				}
+				return
+			}
+			freq := float64(zeroCrossings(body)) / 2 / (float64(len(body)) / float64(tt.to))
+			if math.Abs(freq-tt.wantFreq) > tt.tolerance*tt.wantFreq {
+				t.Errorf("frequency = %.1f Hz, want %.1f Hz", freq, tt.wantFreq)
+			}
+			if r, want := rms(body), rms(in); math.Abs(r-want) > 0.02*want {
+				t.Errorf("RMS = %.0f, want %.0f", r, want)
+			}
+		})
+	}
+}
+
+func TestResampleEdgeCases(t *testing.T) {
+	pcm := []int16{1, 2, 3}
+	for _, rates := range [][2]int{{8000, 8000}, {0, 8000}, {8000, -1}} {
+		if out := Resample(pcm, rates[0], rates[1]); !slices.Equal(out, pcm) {
+			t.Errorf("Resample(%d to %d) = %v, want the input", rates[0], rates[1], out)
+		}
+	}
+	if out := Resample(nil, 8000, 16000); len(out) != 0 {
+		t.Errorf("Resample(nil) = %v", out)
+	}
+	if out := Resample(make([]int16, 441), 44100, 8000); len(out) != 80 {
+		t.Errorf("10 ms at 44.1 kHz resampled to %d samples, want 80", len(out))
+	}
+	dc := make([]int16, 800)
+	for i := range dc {
+		dc[i] = 1000
+	}
+	for _, s := range Resample(dc, 8000, 44100)[100:4300] {
+		if s < 995 || s > 1005 {
+			t.Fatalf("DC level = %d, want 1000", s)
+		}
+	}
+}
@@ -5,45 +5,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"os"
-	"os/exec"
-	"path/filepath"
 )
 
-func RunSox(soxpath, parentDir, filenamewithExt, filenameonly string) (string, error) {
-	var filename, rawfilename string
-	var err error
-	filename, err = filepath.Abs(filepath.Join(parentDir, filenamewithExt))
-	if err != nil {
-		return "", err
-	}
-
-	rawfilename, err = filepath.Abs(filepath.Join(parentDir, fmt.Sprintf("%s.raw", filenameonly)))
-	if err != nil {
-		return "", err
-	}
-
-	soxcmd := filepath.Join(soxpath, "sox")
-	cmd := exec.Command(soxcmd, "--clobber", "--no-glob",
-		filename,
-		"-e", "signed-integer",
-		"-b", "16",
-		"-c", "1",
-		"-r", "16000",
-		rawfilename,
-		"speed", "2")
-
-	// Redirect output to console
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	// Run the command
-	err = cmd.Run()
-	if err == nil {
-		_ = os.Remove(filename)
-	}
-	return rawfilename, err
-}
-
 func ReadPCMRaw(filename string) ([]int16, error) {
 	file, err := os.ReadFile(filename)
 	if err != nil {
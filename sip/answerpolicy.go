@@ -0,0 +1,197 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"sipclientgo/sip/status"
+	"sipclientgo/system"
+	"strings"
+	"time"
+)
+
+// answer policy of inbound calls - kept with the UE as mode[:args]
+//   manual                       wait for Answer in the portal (default)
+//   auto[:delay]                 answer after delay ms
+//   reject[:sip[:q850[:delay]]]  reject with the SIP code and Q.850 cause, after ringing for delay ms
+//   ring                         keep ringing until the caller cancels or the call is rejected in the portal
+//   early:audio                  send 183 with SDP and loop the audio as early media until answered in the portal
+//   announce:audio[:delay]       answer after delay ms, play the audio then release the call
+
+const (
+	AnswerManual   = "manual"
+	AnswerAuto     = "auto"
+	AnswerReject   = "reject"
+	AnswerRing     = "ring"
+	AnswerEarly    = "early"
+	AnswerAnnounce = "announce"
+)
+
+type AnswerPolicy struct {
+	Mode    string
+	Delay   int // ms
+	SIPCode int
+	Q850    int
+	Audio   string
+	Loop    bool
+	HangUp  bool
+}
+
+func ParseAnswerPolicy(s string) (*AnswerPolicy, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	plc := &AnswerPolicy{Mode: strings.ToLower(parts[0])}
+	args := parts[1:]
+	num := func(i int, dflt int) (int, error) {
+		if i >= len(args) || args[i] == "" {
+			return dflt, nil
+		}
+		n, ok := system.Str2IntCheck[int](args[i])
+		if !ok || n < 0 {
+			return 0, fmt.Errorf("invalid answer policy value [%s]", args[i])
+		}
+		return n, nil
+	}
+
+	var err error
+	maxArgs := 0
+	switch plc.Mode {
+	case "", AnswerManual:
+		plc.Mode = AnswerManual
+	case AnswerRing:
+	case AnswerAuto:
+		maxArgs = 1
+		plc.Delay, err = num(0, 0)
+	case AnswerReject:
+		maxArgs = 3
+		if plc.SIPCode, err = num(0, status.BusyHere); err != nil {
+			break
+		}
+		if plc.SIPCode < 300 || plc.SIPCode > 699 {
+			return nil, fmt.Errorf("invalid reject SIP code [%d]", plc.SIPCode)
+		}
+		if plc.Q850, err = num(1, 17); err != nil {
+			break
+		}
+		plc.Delay, err = num(2, 0)
+	case AnswerEarly:
+		maxArgs = 1
+		plc.Loop = true
+	case AnswerAnnounce:
+		maxArgs = 2
+		plc.HangUp = true
+		plc.Delay, err = num(1, 0)
+	default:
+		return nil, fmt.Errorf("invalid answer policy mode [%s]", parts[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(args) > maxArgs {
+		return nil, fmt.Errorf("too many answer policy values for [%s]", plc.Mode)
+	}
+	if plc.Mode == AnswerEarly || plc.Mode == AnswerAnnounce {
+		if len(args) == 0 || args[0] == "" {
+			return nil, fmt.Errorf("answer policy [%s] requires an audio key", plc.Mode)
+		}
+		plc.Audio = args[0]
+	}
+	return plc, nil
+}
+
+func (plc *AnswerPolicy) String() string {
+	switch plc.Mode {
+	case AnswerAuto:
+		return fmt.Sprintf("%s:%d", plc.Mode, plc.Delay)
+	case AnswerReject:
+		return fmt.Sprintf("%s:%d:%d:%d", plc.Mode, plc.SIPCode, plc.Q850, plc.Delay)
+	case AnswerEarly:
+		return fmt.Sprintf("%s:%s", plc.Mode, plc.Audio)
+	case AnswerAnnounce:
+		return fmt.Sprintf("%s:%s:%d", plc.Mode, plc.Audio, plc.Delay)
+	}
+	return plc.Mode
+}
+
+// setAnswerPolicy validates and normalises the policy of the UE
+func (ue *UserEquipment) setAnswerPolicy(s string) error {
+	plc, err := ParseAnswerPolicy(s)
+	if err != nil {
+		return err
+	}
+	ue.answerPlc.Store(plc)
+	ue.AnswerPolicy = plc.String()
+	return nil
+}
+
+func (ues *UserEquipments) SetAnswerPolicy(imsi, policy string) error {
+	ue := ues.GetUE(imsi)
+	if ue == nil {
+		return errors.New("UE not found")
+	}
+	return ue.setAnswerPolicy(policy)
+}
+
+// ---------------------------------------------------------------------------
+
+// answerPolicy returns the UE policy - or, when manual, the policy of the MRF repository the call is routed to
+func (ss *SipSession) answerPolicy() *AnswerPolicy {
+	if ss.replaced != nil { // calls replacing an established one are answered at once
+		return &AnswerPolicy{Mode: AnswerAuto}
+	}
+	if ue := ss.UserEquipment; ue != nil {
+		if plc := ue.answerPlc.Load(); plc != nil && plc.Mode != AnswerManual {
+			return plc
+		}
+	}
+	plc := &AnswerPolicy{Mode: AnswerManual}
+	if mp := ss.mrfPolicy(); mp != nil {
+		if mp.AutoAnswer {
+			plc.Mode, plc.Delay = AnswerAuto, mp.AnswerDelay
+		}
+		plc.Audio, plc.Loop, plc.HangUp = mp.Announcement, mp.Loop, mp.HangUp
+	}
+	return plc
+}
+
+// awaitAnswer returns once the call is answered in the portal, the delay (if any) elapses or the session is disposed
+func (ss *SipSession) awaitAnswer(plc *AnswerPolicy) {
+	switch plc.Mode {
+	case AnswerAuto, AnswerAnnounce, AnswerReject:
+		select {
+		case <-ss.AnswerChan:
+		case <-time.After(time.Duration(plc.Delay) * time.Millisecond):
+		}
+	case AnswerRing:
+		for range ss.AnswerChan { // answer requests are ignored
+		}
+	default:
+		<-ss.AnswerChan
+	}
+}
+
+// requestAnswer passes the answer of the portal to awaitAnswer - held in AnswerChan while preconditions or
+// reliable provisionals delay the wait, dropped once the session is disposed and AnswerChan closed
+func (ss *SipSession) requestAnswer() {
+	ss.multiUseMutex.Lock()
+	defer ss.multiUseMutex.Unlock()
+	if ss.IsDisposed {
+		return
+	}
+	select {
+	case ss.AnswerChan <- struct{}{}:
+	default:
+	}
+}
+
+// playAnnouncement starts the policy audio once an inbound call is established
+func (ss *SipSession) playAnnouncement() {
+	plc := ss.answerPlc
+	if plc == nil || plc.Audio == "" || plc.Mode == AnswerEarly {
+		return
+	}
+	if err := ss.playAudio(plc.Audio, plc.Loop, plc.HangUp); err != nil {
+		system.LogError(system.LTMediaStack, fmt.Sprintf("Call [%s] - Failed to play announcement [%s]: %v", ss.CallID, plc.Audio, err))
+	}
+}
@@ -0,0 +1,154 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"sipclientgo/aka"
+	"sipclientgo/global"
+	"sipclientgo/guid"
+	"sipclientgo/system"
+	"strings"
+)
+
+// digest challenge state of the last WWW-Authenticate received by the UE
+type authContext struct {
+	realm     string
+	nonce     string
+	algorithm string
+	opaque    string
+	qop       string
+	username  string
+	password  []byte
+	auts      string
+	nc        uint32 // nonce count - incremented for every request reusing the nonce
+}
+
+// processChallenge parses WWW-Authenticate and computes the digest password - using Milenage for AKAv1-MD5/AKAv2-MD5
+func (ue *UserEquipment) processChallenge(wwwauth string) error {
+	ac, err := parseDigestChallenge(wwwauth)
+	if err != nil {
+		return err
+	}
+
+	ue.authMu.Lock()
+	defer ue.authMu.Unlock()
+	ue.auth = ac
+
+	rslt, err := ue.solveChallenge(ac)
+	if err != nil && !errors.Is(err, aka.ErrMACFailure) {
+		ue.auth = nil
+	}
+	if rslt != nil && ue.secAgree != nil {
+		ue.secAgree.setKeys(rslt.IK)
+	}
+	return err
+}
+
+// parseDigestChallenge returns the state of the first Digest challenge of WWW-Authenticate
+func parseDigestChallenge(wwwauth string) (*authContext, error) {
+	auths := ParseWWWAuthenticateOptimized(wwwauth)
+	idx := -1
+	for i, as := range auths {
+		if strings.EqualFold(as.Scheme, "Digest") {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		return nil, errors.New("no Digest challenge found")
+	}
+	params := auths[idx].Params
+
+	ac := &authContext{
+		realm:     params["realm"],
+		nonce:     params["nonce"],
+		algorithm: params["algorithm"],
+		opaque:    params["opaque"],
+		qop:       params["qop"],
+	}
+	if ac.realm == "" {
+		ac.realm = global.ImsDomain
+	}
+	if ac.algorithm == "" {
+		ac.algorithm = "MD5"
+	}
+	if strings.Contains(ac.qop, "auth") {
+		ac.qop = "auth"
+	}
+	return ac, nil
+}
+
+// solveChallenge sets the credentials answering the challenge - the AKA result is returned on success, authMu must be held
+func (ue *UserEquipment) solveChallenge(ac *authContext) (*aka.Result, error) {
+	if !aka.IsAKA(ac.algorithm) {
+		ac.username = ue.Imsi
+		ac.password = []byte(ue.Ki)
+		return nil, nil
+	}
+
+	ac.username = fmt.Sprintf("%s@%s", ue.Imsi, global.ImsDomain)
+
+	rslt, err := aka.Authenticate(ue.Ki, ue.Opc, ac.nonce, ue.sqnMS)
+	switch {
+	case err == nil:
+		ue.sqnMS = rslt.SQN
+		ac.password = rslt.Password(ac.algorithm)
+		return rslt, nil
+	case errors.Is(err, aka.ErrSyncFailure):
+		// empty password and AUTS to re-synchronise (RFC 3310 section 3.4)
+		ac.password = []byte{}
+		ac.auts = rslt.AUTSString()
+		system.LogWarning(system.LTRegistration, fmt.Sprintf("UE [%s] - SQN out of range - Sending re-synchronisation AUTS", ue.Imsi))
+		return nil, nil
+	case errors.Is(err, aka.ErrMACFailure):
+		// network authentication failed - response is left empty (RFC 3310 section 3.3)
+		ac.password = nil
+		return nil, err
+	default:
+		return nil, err
+	}
+}
+
+func computeAuthorizationHeader(method string, ue *UserEquipment) string {
+	ue.authMu.Lock()
+	defer ue.authMu.Unlock()
+	if ue.auth == nil {
+		return ""
+	}
+	return ue.auth.authorization(method, "sip:"+global.ImsDomain)
+}
+
+// authorization computes the digest credentials of the request - the nonce count is incremented
+func (ac *authContext) authorization(method, uri string) string {
+	ac.nc++
+	nonceCount := fmt.Sprintf("%08x", ac.nc)
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, ac.username, ac.realm, ac.nonce, uri))
+
+	if ac.password == nil {
+		sb.WriteString(`, response=""`)
+	} else {
+		ha1 := guid.Md5Hash(fmt.Sprintf("%s:%s:%s", ac.username, ac.realm, string(ac.password)))
+		ha2 := guid.Md5Hash(fmt.Sprintf("%s:%s", method, uri))
+		if ac.qop == "" {
+			response := guid.Md5Hash(fmt.Sprintf("%s:%s:%s", ha1, ac.nonce, ha2))
+			sb.WriteString(fmt.Sprintf(`, response="%s"`, response))
+		} else {
+			cnonce := guid.GenerateCNonce()
+			response := guid.Md5Hash(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, ac.nonce, nonceCount, cnonce, ac.qop, ha2))
+			sb.WriteString(fmt.Sprintf(`, response="%s", qop=%s, nc=%s, cnonce="%s"`, response, ac.qop, nonceCount, cnonce))
+		}
+	}
+
+	sb.WriteString(", algorithm=" + ac.algorithm)
+
+	if ac.opaque != "" {
+		sb.WriteString(fmt.Sprintf(`, opaque="%s"`, ac.opaque))
+	}
+	if ac.auts != "" {
+		sb.WriteString(fmt.Sprintf(`, auts="%s"`, ac.auts))
+	}
+
+	return sb.String()
+}
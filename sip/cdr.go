@@ -0,0 +1,327 @@
+package sip
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	. "sipclientgo/global"
+	"sipclientgo/sip/mode"
+	"sipclientgo/system"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// call detail records - one per finished call, appended to rotating CSV or JSONL files under CDRPath
+
+const (
+	CDRAnswered  = "answered"
+	CDRCancelled = "cancelled"
+	CDRFailed    = "failed"
+
+	cdrFilePrefix = "cdr-"
+)
+
+type CDR struct {
+	Imsi         string `json:"imsi"`
+	MsIsdn       string `json:"msisdn"`
+	Direction    string `json:"direction"`
+	CallID       string `json:"callID"`
+	CalledNumber string `json:"calledNumber"`
+	SetupTime    string `json:"setupTime"`
+	AnswerTime   string `json:"answerTime"`
+	EndTime      string `json:"endTime"`
+	Duration     int    `json:"duration"`
+	SIPCode      int    `json:"sipCode"`
+	Q850Cause    int    `json:"q850Cause"`
+	Codec        string `json:"codec"`
+	Result       string `json:"result"`
+}
+
+var cdrColumns = []string{"imsi", "msisdn", "direction", "callID", "calledNumber", "setupTime", "answerTime", "endTime", "duration", "sipCode", "q850Cause", "codec", "result"}
+
+func (cdr *CDR) record() []string {
+	return []string{cdr.Imsi, cdr.MsIsdn, cdr.Direction, cdr.CallID, cdr.CalledNumber, cdr.SetupTime, cdr.AnswerTime, cdr.EndTime,
+		system.Int2Str(cdr.Duration), system.Int2Str(cdr.SIPCode), system.Int2Str(cdr.Q850Cause), cdr.Codec, cdr.Result}
+}
+
+func cdrFromRecord(rec []string) (CDR, bool) {
+	if len(rec) != len(cdrColumns) || rec[0] == cdrColumns[0] {
+		return CDR{}, false
+	}
+	return CDR{
+		Imsi:         rec[0],
+		MsIsdn:       rec[1],
+		Direction:    rec[2],
+		CallID:       rec[3],
+		CalledNumber: rec[4],
+		SetupTime:    rec[5],
+		AnswerTime:   rec[6],
+		EndTime:      rec[7],
+		Duration:     system.Str2Int[int](rec[8]),
+		SIPCode:      system.Str2Int[int](rec[9]),
+		Q850Cause:    system.Str2Int[int](rec[10]),
+		Codec:        rec[11],
+		Result:       rec[12],
+	}, true
+}
+
+// ---------------------------------------------------------------------------
+
+type cdrWriter struct {
+	mu     sync.Mutex
+	file   *os.File
+	day    string
+	size   int64
+	format string
+}
+
+var cdrs cdrWriter
+
+// rotate opens a new file on the first write, at midnight UTC and when the size limit is reached
+func (w *cdrWriter) rotate(now time.Time) error {
+	day := now.Format("20060102")
+	if w.file != nil && w.day == day && w.size < CDRMaxFileSize && w.format == CDRFormat {
+		return nil
+	}
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	if err := os.MkdirAll(CDRPath, 0o755); err != nil {
+		return err
+	}
+	fn := filepath.Join(CDRPath, fmt.Sprintf("%s%s.%s", cdrFilePrefix, now.Format("20060102-150405.000"), CDRFormat))
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	w.file, w.day, w.size, w.format = f, day, 0, CDRFormat
+	if CDRFormat == CDRFormatCSV {
+		return w.writeCSV(cdrColumns)
+	}
+	return nil
+}
+
+func (w *cdrWriter) writeCSV(rec []string) error {
+	var sb strings.Builder
+	cw := csv.NewWriter(&sb)
+	_ = cw.Write(rec)
+	cw.Flush()
+	n, err := io.WriteString(w.file, sb.String())
+	w.size += int64(n)
+	return err
+}
+
+func (w *cdrWriter) write(cdr *CDR) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.rotate(time.Now().UTC()); err != nil {
+		system.LogError(system.LTSystem, "Failed to open CDR file: "+err.Error())
+		return
+	}
+	var err error
+	if w.format == CDRFormatCSV {
+		err = w.writeCSV(cdr.record())
+	} else {
+		var data []byte
+		data, _ = json.Marshal(cdr)
+		var n int
+		n, err = w.file.Write(append(data, '\n'))
+		w.size += int64(n)
+	}
+	if err != nil {
+		system.LogError(system.LTSystem, "Failed to write CDR: "+err.Error())
+	}
+}
+
+// ---------------------------------------------------------------------------
+
+// noteReleaseCause keeps the first Q.850 cause carried by a call release i.e. BYE, CANCEL or INVITE rejection
+func (ss *SipSession) noteReleaseCause(m Method, msg *SipMessage) {
+	if ss.q850Cause != 0 || ss.Mode != mode.Multimedia {
+		return
+	}
+	if msg.IsRequest() {
+		if m != BYE && m != CANCEL {
+			return
+		}
+	} else if m != INVITE || msg.StartLine.StatusCode < 300 {
+		return
+	}
+	for _, rsn := range msg.Headers.HeaderValues(Reason) {
+		for _, part := range strings.Split(rsn, ",") {
+			prms := strings.Split(part, ";")
+			if !strings.EqualFold(strings.TrimSpace(prms[0]), "Q.850") {
+				continue
+			}
+			for _, prm := range prms[1:] {
+				if k, v, ok := strings.Cut(strings.TrimSpace(prm), "="); ok && strings.EqualFold(k, "cause") {
+					ss.q850Cause = system.Str2Int[int](strings.TrimSpace(v))
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeCDR builds the call detail record from the initial INVITE transaction - called once when the session is disposed
+func (ss *SipSession) writeCDR() {
+	if ss.Mode != mode.Multimedia || ss.UserEquipment == nil || CDRPath == "" {
+		return
+	}
+
+	var invite *Transaction
+	ss.TransLock.RLock()
+	for _, trans := range ss.Transactions {
+		if trans.Method == INVITE {
+			invite = trans
+			break
+		}
+	}
+	ss.TransLock.RUnlock()
+	if invite == nil {
+		return
+	}
+
+	ue := ss.UserEquipment
+	cdr := CDR{
+		Imsi:      ue.Imsi,
+		MsIsdn:    ue.MsIsdn,
+		Direction: ss.Direction.String(),
+		CallID:    ss.CallID,
+		SetupTime: ss.SetupTime.Format(DicTFs[JsonDateTimeMS]),
+		Q850Cause: ss.q850Cause,
+	}
+
+	invite.Lock.RLock()
+	if invite.Direction == INBOUND {
+		if invite.RequestMessage != nil {
+			cdr.CalledNumber = invite.RequestMessage.StartLine.UserPart
+		}
+	} else if invite.SentMessage != nil {
+		cdr.CalledNumber = invite.SentMessage.StartLine.UserPart
+	}
+	for _, sc := range invite.Responses {
+		if sc >= 200 {
+			cdr.SIPCode = sc
+		}
+	}
+	invite.Lock.RUnlock()
+
+	endtm := ss.EndTime
+	if endtm.IsZero() {
+		endtm = time.Now().UTC()
+	}
+	cdr.EndTime = endtm.Format(DicTFs[JsonDateTimeMS])
+
+	switch {
+	case !ss.AnswerTime.IsZero():
+		cdr.Result = CDRAnswered
+		cdr.AnswerTime = ss.AnswerTime.Format(DicTFs[JsonDateTimeMS])
+		cdr.Duration = int(endtm.Sub(ss.AnswerTime).Round(time.Second).Seconds())
+		if ss.LocalSDP != nil {
+			if flow := ss.LocalSDP.GetAudioMediaFlow(); flow != nil {
+				if frmt := flow.FormatByPayload(ss.rtpPayloadType); frmt != nil {
+					cdr.Codec = frmt.Name
+				}
+			}
+		}
+	case cdr.SIPCode == 487 || cdr.SIPCode == 0:
+		cdr.Result = CDRCancelled
+	default:
+		cdr.Result = CDRFailed
+	}
+
+	cdrs.write(&cdr)
+}
+
+// ---------------------------------------------------------------------------
+
+type CDRFilter struct {
+	From   time.Time
+	To     time.Time
+	Imsi   string
+	Result string
+}
+
+func (fltr *CDRFilter) match(cdr *CDR) bool {
+	if fltr.Imsi != "" && cdr.Imsi != fltr.Imsi {
+		return false
+	}
+	if fltr.Result != "" && !strings.EqualFold(cdr.Result, fltr.Result) {
+		return false
+	}
+	if fltr.From.IsZero() && fltr.To.IsZero() {
+		return true
+	}
+	setup, err := time.Parse(DicTFs[JsonDateTimeMS], cdr.SetupTime)
+	if err != nil {
+		return false
+	}
+	if !fltr.From.IsZero() && setup.Before(fltr.From) {
+		return false
+	}
+	if !fltr.To.IsZero() && setup.After(fltr.To) {
+		return false
+	}
+	return true
+}
+
+// QueryCDRs scans the CDR files of both formats and returns the matching records ordered by setup time
+func QueryCDRs(fltr CDRFilter) ([]CDR, error) {
+	entries, err := os.ReadDir(CDRPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []CDR{}, nil
+		}
+		return nil, err
+	}
+
+	cdrs.mu.Lock()
+	defer cdrs.mu.Unlock()
+
+	result := []CDR{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, cdrFilePrefix) {
+			continue
+		}
+		f, err := os.Open(filepath.Join(CDRPath, name))
+		if err != nil {
+			system.LogWarning(system.LTSystem, "Failed to open CDR file: "+err.Error())
+			continue
+		}
+		switch filepath.Ext(name) {
+		case "." + CDRFormatCSV:
+			cr := csv.NewReader(f)
+			cr.FieldsPerRecord = -1
+			for {
+				rec, err := cr.Read()
+				if err != nil {
+					break
+				}
+				if cdr, ok := cdrFromRecord(rec); ok && fltr.match(&cdr) {
+					result = append(result, cdr)
+				}
+			}
+		case "." + CDRFormatJSONL:
+			scnr := bufio.NewScanner(f)
+			for scnr.Scan() {
+				var cdr CDR
+				if json.Unmarshal(scnr.Bytes(), &cdr) == nil && fltr.match(&cdr) {
+					result = append(result, cdr)
+				}
+			}
+		}
+		f.Close()
+	}
+
+	slices.SortStableFunc(result, func(a, b CDR) int { return strings.Compare(a.SetupTime, b.SetupTime) })
+	return result, nil
+}
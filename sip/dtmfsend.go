@@ -0,0 +1,221 @@
+package sip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sipclientgo/dtmf"
+	. "sipclientgo/global"
+	"sipclientgo/rtp"
+	"sipclientgo/system"
+	"strings"
+	"time"
+
+	"github.com/Moatassem/sdp"
+)
+
+// outbound DTMF on established calls - RFC 4733 telephone-events, SIP INFO (application/dtmf-relay) or in-band dual tones
+// RTP methods stop any ongoing playback and share its SSRC, sequence numbers and timestamps
+
+const (
+	DTMFMethodRFC4733 = "rfc4733"
+	DTMFMethodINFO    = "info"
+	DTMFMethodInband  = "inband"
+
+	dtmfDigits          = "0123456789*#ABCD"
+	dtmfDefaultDuration = 160 // ms
+	dtmfMinDuration     = 40
+	dtmfMaxDuration     = 5000
+	dtmfGap             = 100 // ms of silence between digits
+	rfc4733Volume       = 10  // -dBm0
+	rfc4733EndPackets   = 3   // end of event packets, the last two being redundant
+)
+
+type DTMFRequest struct {
+	CallID   string `json:"callID"`
+	Digits   string `json:"digits"`
+	Method   string `json:"method,omitempty"`   // RFC 4733 when negotiated, in-band otherwise
+	Duration int    `json:"duration,omitempty"` // ms per digit
+}
+
+// rtpFrame is one packetization interval of outbound RTP - no packet is sent for a nil payload
+type rtpFrame struct {
+	pt      uint8
+	marker  bool
+	ts      uint32
+	payload []byte
+	audio   bool
+}
+
+// SendDTMF validates the request and sends the digits in the background
+func SendDTMF(req DTMFRequest) error {
+	ss, ok := findCall(req.CallID)
+	if !ok {
+		return ErrCallNotFound
+	}
+	return ss.sendDigits(req.Digits, req.Method, req.Duration, false)
+}
+
+// sendDigits sends the digits with the method - waiting for the last one to be sent when wait is set
+func (ss *SipSession) sendDigits(digits, method string, duration int, wait bool) error {
+	digits = strings.ToUpper(digits)
+	if digits == "" || strings.ContainsFunc(digits, func(r rune) bool { return !strings.ContainsRune(dtmfDigits, r) }) {
+		return fmt.Errorf("%w: invalid digits [%s]", ErrInvalidRequest, digits)
+	}
+	if duration == 0 {
+		duration = dtmfDefaultDuration
+	}
+	if duration < dtmfMinDuration || duration > dtmfMaxDuration {
+		return fmt.Errorf("%w: duration must be between %d and %d ms", ErrInvalidRequest, dtmfMinDuration, dtmfMaxDuration)
+	}
+	if !ss.IsEstablished() {
+		return errors.New("call not established")
+	}
+	method = strings.ToLower(method)
+	switch method {
+	case "":
+		method = DTMFMethodInband
+		if ss.WithTeleEvents {
+			method = DTMFMethodRFC4733
+		}
+	case DTMFMethodRFC4733:
+		if !ss.WithTeleEvents {
+			return errors.New("telephone-event not negotiated")
+		}
+	case DTMFMethodINFO, DTMFMethodInband:
+	default:
+		return fmt.Errorf("%w: invalid DTMF method [%s]", ErrInvalidRequest, method)
+	}
+	if method != DTMFMethodINFO && (ss.RemoteMedia == nil || sdp.IsMedDirHolding(ss.RemoteMedDir)) {
+		return errors.New("no active media")
+	}
+	if !ss.dtmfSending.CompareAndSwap(false, true) {
+		return errors.New("digits already being sent")
+	}
+
+	send := func() error {
+		defer ss.dtmfSending.Store(false)
+		if method == DTMFMethodINFO {
+			ss.sendDTMFRelay(digits, duration)
+		} else {
+			if ss.stopPlayback() && !waitFor(time.Second, func() bool { return !ss.isPlaying() }) {
+				return errors.New("ongoing playback could not be stopped")
+			}
+			var frames []rtpFrame
+			if method == DTMFMethodRFC4733 {
+				frames = ss.rfc4733Frames(digits, duration)
+			} else {
+				frames = ss.inbandFrames(digits, duration)
+			}
+			if err := ss.streamFrames(frames); err != nil {
+				return err
+			}
+		}
+		system.LogInfo(system.LTDTMF, fmt.Sprintf("Call [%s] - Sent DTMF [%s] via %s", ss.CallID, digits, method))
+		return nil
+	}
+	if wait {
+		return send()
+	}
+	go func() {
+		if err := send(); err != nil {
+			system.LogError(system.LTDTMF, fmt.Sprintf("Call [%s] - Failed to send DTMF [%s]: %v", ss.CallID, digits, err))
+		}
+	}()
+	return nil
+}
+
+func rtpTicks() uint32 {
+	return uint32(SamplingRate * PacketizationTime / 1000)
+}
+
+// rfc4733Frames builds the event packets - the timestamp of all packets of an event is the event start
+func (ss *SipSession) rfc4733Frames(digits string, duration int) []rtpFrame {
+	var frames []rtpFrame
+	ticks := rtpTicks()
+	total := uint32(SamplingRate * duration / 1000)
+	ts := ss.rtpTimeStmp
+	for i, d := range digits {
+		if i > 0 {
+			for range dtmfGap / PacketizationTime {
+				frames = append(frames, rtpFrame{})
+				ts += ticks
+			}
+		}
+		start := ts + ticks
+		for dur := ticks; ; dur += ticks {
+			end := dur >= total
+			reps := 1
+			if end {
+				dur, reps = total, rfc4733EndPackets
+			}
+			payload := make([]byte, 4)
+			payload[0] = DicDTMFSignal[string(d)]
+			payload[1] = bool2byte(end)<<7 | rfc4733Volume
+			binary.BigEndian.PutUint16(payload[2:], uint16(dur))
+			for range reps {
+				ts += ticks
+				frames = append(frames, rtpFrame{pt: ss.rtpEventType, marker: dur == ticks, ts: start, payload: payload})
+			}
+			if end {
+				break
+			}
+		}
+	}
+	ss.rtpTimeStmp = ts
+	return frames
+}
+
+// inbandFrames encodes the dual tones with the negotiated codec
+func (ss *SipSession) inbandFrames(digits string, duration int) []rtpFrame {
+	var pcm []int16
+	for _, d := range digits {
+		tone, _ := dtmf.GenerateTone(string(d), SamplingRate, duration, dtmfGap)
+		pcm = append(pcm, tone...)
+	}
+	if rem := len(pcm) % RTPPayloadSize; rem != 0 {
+		pcm = append(pcm, make([]int16, RTPPayloadSize-rem)...)
+	}
+	data := rtp.EncodePCM(pcm, ss.rtpPayloadType)
+	frames := make([]rtpFrame, 0, len(data)/RTPPayloadSize)
+	for off := 0; off+RTPPayloadSize <= len(data); off += RTPPayloadSize {
+		ss.rtpTimeStmp += rtpTicks()
+		frames = append(frames, rtpFrame{pt: ss.rtpPayloadType, marker: off == 0, ts: ss.rtpTimeStmp, payload: data[off : off+RTPPayloadSize], audio: true})
+	}
+	return frames
+}
+
+// streamFrames sends one frame per packetization interval - stopped if the call is no longer established
+func (ss *SipSession) streamFrames(frames []rtpFrame) error {
+	tckr := time.NewTicker(time.Duration(PacketizationTime) * time.Millisecond)
+	defer tckr.Stop()
+	for _, frm := range frames {
+		<-tckr.C
+		if !ss.IsEstablished() || ss.MediaListener == nil {
+			return errors.New("call no longer established")
+		}
+		if frm.payload == nil {
+			continue
+		}
+		ss.rtpSequenceNum++
+		pktptr := RTPTXBufferPool.Get().(*[]byte)
+		pkt := (*pktptr)[:0]
+		pkt = append(pkt, 128, bool2byte(frm.marker)*128+frm.pt)
+		pkt = append(pkt, uint16ToBytes(ss.rtpSequenceNum)...)
+		pkt = append(pkt, uint32ToBytes(frm.ts)...)
+		pkt = append(pkt, uint32ToBytes(ss.rtpSSRC)...)
+		pkt = append(pkt, frm.payload...)
+		_, err := ss.MediaListener.WriteToUDP(pkt, ss.RemoteMedia)
+		if err == nil {
+			capturePacket(ss, ss.MediaListener.LocalAddr(), ss.RemoteMedia, pkt)
+			if frm.audio {
+				ss.recordRTP(OUTBOUND, pkt)
+			}
+		}
+		RTPTXBufferPool.Put(pktptr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
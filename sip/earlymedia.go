@@ -0,0 +1,64 @@
+package sip
+
+import (
+	"fmt"
+	. "sipclientgo/global"
+	"sipclientgo/system"
+	"time"
+)
+
+// early media and reliable provisional responses (RFC 3262)
+// inbound calls send 180/183 reliably when the caller supports 100rel, outbound calls PRACK reliable 18x and
+// apply any SDP they carry so early media is received and recorded before answer
+
+// sendProvisional sends the 18x - reliably when the caller supports 100rel
+func (ss *SipSession) sendProvisional(trans *Transaction, sc int, body MessageBody) {
+	ss.SendResponseDetailed(trans, ResponsePack{StatusCode: sc, PRACKRequested: ss.IsPRACKSupported}, body)
+	ss.logSessData(nil, nil, sc)
+}
+
+// awaitPRACK returns once all reliable provisional responses are PRACKed - false if the session is no longer being established
+func (ss *SipSession) awaitPRACK() bool {
+	waitFor(64*time.Duration(T1Timer)*time.Millisecond, func() bool {
+		return ss.UnPRACKed18xCountSYNC() == 0 || !ss.IsBeingEstablished()
+	})
+	return ss.IsBeingEstablished() && ss.UnPRACKed18xCountSYNC() == 0
+}
+
+// prackProvisional acknowledges a reliable 18x of an outbound call - retransmitted or out of order ones are ignored
+func (ss *SipSession) prackProvisional(sipmsg *SipMessage) {
+	if !sipmsg.IsOptionRequired("100rel") {
+		return
+	}
+	rSeq := system.Str2Uint[uint32](sipmsg.Headers.ValueHeader(RSeq))
+	if rSeq == 0 {
+		system.LogWarning(system.LTSIPStack, fmt.Sprintf("Reliable provisional response without RSeq - Call-ID [%s]", ss.CallID))
+		return
+	}
+	ss.multiUseMutex.Lock()
+	if ss.remoteRSeq != 0 && rSeq <= ss.remoteRSeq {
+		ss.multiUseMutex.Unlock()
+		return
+	}
+	ss.remoteRSeq = rSeq
+	ss.multiUseMutex.Unlock()
+
+	ss.SendRequest(PRACK, ss.GenerateOutgoingPRACKST(sipmsg), EmptyBody())
+}
+
+// applyEarlyMedia applies the SDP of the first 18x carrying one and starts receiving and recording its media
+func (ss *SipSession) applyEarlyMedia(sipmsg *SipMessage) {
+	if ss.Direction != OUTBOUND || ss.RemoteMedia != nil || !ss.processSDPAnswer(sipmsg) {
+		return
+	}
+	system.LogInfo(system.LTMediaStack, fmt.Sprintf("Call [%s] - Early media from %s", ss.CallID, ss.RemoteMedia))
+	ss.autoRecord()
+	ss.startMediaReceiver()
+}
+
+// startMediaReceiver starts the RTP receiving loop once per session
+func (ss *SipSession) startMediaReceiver() {
+	if ss.mediaReceiving.CompareAndSwap(false, true) {
+		go ss.mediaReceiver()
+	}
+}
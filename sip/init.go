@@ -3,6 +3,7 @@ package sip
 import (
 	"fmt"
 	"sipclientgo/global"
+	"sipclientgo/system"
 
 	"github.com/Moatassem/sdp"
 )
@@ -24,5 +25,14 @@ func StartServer() {
 
 	fmt.Printf("Loading files in directory: %s\n", global.MediaPath)
 	MRFRepos = NewMRFRepoCollection(global.MRFRepoName)
-	fmt.Printf("Audio files loaded: %d\n", MRFRepos.FilesCount(global.MRFRepoName))
+	for _, rn := range MRFRepos.Names() {
+		fmt.Printf("Audio files loaded: %d (repository: %s)\n", MRFRepos.FilesCount(rn), rn)
+	}
+	go MRFRepos.watchMedia()
+
+	if global.CaptureOnStart {
+		if _, err := StartCapture(); err != nil {
+			system.LogError(system.LTSystem, "Failed to start packet capture: "+err.Error())
+		}
+	}
 }
@@ -20,6 +20,22 @@ type Packet struct {
 	sourceAddr *net.UDPAddr
 	buffer     *[]byte
 	bytesCount int
+	conn       *net.UDPConn
+	stream     *streamConn
+}
+
+func (packet *Packet) localAddr() net.Addr {
+	if packet.stream != nil {
+		return packet.stream.conn.LocalAddr()
+	}
+	return packet.conn.LocalAddr()
+}
+
+func (packet *Packet) transport() global.Transport {
+	if packet.stream != nil {
+		return packet.stream.transport
+	}
+	return global.TransportUDP
 }
 
 func startWorkers(ue *UserEquipment, queue <-chan Packet) {
@@ -30,7 +46,7 @@ func startWorkers(ue *UserEquipment, queue <-chan Packet) {
 	}
 }
 
-func udpLoopWorkers(ue *UserEquipment, queue chan<- Packet) {
+func udpLoopWorkers(ue *UserEquipment, conn *net.UDPConn, queue chan<- Packet) {
 	global.WtGrp.Add(1)
 	atomic.AddInt32(&global.WtGrpC, 1)
 	defer func() {
@@ -38,17 +54,25 @@ func udpLoopWorkers(ue *UserEquipment, queue chan<- Packet) {
 		atomic.AddInt32(&global.WtGrpC, -1)
 		if r := recover(); r != nil {
 			system.LogCallStack(r)
-			udpLoopWorkers(ue, queue)
+			udpLoopWorkers(ue, conn, queue)
 		}
 	}()
 	go func() {
 		for {
 			buf := global.BufferPool.Get().(*[]byte)
-			n, addr, err := ue.UDPListener.ReadFromUDP(*buf)
+			n, addr, err := conn.ReadFromUDP(*buf)
 			if err != nil {
 				break
 			}
-			queue <- Packet{sourceAddr: addr, buffer: buf, bytesCount: n}
+			if ue.secAgreeMode() == SecAgreeESP && ue.secAgree.isProtected(conn) {
+				n, err = ue.decapsulate(conn, (*buf)[:n])
+				if err != nil {
+					system.LogWarning(system.LTSIPStack, fmt.Sprintf("UE [%s] - Dropped ESP packet from [%s]: %v", ue.Imsi, addr, err))
+					global.BufferPool.Put(buf)
+					continue
+				}
+			}
+			queue <- Packet{sourceAddr: addr, buffer: buf, bytesCount: n, conn: conn}
 		}
 	}()
 }
@@ -62,7 +86,9 @@ func worker(ue *UserEquipment, queue <-chan Packet) {
 }
 
 func processPacket(packet Packet, ue *UserEquipment) {
-	pdu := (*packet.buffer)[:packet.bytesCount]
+	raw := (*packet.buffer)[:packet.bytesCount]
+	pdu := raw
+	captured := !IsCapturing()
 	for {
 		if len(pdu) == 0 {
 			break
@@ -76,12 +102,30 @@ func processPacket(packet Packet, ue *UserEquipment) {
 			break
 		}
 		ss, newSesType := sessionGetter(msg, ue)
+		if !captured { // the whole datagram goes to the capture of the first message session
+			capturePacket(ss, packet.sourceAddr, packet.localAddr(), raw)
+			captured = true
+		}
 		if ss != nil {
+			ss.traceMessage(global.INBOUND, packet.transport(), packet.localAddr(), packet.sourceAddr, pdu[:len(pdu)-len(pdutmp)])
 			ss.RemoteUDP = packet.sourceAddr
-			ss.SIPUDPListenser = ue.UDPListener
+			if packet.stream == nil {
+				ss.SIPUDPListenser = packet.conn
+				ss.SIPTransport = global.TransportUDP
+			} else {
+				if ss.SIPUDPListenser == nil { // local address for Via, Contact and SDP
+					ss.SIPUDPListenser = ue.UDPListener
+				}
+				ss.SIPTransport = packet.stream.transport
+			}
 		}
 		sipStack(msg, ss, newSesType)
 		pdu = pdutmp
 	}
-	global.BufferPool.Put(packet.buffer)
+	if !captured {
+		capturePacket(nil, packet.sourceAddr, packet.localAddr(), raw)
+	}
+	if packet.stream == nil {
+		global.BufferPool.Put(packet.buffer)
+	}
 }
@@ -0,0 +1,421 @@
+package sip
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	. "sipclientgo/global"
+	"sipclientgo/system"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// =================================================================================================
+// Load generator - paced call attempts over a pool of UEs with concurrency cap, ramp-up and hold time
+
+const (
+	LoadRunning   = "running"
+	LoadStopped   = "stopped"
+	LoadCompleted = "completed"
+
+	HoldFixed       = "fixed"
+	HoldUniform     = "uniform"
+	HoldExponential = "exponential"
+
+	loadTickInterval     = 10 * time.Millisecond
+	loadAnswerTimeout    = 60 // seconds
+	loadReleaseTimeout   = 5 * time.Second
+	loadDefaultHoldTime  = 10000 // ms
+	loadNoFinalResponse  = "No final response"
+	loadMaxPDDSamples    = 1000000
+	loadDefaultMaxActive = 100
+)
+
+type LoadProfile struct {
+	UEs           []string     `json:"ues"`           // IMSIs - all enabled UEs if empty
+	Numbers       []string     `json:"numbers"`       // called numbers used in round robin
+	CPS           float64      `json:"cps"`           // target call attempts per second
+	MaxConcurrent int          `json:"maxConcurrent"` // cap on simultaneous calls
+	RampUp        int          `json:"rampUp"`        // seconds to reach target CPS linearly
+	Duration      int          `json:"duration"`      // seconds of call generation - 0 until stopped
+	TotalCalls    int          `json:"totalCalls"`    // 0 for unlimited
+	Preconditions bool         `json:"preconditions"` // offer QoS preconditions
+	AnswerTimeout int          `json:"answerTimeout"` // seconds to wait for a final response
+	HoldTime      HoldTimeDist `json:"holdTime"`
+}
+
+type HoldTimeDist struct {
+	Distribution string `json:"distribution"` // fixed, uniform or exponential
+	Mean         int    `json:"mean"`         // ms - fixed and exponential
+	Min          int    `json:"min"`          // ms - uniform
+	Max          int    `json:"max"`          // ms - uniform
+}
+
+type PDDPercentiles struct {
+	P50 int64 `json:"p50"`
+	P90 int64 `json:"p90"`
+	P95 int64 `json:"p95"`
+	P99 int64 `json:"p99"`
+	Max int64 `json:"max"`
+}
+
+type LoadStats struct {
+	Status       string           `json:"status"`
+	StartTime    string           `json:"startTime"`
+	EndTime      string           `json:"endTime"`
+	TargetCPS    float64          `json:"targetCPS"`
+	CurrentCPS   float64          `json:"currentCPS"`
+	Attempts     int64            `json:"attempts"`
+	Answered     int64            `json:"answered"`
+	Failed       int64            `json:"failed"`
+	Active       int64            `json:"active"`
+	Throttled    int64            `json:"throttled"`
+	ASR          float64          `json:"asr"`   // answered/completed attempts %
+	PDD          PDDPercentiles   `json:"pddMs"` // INVITE to first 18x or 2xx
+	FailureCodes map[string]int64 `json:"failureCodes"`
+}
+
+type loadGenerator struct {
+	profile LoadProfile
+	pool    []*UserEquipment
+	stopCh  chan struct{}
+	wg      sync.WaitGroup
+
+	attempts  atomic.Int64
+	answered  atomic.Int64
+	failed    atomic.Int64
+	active    atomic.Int64
+	throttled atomic.Int64
+
+	mu         sync.Mutex
+	status     string
+	startTime  time.Time
+	endTime    time.Time
+	currentCPS float64
+	pdds       []int64
+	failures   map[string]int64
+}
+
+var (
+	loadMu  sync.Mutex
+	loadGen *loadGenerator
+
+	// ErrInvalidProfile is returned when the load profile cannot be run
+	ErrInvalidProfile = errors.New("invalid load profile")
+	ErrLoadRunning    = errors.New("load already running")
+)
+
+// StartLoad validates the profile and starts generating calls - only one load run at a time
+func StartLoad(prfl LoadProfile) error {
+	if prfl.CPS <= 0 {
+		return fmt.Errorf("%w: invalid CPS", ErrInvalidProfile)
+	}
+	if prfl.MaxConcurrent < 0 || prfl.RampUp < 0 || prfl.Duration < 0 || prfl.TotalCalls < 0 || prfl.AnswerTimeout < 0 {
+		return fmt.Errorf("%w: negative concurrency, duration or count", ErrInvalidProfile)
+	}
+	if len(prfl.Numbers) == 0 {
+		return fmt.Errorf("%w: no called numbers", ErrInvalidProfile)
+	}
+	switch prfl.HoldTime.Distribution {
+	case "":
+		prfl.HoldTime.Distribution = HoldFixed
+	case HoldFixed, HoldExponential:
+	case HoldUniform:
+		if prfl.HoldTime.Max < prfl.HoldTime.Min {
+			return fmt.Errorf("%w: invalid uniform hold time range", ErrInvalidProfile)
+		}
+	default:
+		return fmt.Errorf("%w: invalid hold time distribution: %s", ErrInvalidProfile, prfl.HoldTime.Distribution)
+	}
+	prfl.MaxConcurrent = cmp.Or(prfl.MaxConcurrent, loadDefaultMaxActive)
+	prfl.AnswerTimeout = cmp.Or(prfl.AnswerTimeout, loadAnswerTimeout)
+
+	var pool []*UserEquipment
+	if len(prfl.UEs) == 0 {
+		for _, ue := range UEs.GetUEs() {
+			if ue.Enabled {
+				pool = append(pool, ue)
+			}
+		}
+	} else {
+		for _, imsi := range prfl.UEs {
+			ue := UEs.GetUE(imsi)
+			if ue == nil {
+				return fmt.Errorf("%w: UE [%s] not found", ErrInvalidProfile, imsi)
+			}
+			pool = append(pool, ue)
+		}
+	}
+	if len(pool) == 0 {
+		return fmt.Errorf("%w: no UEs available for load", ErrInvalidProfile)
+	}
+	slices.SortFunc(pool, func(a, b *UserEquipment) int { return cmp.Compare(a.Imsi, b.Imsi) })
+
+	loadMu.Lock()
+	defer loadMu.Unlock()
+	if loadGen != nil && loadGen.getStatus() == LoadRunning {
+		return ErrLoadRunning
+	}
+	lg := &loadGenerator{
+		profile:   prfl,
+		pool:      pool,
+		stopCh:    make(chan struct{}),
+		status:    LoadRunning,
+		startTime: time.Now().UTC(),
+		failures:  make(map[string]int64),
+	}
+	loadGen = lg
+	system.LogInfo(system.LTStressTester, fmt.Sprintf("Load started - Target [%.2f] CPS, Max [%d] concurrent calls, [%d] UEs", prfl.CPS, prfl.MaxConcurrent, len(pool)))
+	go lg.generate()
+	return nil
+}
+
+// StopLoad stops generating new calls - active calls end on their hold time
+func StopLoad() error {
+	loadMu.Lock()
+	defer loadMu.Unlock()
+	if loadGen == nil || loadGen.getStatus() != LoadRunning {
+		return errors.New("no load running")
+	}
+	loadGen.stop()
+	return nil
+}
+
+// GetLoadStats returns the current or last load run statistics
+func GetLoadStats() *LoadStats {
+	loadMu.Lock()
+	lg := loadGen
+	loadMu.Unlock()
+	if lg == nil {
+		return nil
+	}
+	return lg.stats()
+}
+
+func (lg *loadGenerator) getStatus() string {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	return lg.status
+}
+
+func (lg *loadGenerator) stop() {
+	select {
+	case <-lg.stopCh:
+	default:
+		close(lg.stopCh)
+	}
+}
+
+func (lg *loadGenerator) generate() {
+	prfl := lg.profile
+	tckr := time.NewTicker(loadTickInterval)
+	defer tckr.Stop()
+
+	var deadline <-chan time.Time
+	if prfl.Duration > 0 {
+		tmr := time.NewTimer(time.Duration(prfl.Duration) * time.Second)
+		defer tmr.Stop()
+		deadline = tmr.C
+	}
+
+	status := LoadCompleted
+	last := time.Now()
+	credits := 0.0
+	idx := 0
+loop:
+	for {
+		select {
+		case <-lg.stopCh:
+			status = LoadStopped
+			break loop
+		case <-deadline:
+			break loop
+		case now := <-tckr.C:
+			rate := prfl.CPS
+			if elapsed := now.Sub(lg.startTime).Seconds(); prfl.RampUp > 0 && elapsed < float64(prfl.RampUp) {
+				rate *= elapsed / float64(prfl.RampUp)
+			}
+			lg.mu.Lock()
+			lg.currentCPS = rate
+			lg.mu.Unlock()
+
+			credits += rate * now.Sub(last).Seconds()
+			last = now
+			for ; credits >= 1; credits-- {
+				if prfl.TotalCalls > 0 && idx >= prfl.TotalCalls { // idx counts the calls placed - throttled ticks excluded
+					break loop
+				}
+				if lg.active.Load() >= int64(prfl.MaxConcurrent) {
+					lg.throttled.Add(1)
+					continue
+				}
+				ue := lg.pool[idx%len(lg.pool)]
+				cdpn := prfl.Numbers[idx%len(prfl.Numbers)]
+				idx++
+				lg.active.Add(1)
+				lg.wg.Add(1)
+				go lg.placeCall(ue, cdpn)
+			}
+		}
+	}
+
+	lg.mu.Lock()
+	lg.currentCPS = 0
+	lg.mu.Unlock()
+	lg.wg.Wait()
+
+	lg.mu.Lock()
+	lg.status = status
+	lg.endTime = time.Now().UTC()
+	lg.mu.Unlock()
+
+	st := lg.stats()
+	system.LogInfo(system.LTStressTester, fmt.Sprintf("Load %s - Attempts [%d], Answered [%d], Failed [%d], Throttled [%d], ASR [%.2f%%], PDD ms p50/p90/p95/p99 [%d/%d/%d/%d], Failures %v",
+		status, st.Attempts, st.Answered, st.Failed, st.Throttled, st.ASR, st.PDD.P50, st.PDD.P90, st.PDD.P95, st.PDD.P99, st.FailureCodes))
+}
+
+func (lg *loadGenerator) placeCall(ue *UserEquipment, cdpn string) {
+	defer func() {
+		if r := recover(); r != nil {
+			system.LogCallStack(r)
+		}
+		lg.active.Add(-1)
+		lg.wg.Done()
+	}()
+
+	lg.attempts.Add(1)
+	start := time.Now()
+	callID, err := UEs.DoCall(ue.Imsi, cdpn, lg.profile.Preconditions)
+	if err != nil {
+		lg.recordFailure(err.Error())
+		return
+	}
+	ss, ok := ue.SesMap.Load(callID)
+	if !ok {
+		lg.recordFailure("Session dropped")
+		return
+	}
+
+	// wait for PDD and the final response
+	pddDone := false
+	final := 0
+	timedOut := !waitFor(time.Duration(lg.profile.AnswerTimeout)*time.Second, func() bool {
+		trans := ss.outboundTransaction(INVITE)
+		if trans == nil {
+			return false
+		}
+		trans.Lock.RLock()
+		defer trans.Lock.RUnlock()
+		for _, r := range trans.Responses {
+			if !pddDone && (180 <= r && r <= 189 || 200 <= r && r <= 299) {
+				pddDone = true
+				lg.recordPDD(time.Since(start).Milliseconds())
+			}
+			if r >= 200 {
+				final = r
+				return true
+			}
+		}
+		return ss.GetState().IsFinalized() // timed out or dropped
+	})
+
+	switch {
+	case final >= 200 && final <= 299:
+		lg.answered.Add(1)
+	case final >= 300:
+		lg.recordFailure(fmt.Sprintf("%d %s", final, DicResponse[final]))
+		return
+	default:
+		lg.recordFailure(loadNoFinalResponse)
+		if timedOut {
+			CallAction(ue, callID, RejectRelease)
+		}
+		return
+	}
+
+	// hold then release unless the remote party clears first
+	waitFor(lg.holdTime(), func() bool { return !ss.IsEstablished() })
+	if ss.IsEstablished() {
+		CallAction(ue, callID, RejectRelease)
+		waitFor(loadReleaseTimeout, func() bool { return ss.GetState().IsFinalized() && !ss.IsEstablished() })
+	}
+}
+
+func (lg *loadGenerator) holdTime() time.Duration {
+	ht := lg.profile.HoldTime
+	var ms float64
+	switch ht.Distribution {
+	case HoldUniform:
+		ms = float64(ht.Min) + rand.Float64()*float64(ht.Max-ht.Min)
+	case HoldExponential:
+		ms = rand.ExpFloat64() * float64(cmp.Or(ht.Mean, loadDefaultHoldTime))
+	default:
+		ms = float64(cmp.Or(ht.Mean, loadDefaultHoldTime))
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+func (lg *loadGenerator) recordPDD(ms int64) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	if len(lg.pdds) < loadMaxPDDSamples {
+		lg.pdds = append(lg.pdds, ms)
+	}
+}
+
+func (lg *loadGenerator) recordFailure(reason string) {
+	lg.failed.Add(1)
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	lg.failures[reason]++
+}
+
+func (lg *loadGenerator) stats() *LoadStats {
+	st := &LoadStats{
+		TargetCPS: lg.profile.CPS,
+		Attempts:  lg.attempts.Load(),
+		Answered:  lg.answered.Load(),
+		Failed:    lg.failed.Load(),
+		Active:    lg.active.Load(),
+		Throttled: lg.throttled.Load(),
+		EndTime:   "N/A",
+	}
+	if completed := st.Answered + st.Failed; completed > 0 {
+		st.ASR = float64(st.Answered) * 100 / float64(completed)
+	}
+
+	lg.mu.Lock()
+	st.Status = lg.status
+	st.CurrentCPS = lg.currentCPS
+	st.StartTime = lg.startTime.Format(DicTFs[JsonDateTimeMS])
+	if !lg.endTime.IsZero() {
+		st.EndTime = lg.endTime.Format(DicTFs[JsonDateTimeMS])
+	}
+	st.FailureCodes = make(map[string]int64, len(lg.failures))
+	for k, v := range lg.failures {
+		st.FailureCodes[k] = v
+	}
+	pdds := slices.Clone(lg.pdds)
+	lg.mu.Unlock()
+
+	if len(pdds) > 0 {
+		slices.Sort(pdds)
+		st.PDD = PDDPercentiles{
+			P50: percentile(pdds, 50),
+			P90: percentile(pdds, 90),
+			P95: percentile(pdds, 95),
+			P99: percentile(pdds, 99),
+			Max: pdds[len(pdds)-1],
+		}
+	}
+	return st
+}
+
+// percentile uses nearest-rank on sorted samples
+func percentile(sorted []int64, p int) int64 {
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
@@ -0,0 +1,340 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sipclientgo/global"
+	"sipclientgo/system"
+	"slices"
+	"strings"
+	"time"
+)
+
+// media management of the MRF repository - upload, delete and rename over the API plus a watcher of the media directory
+// changes take effect immediately; sessions already streaming keep the audio they started with
+
+const (
+	mediaWatchInterval = 2 * time.Second
+	mediaTempPrefix    = ".upload-"
+)
+
+type mediaStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+type MediaInfo struct {
+	Name     string  `json:"name"`
+	Key      string  `json:"key"`
+	Size     int64   `json:"size"`
+	Duration float64 `json:"duration"`
+	Modified string  `json:"modified"`
+	Loaded   bool    `json:"loaded"`
+}
+
+// ErrRepoNotFound is returned when no MRF repository has the requested name
+var ErrRepoNotFound = errors.New("MRF repository not found")
+
+// mediaRepo returns the named repository, the default one when empty - uploads may create a new repository
+func mediaRepo(name string, create bool) (*MRFRepo, error) {
+	if name == "" {
+		name = global.MRFRepoName
+	}
+	if repo, ok := MRFRepos.GetMRFRepo(name); ok {
+		return repo, nil
+	}
+	if !create {
+		return nil, ErrRepoNotFound
+	}
+	repo, err := MRFRepos.addRepo(name)
+	if err == nil {
+		system.LogInfo(system.LTFileUpload, "MRF repository created: "+name)
+	}
+	return repo, err
+}
+
+// validMediaName rejects paths, hidden files and unsupported extensions
+func validMediaName(name string) error {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid file name [%s]", name)
+	}
+	if !IsMediaFile(name) {
+		return fmt.Errorf("unsupported extension [%s]", getExtension(name))
+	}
+	return nil
+}
+
+// ListMedia returns the audio files of the media directory and whether they are loaded
+func ListMedia(rn string) ([]MediaInfo, error) {
+	repo, err := mediaRepo(rn, false)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(repo.dir)
+	if err != nil {
+		return nil, err
+	}
+	lst := []MediaInfo{}
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	for _, entry := range entries {
+		if entry.IsDir() || validMediaName(entry.Name()) != nil {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		info := MediaInfo{Name: entry.Name(), Key: dropExtension(entry.Name()), Size: fi.Size(), Modified: fi.ModTime().UTC().Format(global.DicTFs[global.JsonDateTimeMS])}
+		if _, info.Loaded = repo.files[info.Name]; info.Loaded {
+			info.Duration = float64(len(repo.pcmdata[info.Key])) / global.PcmSamplingRate
+		}
+		lst = append(lst, info)
+	}
+	slices.SortFunc(lst, func(a, b MediaInfo) int { return strings.Compare(a.Name, b.Name) })
+	return lst, nil
+}
+
+// SaveMedia stores an uploaded file and loads it - an existing file with the same name is replaced
+func SaveMedia(rn, name string, r io.Reader) (*MediaInfo, error) {
+	if err := validMediaName(name); err != nil {
+		return nil, err
+	}
+	repo, err := mediaRepo(rn, true)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(repo.dir, mediaTempPrefix+"*."+getExtension(name))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// decoded before being moved in place so a corrupt upload does not replace a working file
+	pcm, err := decodeMedia(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	fullpath := filepath.Join(repo.dir, name)
+	if err := os.Rename(tmp.Name(), fullpath); err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	repo.setFile(name, fi, pcm)
+
+	info := &MediaInfo{Name: name, Key: dropExtension(name), Size: fi.Size(), Duration: float64(len(pcm)) / global.PcmSamplingRate,
+		Modified: fi.ModTime().UTC().Format(global.DicTFs[global.JsonDateTimeMS]), Loaded: true}
+	system.LogInfo(system.LTFileUpload, fmt.Sprintf("Media file uploaded: %s/%s (%s)", repo.name, name, formattedTime(info.Duration)))
+	return info, nil
+}
+
+func DeleteMedia(rn, name string) error {
+	if err := validMediaName(name); err != nil {
+		return err
+	}
+	repo, err := mediaRepo(rn, false)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(repo.dir, name)); err != nil {
+		return err
+	}
+	repo.unloadFile(name)
+	system.LogInfo(system.LTFileUpload, "Media file deleted: "+repo.name+"/"+name)
+	return nil
+}
+
+// RenameMedia renames the file and its audio key - the extension cannot be changed
+func RenameMedia(rn, name, newName string) error {
+	if err := validMediaName(name); err != nil {
+		return err
+	}
+	if err := validMediaName(newName); err != nil {
+		return err
+	}
+	if getExtension(name) != getExtension(newName) {
+		return errors.New("file extension cannot be changed")
+	}
+	repo, err := mediaRepo(rn, false)
+	if err != nil {
+		return err
+	}
+	oldpath, newpath := filepath.Join(repo.dir, name), filepath.Join(repo.dir, newName)
+	if _, err := os.Stat(newpath); err == nil {
+		return fmt.Errorf("file [%s] already exists", newName)
+	}
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	if _, err := repo.loadFile(newName); err != nil {
+		return err
+	}
+	repo.unloadFile(name)
+	system.LogInfo(system.LTFileUpload, fmt.Sprintf("Media file renamed: %s/%s -> %s", repo.name, name, newName))
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+
+func (a mediaStamp) same(b mediaStamp) bool {
+	return a.size == b.size && a.modTime.Equal(b.modTime)
+}
+
+type mediaWatcher struct {
+	repo    *MRFRepo
+	pending map[string]mediaStamp // new or changed files, loaded once unchanged for one interval
+	failed  map[string]mediaStamp // files that could not be decoded, retried when changed
+}
+
+// watchMedia polls the media directory for repositories and files added, replaced or removed outside the API
+func (mrfrps *MRFRepoCollection) watchMedia() {
+	wtchrs := make(map[string]*mediaWatcher)
+	tckr := time.NewTicker(mediaWatchInterval)
+	defer tckr.Stop()
+	for range tckr.C {
+		mrfrps.scanRepos()
+		names := mrfrps.Names()
+		for _, name := range names {
+			repo, ok := mrfrps.GetMRFRepo(name)
+			if !ok {
+				continue
+			}
+			wtchr, ok := wtchrs[name]
+			if !ok || wtchr.repo != repo {
+				wtchr = &mediaWatcher{repo: repo, pending: make(map[string]mediaStamp), failed: make(map[string]mediaStamp)}
+				wtchrs[name] = wtchr
+			}
+			wtchr.scan()
+		}
+		for name := range wtchrs {
+			if !slices.Contains(names, name) {
+				delete(wtchrs, name)
+			}
+		}
+	}
+}
+
+// scanRepos adds the repositories of new subdirectories and drops those whose subdirectory is gone
+func (mrfrps *MRFRepoCollection) scanRepos() {
+	entries, err := os.ReadDir(global.MediaPath)
+	if err != nil {
+		return
+	}
+	present := make(map[string]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || validRepoName(name) != nil || name == global.MRFRepoName {
+			continue
+		}
+		present[name] = true
+		if _, ok := mrfrps.GetMRFRepo(name); !ok {
+			if _, err := mrfrps.addRepo(name); err == nil {
+				system.LogInfo(system.LTFileUpload, "MRF repository added: "+name)
+			}
+		}
+	}
+	for _, name := range mrfrps.Names() {
+		if name != global.MRFRepoName && !present[name] {
+			mrfrps.removeRepo(name)
+			system.LogInfo(system.LTFileUpload, "MRF repository removed: "+name)
+		}
+	}
+}
+
+func (wtchr *mediaWatcher) scan() {
+	repo := wtchr.repo
+	entries, err := os.ReadDir(repo.dir)
+	if err != nil {
+		return
+	}
+
+	present := make(map[string]bool)
+	var policyStamp mediaStamp
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == mrfPolicyFile && !entry.IsDir() {
+			if fi, err := entry.Info(); err == nil {
+				policyStamp = mediaStamp{size: fi.Size(), modTime: fi.ModTime()}
+			}
+			continue
+		}
+		if entry.IsDir() || validMediaName(name) != nil {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		present[name] = true
+		stamp := mediaStamp{size: fi.Size(), modTime: fi.ModTime()}
+
+		repo.mu.RLock()
+		known, ok := repo.files[name]
+		repo.mu.RUnlock()
+		if ok && known.same(stamp) {
+			delete(wtchr.pending, name)
+			continue
+		}
+		if fld, ok := wtchr.failed[name]; ok && fld.same(stamp) {
+			continue
+		}
+		if pnd, ok := wtchr.pending[name]; !ok || !pnd.same(stamp) {
+			wtchr.pending[name] = stamp
+			continue
+		}
+
+		delete(wtchr.pending, name)
+		duration, err := repo.loadFile(name)
+		if err != nil {
+			wtchr.failed[name] = stamp
+			system.LogError(system.LTFileUpload, fmt.Sprintf("Failed to load media file [%s/%s]: %v", repo.name, name, err))
+			continue
+		}
+		delete(wtchr.failed, name)
+		system.LogInfo(system.LTFileUpload, fmt.Sprintf("Media file loaded: %s/%s (%s)", repo.name, name, formattedTime(duration)))
+	}
+
+	var removed []string
+	repo.mu.RLock()
+	for name := range repo.files {
+		if !present[name] {
+			removed = append(removed, name)
+		}
+	}
+	repo.mu.RUnlock()
+	for _, name := range removed {
+		repo.unloadFile(name)
+		system.LogInfo(system.LTFileUpload, "Media file removed: "+repo.name+"/"+name)
+	}
+	for _, m := range []map[string]mediaStamp{wtchr.pending, wtchr.failed} {
+		for name := range m {
+			if !present[name] {
+				delete(m, name)
+			}
+		}
+	}
+
+	repo.mu.RLock()
+	policyChanged := !repo.policyStamp.same(policyStamp)
+	repo.mu.RUnlock()
+	if policyChanged {
+		if err := repo.loadPolicy(); err != nil {
+			system.LogError(system.LTFileUpload, fmt.Sprintf("Failed to load MRF policy of [%s]: %v", repo.name, err))
+		} else {
+			system.LogInfo(system.LTFileUpload, "MRF policy reloaded: "+repo.name)
+		}
+	}
+}
@@ -24,12 +24,13 @@ func NewMediaPortPool() *MediaPool {
 	return mpp
 }
 
-func (mpp *MediaPool) ReserveSocket() *net.UDPConn {
+// ReserveSocket binds a free media port on the given local IP - ports are shared by both address families
+func (mpp *MediaPool) ReserveSocket(ip net.IP) *net.UDPConn {
 	mpp.mu.Lock()
 	defer mpp.mu.Unlock()
 	for port, inUse := range mpp.alloc {
 		if !inUse {
-			socket, err := system.StartListening(global.ClientIPv4, port)
+			socket, err := system.StartListening(ip, port)
 			if err != nil {
 				continue
 			}
@@ -37,7 +38,7 @@ func (mpp *MediaPool) ReserveSocket() *net.UDPConn {
 			return socket
 		}
 	}
-	log.Printf("No available ports for IPv4 %s\n", global.ClientIPv4)
+	log.Printf("No available ports for IP %s\n", ip)
 	return nil
 }
 
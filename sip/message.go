@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"cmp"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"net/url"
 	"sipclientgo/global"
 	"sipclientgo/system"
 	"slices"
@@ -197,6 +199,21 @@ func (sipmsg *SipMessage) IsOptionRequired(o string) bool {
 	return hdr != "" && strings.Contains(hdr, o)
 }
 
+// UnsupportedOptions returns the Require option tags not listed in SupportedOptions
+func (sipmsg *SipMessage) UnsupportedOptions() []string {
+	supported := strings.Split(global.SupportedOptions, ", ")
+	var opts []string
+	for _, hv := range sipmsg.Headers.HeaderValues(global.Require) {
+		for _, opt := range strings.Split(hv, ",") {
+			opt = system.ASCIIToLower(strings.TrimSpace(opt))
+			if opt != "" && !slices.Contains(supported, opt) {
+				opts = append(opts, opt)
+			}
+		}
+	}
+	return opts
+}
+
 func (sipmsg *SipMessage) IsMethodAllowed(m global.Method) bool {
 	hdr := sipmsg.Headers.ValueHeader(global.Allow)
 	hdr = system.ASCIIToLower(hdr)
@@ -212,37 +229,40 @@ func (sipmsg *SipMessage) IsKnownRURIScheme() bool {
 	return false
 }
 
-// func (sipmsg *SipMessage) GetReferToRUIR() (string, error) {
-// 	ok, values := sipmsg.Headers.ValuesHeader(Refer_To)
-// 	if !ok {
-// 		return "", errors.New("No Refer-To header")
-// 	}
-// 	if len(values) > 1 {
-// 		return "", errors.New("Multiple Refer-To headers found")
-// 	}
-// 	value := values[0]
-// 	if strings.Contains(ASCIIToLower(value), "replaces") {
-// 		return "", errors.New("Refer-To with Replaces")
-// 	}
-// 	var mtch []string
-// 	if !RMatch(value, URIFull, &mtch) {
-// 		return "", errors.New("Badly formatted URI")
-// 	}
-// 	return mtch[1], nil
-// }
-
-// func (sipmsg *SipMessage) WithNoReferSubscription() bool {
-// 	if sipmsg.Headers.DoesValueExistInHeader(Require.String(), "norefersub") {
-// 		return true
-// 	}
-// 	if sipmsg.Headers.DoesValueExistInHeader(Supported.String(), "norefersub") {
-// 		return true
-// 	}
-// 	if sipmsg.Headers.DoesValueExistInHeader(Refer_Sub.String(), "false") {
-// 		return true
-// 	}
-// 	return false
-// }
+// GetReferTo returns the Refer-To URI and the unescaped Replaces header embedded in it, if any
+func (sipmsg *SipMessage) GetReferTo() (uri, replaces string, err error) {
+	values := sipmsg.Headers.HeaderValues(global.Refer_To)
+	if len(values) == 0 {
+		return "", "", errors.New("no Refer-To header")
+	}
+	if len(values) > 1 {
+		return "", "", errors.New("multiple Refer-To headers found")
+	}
+	value := strings.TrimSpace(values[0])
+	if v, ok := strings.CutPrefix(value, "<"); ok {
+		value, _, _ = strings.Cut(v, ">")
+	}
+	uri, embedded, _ := strings.Cut(value, "?")
+	var mtch []string
+	if !global.RMatch(uri, global.URIFull, &mtch) {
+		return "", "", errors.New("badly formatted Refer-To URI")
+	}
+	qry, err := url.ParseQuery(embedded)
+	if err != nil {
+		return "", "", errors.New("badly formatted Refer-To headers")
+	}
+	for k, vs := range qry {
+		if global.Replaces.Equals(k) {
+			replaces = vs[0]
+		}
+	}
+	return mtch[1], replaces, nil
+}
+
+// WithNoReferSubscription reports whether the referrer asked for no implicit subscription (RFC 4488)
+func (sipmsg *SipMessage) WithNoReferSubscription() bool {
+	return sipmsg.IsOptionRequired("norefersub") || strings.EqualFold(sipmsg.Headers.ValueHeader(global.Refer_Sub), "false")
+}
 
 func (sipmsg *SipMessage) IsResponse() bool {
 	return sipmsg.MsgType == global.RESPONSE
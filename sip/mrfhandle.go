@@ -8,7 +8,6 @@ import (
 	"regexp"
 	"sipclientgo/dtmf"
 	. "sipclientgo/global"
-	"sipclientgo/guid"
 	"sipclientgo/q850"
 	"sipclientgo/rtp"
 	"sipclientgo/sip/state"
@@ -35,14 +34,11 @@ func (ss *SipSession) RouteRequestInternal(trans *Transaction, sipmsg1 *SipMessa
 		return
 	}
 
-	// upart := sipmsg1.StartLine.UserPart
-	// repo, ok := MRFRepos.GetMRFRepo(upart)
-	// if !ok {
-	// 	ss.RejectMe(trans, status.NotFound, q850.UnallocatedNumber, "MRF Repository not found")
-	// 	return
-	// }
+	if sipmsg1.Headers.HeaderExists(Replaces.String()) && !ss.matchReplaced(trans, sipmsg1) {
+		return
+	}
 
-	// ss.MRFRepo = repo
+	ss.selectMRFRepo(sipmsg1)
 
 	ss.answerMRF(trans, sipmsg1)
 }
@@ -50,6 +46,36 @@ func (ss *SipSession) RouteRequestInternal(trans *Transaction, sipmsg1 *SipMessa
 // ============================================================================
 // MRF methods
 
+// mediaIP returns the local media address - same address family as the signalling socket
+func (ss *SipSession) mediaIP() net.IP {
+	return system.GetUDPAddrFromConn(ss.SIPUDPListenser).IP
+}
+
+func sdpAddrType(ip net.IP) string {
+	if ip.To4() == nil {
+		return sdp.TypeIPv6
+	}
+	return sdp.TypeIPv4
+}
+
+// setSDPAddrType sets origin and connection address types - IN IP6 for IPv6 media
+func setSDPAddrType(ses *sdp.Session, addrType string) {
+	if ses == nil {
+		return
+	}
+	if ses.Origin != nil {
+		ses.Origin.Type = addrType
+	}
+	if ses.Connection != nil {
+		ses.Connection.Type = addrType
+	}
+	for _, media := range ses.Media {
+		for _, conn := range media.Connection {
+			conn.Type = addrType
+		}
+	}
+}
+
 func (ss *SipSession) buildSDPOffer(callhold bool) bool {
 	medDir, ok := sdp.GetOriginatingMode(ss.LocalMedDir, callhold)
 
@@ -59,11 +85,14 @@ func (ss *SipSession) buildSDPOffer(callhold bool) bool {
 
 	ss.LocalMedDir = medDir
 
+	mediaIP := ss.mediaIP()
 	if ss.MediaListener == nil {
-		ss.MediaListener = MediaPorts.ReserveSocket()
+		ss.MediaListener = MediaPorts.ReserveSocket(mediaIP)
 	}
 
-	mySDP, _ := sdp.NewSessionSDP(ss.SDPSessionID, ss.SDPSessionVersion, ClientIPv4.String(), B2BUAName, system.Uint32ToStr(ss.rtpSSRC), medDir, system.GetUDPortFromConn(ss.MediaListener), []uint8{sdp.G722, sdp.PCMA, sdp.PCMU, sdp.RFC4733PT})
+	mySDP, _ := sdp.NewSessionSDP(ss.SDPSessionID, ss.SDPSessionVersion, mediaIP.String(), B2BUAName, system.Uint32ToStr(ss.rtpSSRC), medDir, system.GetUDPortFromConn(ss.MediaListener), []uint8{sdp.G722, sdp.PCMA, sdp.PCMU, sdp.RFC4733PT})
+	setSDPAddrType(mySDP, sdpAddrType(mediaIP))
+	ss.setQoSAttributes(mySDP)
 
 	if ss.LocalSDP != nil && !mySDP.Equals(ss.LocalSDP) {
 		ss.SDPSessionVersion += 1
@@ -83,8 +112,13 @@ func (ss *SipSession) buildSDPAnswer(sipmsg *SipMessage) (sipcode, q850code int,
 		warn = "Not supported SDP"
 		return
 	}
+	mediaIP := ss.mediaIP()
+	addrType := sdpAddrType(mediaIP)
 	var media *sdp.Media
 	var conn *sdp.Connection = sdpses.Connection
+	if conn != nil && conn.Type != addrType {
+		conn = nil
+	}
 	var audioFormat *sdp.Format
 	var dtmfFormat *sdp.Format
 	for i := range sdpses.Media {
@@ -94,7 +128,7 @@ func (ss *SipSession) buildSDPAnswer(sipmsg *SipMessage) (sipcode, q850code int,
 		}
 		for k := range media.Connection {
 			connection := media.Connection[k]
-			if connection.Type != sdp.TypeIPv4 || connection.Network != sdp.NetworkInternet { //connection.Address == "0.0.0.0"
+			if connection.Type != addrType || connection.Network != sdp.NetworkInternet { //connection.Address == "0.0.0.0"
 				continue
 			}
 			conn = connection
@@ -150,16 +184,17 @@ func (ss *SipSession) buildSDPAnswer(sipmsg *SipMessage) (sipcode, q850code int,
 	if err != nil {
 		sipcode = status.NotAcceptableHere
 		q850code = q850.ChannelUnacceptable
-		warn = "Unable to parse received connection IPv4"
+		warn = "Unable to parse received connection address"
 		return
 	}
 
 	ss.RemoteMedia = rmedia
 	ss.RemoteMedDir = sdpses.GetEffectiveMediaDirective()
+	ss.updateQoS(media)
 
 	// TODO need to handle CANCEL (put some delay before answering?)
 	if ss.MediaListener == nil { // to avoid memory leak because this method will be called with INVITE/ReINVITE/UPDATE
-		ss.MediaListener = MediaPorts.ReserveSocket()
+		ss.MediaListener = MediaPorts.ReserveSocket(mediaIP)
 	}
 	if ss.MediaListener == nil {
 		sipcode = status.NotAcceptableHere
@@ -174,8 +209,8 @@ func (ss *SipSession) buildSDPAnswer(sipmsg *SipMessage) (sipcode, q850code int,
 			SessionID:      ss.SDPSessionID,
 			SessionVersion: ss.SDPSessionVersion,
 			Network:        sdp.NetworkInternet,
-			Type:           sdp.TypeIPv4,
-			Address:        ClientIPv4.String(),
+			Type:           addrType,
+			Address:        mediaIP.String(),
 		},
 		Name: "MRF",
 		// Information: "A Seminar on the session description protocol",
@@ -184,8 +219,8 @@ func (ss *SipSession) buildSDPAnswer(sipmsg *SipMessage) (sipcode, q850code int,
 		// Phone:       []string{"+1 617 555-6011"},
 		Connection: &sdp.Connection{
 			Network: sdp.NetworkInternet,
-			Type:    sdp.TypeIPv4,
-			Address: ClientIPv4.String(),
+			Type:    addrType,
+			Address: mediaIP.String(),
 			TTL:     0,
 		},
 		// Bandwidth: []*Bandwidth{
@@ -231,6 +266,7 @@ func (ss *SipSession) buildSDPAnswer(sipmsg *SipMessage) (sipcode, q850code int,
 		}
 		mySDP.Media = append(mySDP.Media, newmedia)
 	}
+	ss.setQoSAttributes(mySDP)
 
 	if ss.LocalSDP != nil && !mySDP.Equals(ss.LocalSDP) {
 		ss.SDPSessionVersion += 1
@@ -240,6 +276,9 @@ func (ss *SipSession) buildSDPAnswer(sipmsg *SipMessage) (sipcode, q850code int,
 	ss.LocalSDP = mySDP
 	ss.rtpPayloadType = audioFormat.Payload
 	ss.WithTeleEvents = dtmfFormat != nil
+	if ss.WithTeleEvents {
+		ss.rtpEventType = dtmfFormat.Payload
+	}
 
 	if !ss.WithTeleEvents {
 		ss.audioBytes = make([]byte, 0, DTMFPacketsCount*RTPPayloadSize)
@@ -259,22 +298,51 @@ func (ss *SipSession) initMediaParameters() {
 func (ss *SipSession) answerMRF(trans *Transaction, sipmsg *SipMessage) {
 	ss.initMediaParameters()
 
+	// preconditions merely supported by a caller without 100rel are ignored
+	if sipmsg.IsOptionRequired("precondition") || (ss.IsPRACKSupported && sipmsg.IsOptionSupported("precondition")) {
+		ss.qos = newQoSPrecondition()
+	}
+
 	if sc, qc, wr := ss.buildSDPAnswer(sipmsg); sc != 0 {
 		ss.RejectMe(trans, sc, qc, wr)
 		return
 	}
 
-	ss.SendResponse(trans, status.Ringing, EmptyBody())
+	if ss.preconditions() != nil && !ss.awaitPreconditions(trans) {
+		return
+	}
+
+	plc := ss.answerPolicy()
+	ss.answerPlc = plc
 
-	ss.logSessData(nil, nil, status.Ringing)
+	switch {
+	case plc.Mode == AnswerReject && plc.Delay == 0:
+	case plc.Mode == AnswerEarly:
+		ss.sendProvisional(trans, status.SessionProgress, NewMessageSDPBody(ss.LocalSDP))
+		if err := ss.playEarlyMedia(plc.Audio); err != nil {
+			system.LogError(system.LTMediaStack, fmt.Sprintf("Call [%s] - Failed to play early media [%s]: %v", ss.CallID, plc.Audio, err))
+		}
+	default:
+		ss.sendProvisional(trans, status.Ringing, EmptyBody())
+	}
 
-	<-ss.AnswerChan
+	ss.awaitAnswer(plc)
 
-	if !ss.IsBeingEstablished() {
+	if plc.Mode == AnswerReject {
+		ss.RejectMe(trans, plc.SIPCode, plc.Q850, "Rejected by answer policy")
 		return
 	}
+	if plc.Mode == AnswerEarly {
+		ss.stopPlayback()
+	}
 
+	if !ss.awaitPRACK() {
+		return
+	}
+
+	ss.markAnswered()
 	ss.SendResponse(trans, status.OK, NewMessageSDPBody(ss.LocalSDP))
+	ss.releaseReplaced()
 }
 
 func (ss *SipSession) mediaReceiver() {
@@ -302,6 +370,8 @@ func (ss *SipSession) mediaReceiver() {
 		}
 
 		bytes := (*buf)[:n]
+		capturePacket(ss, addr, ss.MediaListener.LocalAddr(), bytes)
+		ss.recordRTP(INBOUND, bytes)
 		payload := bytes[RTPHeaderSize:]
 
 		if ss.WithTeleEvents {
@@ -367,6 +437,74 @@ func (ss *SipSession) mediaReceiver() {
 	}
 }
 
+// processSDPAnswer applies the remote SDP answer of an outbound call - remote media, codec and telephone events
+func (ss *SipSession) processSDPAnswer(sipmsg *SipMessage) bool {
+	sdpbytes, ok := sipmsg.GetBodyPart(SDP)
+	if !ok {
+		return false
+	}
+	sdpses, err := sdp.Parse(sdpbytes)
+	if err != nil {
+		system.LogError(system.LTSDPStack, "Invalid SDP answer: "+err.Error())
+		return false
+	}
+	addrType := sdpAddrType(ss.mediaIP())
+	media := sdpses.GetAudioMediaFlow()
+	if media == nil || media.Port == 0 {
+		return false
+	}
+	conn := sdpses.Connection
+	for _, c := range media.Connection {
+		if c.Type == addrType && c.Network == sdp.NetworkInternet {
+			conn = c
+			break
+		}
+	}
+	if conn == nil || conn.Type != addrType {
+		return false
+	}
+	rmedia, err := system.BuildUDPAddr(conn.Address, media.Port)
+	if err != nil {
+		return false
+	}
+
+	var audioFormat, dtmfFormat *sdp.Format
+	for _, frmt := range media.Formats {
+		if frmt.Name == sdp.RFC4733 {
+			dtmfFormat = frmt
+		} else if audioFormat == nil && slices.Contains(SupportedCodecs, frmt.Payload) {
+			audioFormat = frmt
+		}
+	}
+	if audioFormat == nil {
+		return false
+	}
+
+	ss.RemoteMedia = rmedia
+	ss.RemoteMedDir = sdpses.GetEffectiveMediaDirective()
+	ss.updateQoS(media)
+	ss.rtpPayloadType = audioFormat.Payload
+	ss.WithTeleEvents = dtmfFormat != nil
+	if ss.WithTeleEvents {
+		ss.rtpEventType = dtmfFormat.Payload
+	}
+	if !ss.WithTeleEvents {
+		ss.audioBytes = make([]byte, 0, DTMFPacketsCount*RTPPayloadSize)
+	}
+	return true
+}
+
+// sendDTMFRelay sends each digit in a SIP INFO with application/dtmf-relay body
+func (ss *SipSession) sendDTMFRelay(digits string, duration int) {
+	for i, d := range digits {
+		if i > 0 {
+			time.Sleep(time.Duration(duration)*time.Millisecond + 100*time.Millisecond)
+		}
+		body := MessageBody{PartsContents: map[BodyType]ContentPart{DTMFRelay: {Bytes: fmt.Appendf(nil, "Signal=%c\r\nDuration=%d\r\n", d, duration)}}}
+		ss.SendRequest(INFO, nil, body)
+	}
+}
+
 func (ss *SipSession) parseDTMF(bytes []byte, m Method, bt BodyType) {
 	strng := string(bytes)
 	var mtch []string
@@ -394,7 +532,7 @@ func (ss *SipSession) processDTMF(dtmf, details string) {
 	// 	fmt.Println("Received:", dtmf, " - Begin collecting speech")
 	// 	ss.collectSpeech = true
 	// }
-	if ss.bargeEnabled && ss.stopRTPStreaming() {
+	if ss.bargeEnabled.Load() && ss.stopRTPStreaming() {
 		system.LogInfo(system.LTMediaCapability, "Audio streaming has been interrupted")
 	}
 	system.LogInfo(system.LTDTMF, details+dtmf)
@@ -411,8 +549,7 @@ func (ss *SipSession) stopRTPStreaming() bool {
 	select {
 	case ss.rtpChan <- true:
 		return true
-	default:
-		<-ss.rtpChan
+	case <-time.After(2 * time.Duration(PacketizationTime) * time.Millisecond): // streaming has just ended
 	}
 	return false
 }
@@ -445,6 +582,10 @@ func (ss *SipSession) startRTPStreaming(audiokey string, resetflag, loopflag, dr
 			goto finish1
 		}
 
+		ss.rtpmutex.Lock()
+		ss.rtpAudioKey, ss.rtpAudioLen, ss.rtpLoop, ss.rtpHangUp = audiokey, len(data), loopflag, dropCallflag
+		ss.rtpmutex.Unlock()
+
 		tckr := time.NewTicker(20 * time.Millisecond)
 		defer tckr.Stop()
 
@@ -493,6 +634,7 @@ func (ss *SipSession) startRTPStreaming(audiokey string, resetflag, loopflag, dr
 				ss.rtpIndex += delta
 				isFinished = true
 			}
+			ss.rtpPosition.Store(int64(ss.rtpIndex))
 
 			if !sdp.IsMedDirHolding(ss.RemoteMedDir) {
 				pktptr := RTPTXBufferPool.Get().(*[]byte)
@@ -507,6 +649,8 @@ func (ss *SipSession) startRTPStreaming(audiokey string, resetflag, loopflag, dr
 				if err != nil {
 					goto finish1
 				}
+				capturePacket(ss, ss.MediaListener.LocalAddr(), ss.RemoteMedia, pkt)
+				ss.recordRTP(OUTBOUND, pkt)
 				RTPTXBufferPool.Put(pktptr)
 			}
 
@@ -587,41 +731,76 @@ func ProbeUA(conn *net.UDPConn, ua *SipUdpUserAgent) {
 }
 
 func StartUEListener(ue *UserEquipment) error {
-	ul, err := system.StartListening(ClientIPv4, ue.UdpPort)
+	if ue.localIP() == nil {
+		return fmt.Errorf("no local %s address configured", ue.ipFamily())
+	}
+	ul, err := system.StartListening(ue.localIP(), ue.UdpPort)
 	if err != nil {
 		return err
 	}
 	ue.UDPListener = ul
 	ue.DataChan = make(chan Packet, QueueSize)
+	if err := ue.startSecAgreement(); err != nil {
+		ul.Close()
+		return err
+	}
+	if err := ue.startStreamListener(); err != nil {
+		ul.Close()
+		ue.stopSecAgreement()
+		return err
+	}
 	startWorkers(ue, ue.DataChan)
-	udpLoopWorkers(ue, ue.DataChan)
+	udpLoopWorkers(ue, ue.UDPListener, ue.DataChan)
 	return nil
 }
 
 func RegisterMe(ue *UserEquipment, wwwauth string) {
+	sendRegister(ue, wwwauth, false)
+}
+
+// sendRegister sends an initial, challenged or refreshing REGISTER - a refresh reuses the last nonce
+func sendRegister(ue *UserEquipment, wwwauth string, refresh bool) {
 	if PCSCFSocket == nil {
 		system.LogError(system.LTConfiguration, "Missing PCSCF Socket")
 		return
 	}
 
+	ue.setRegistrationWanted(true)
+
+	if wwwauth == "" && !refresh && ue.secAgree != nil {
+		ue.secAgree.reset()
+	}
+
 	ss := NewSS(OUTBOUND)
-	ss.RemoteUDP = PCSCFSocket
-	ss.SIPUDPListenser = ue.UDPListener
+	ss.SIPUDPListenser, ss.RemoteUDP, ss.SIPTransport = ue.signallingPath()
 	ss.UserEquipment = ue
 
 	hdrs := NewSipHeaders()
 	hdrs.AddHeader(P_Access_Network_Info, "IEEE-802.3") //"3GPP-E-UTRAN-FDD; utran-cell-id-3gpp=001010001000019B")
-	hdrs.AddHeader(Expires, ue.Expires)
-	hdrs.AddHeader(Supported, "path")
-	hdrs.AddHeader(Contact, fmt.Sprintf(`<sip:%s@%s;transport=udp>;+g.3gpp.icsi-ref="urn:Aurn-7:3gpp-service.ims.icsi.mmtel";+g.3gpp.smsip;video;+sip.instance="<urn:gsma:imei:86728703-952237-0>";+g.3gpp.accesstype="wired"`, ue.Imsi, system.GetUDPAddrStringFromConn(ue.UDPListener)))
+	hdrs.AddHeader(Expires, ue.requestedExpires())
+	if ue.secAgree != nil {
+		hdrs.AddHeader(Supported, "path, sec-agree")
+		ue.addSecAgreeHeaders(&hdrs, true)
+	} else {
+		hdrs.AddHeader(Supported, "path")
+	}
+	hdrs.AddHeader(Contact, fmt.Sprintf(`<sip:%s@%s;transport=%s>;+g.3gpp.icsi-ref="urn:Aurn-7:3gpp-service.ims.icsi.mmtel";+g.3gpp.smsip;video;+sip.instance="<urn:gsma:imei:86728703-952237-0>";+g.3gpp.accesstype="wired"`, ue.Imsi, ue.contactSocket(), ue.transport().URIParam()))
 	// hdrs.AddHeader(Contact, fmt.Sprintf(`<sip:%s>;+g.3gpp.icsi-ref="urn:Aurn-7:3gpp-service.ims.icsi.mmtel";+g.3gpp.smsip;video;+sip.instance="<urn:gsma:imei:86728703-952237-0>";+g.3gpp.accesstype="wired"`, system.GetUDPAddrStringFromConn(ue.UDPListener)))
 
-	if wwwauth != "" {
-		auths := ParseWWWAuthenticateOptimized(wwwauth)
-		author := computeAuthorizationHeader(ImsDomain, auths[0].Params["nonce"], REGISTER.String(), "00000001", ue)
+	switch {
+	case wwwauth != "":
+		if err := ue.processChallenge(wwwauth); err != nil {
+			system.LogError(system.LTRegistration, fmt.Sprintf("UE [%s] - Authentication challenge failed: %v", ue.Imsi, err))
+		}
+		author := computeAuthorizationHeader(REGISTER.String(), ue)
 		hdrs.AddHeader(Authorization, author)
 		ue.RegAuth = author
-		ue.InvAuth = computeAuthorizationHeader(ImsDomain, auths[0].Params["nonce"], INVITE.String(), "00000001", ue)
+		ue.InvAuth = computeAuthorizationHeader(INVITE.String(), ue)
+	case refresh:
+		if author := computeAuthorizationHeader(REGISTER.String(), ue); author != "" {
+			hdrs.AddHeader(Authorization, author)
+			ue.RegAuth = author
+		}
 	}
 
 	trans := ss.CreateSARequest(RequestPack{Method: REGISTER, Max70: true, RUriUP: ue.Imsi, FromUP: ue.Imsi, CustomHeaders: hdrs}, EmptyBody())
@@ -637,21 +816,25 @@ func UnregisterMe(ue *UserEquipment, wwwauth string) {
 		return
 	}
 
+	ue.setRegistrationWanted(false)
+
 	ss := NewSS(OUTBOUND)
-	ss.RemoteUDP = PCSCFSocket
-	ss.SIPUDPListenser = ue.UDPListener
+	ss.SIPUDPListenser, ss.RemoteUDP, ss.SIPTransport = ue.signallingPath()
 	ss.UserEquipment = ue
 
 	hdrs := NewSipHeaders()
 	// hdrs.AddHeader(P_Access_Network_Info, "IEEE-802.3") //"3GPP-E-UTRAN-FDD; utran-cell-id-3gpp=001010001000019B")
 	hdrs.AddHeader(Expires, "0")
 	// hdrs.AddHeader(Supported, "path")
-	hdrs.AddHeader(Contact, fmt.Sprintf(`<sip:%s@%s;transport=udp>;+g.3gpp.icsi-ref="urn:Aurn-7:3gpp-service.ims.icsi.mmtel";+g.3gpp.smsip;video;+sip.instance="<urn:gsma:imei:86728703-952237-0>";+g.3gpp.accesstype="wired"`, ue.Imsi, system.GetUDPAddrStringFromConn(ue.UDPListener)))
+	ue.addSecAgreeHeaders(&hdrs, true)
+	hdrs.AddHeader(Contact, fmt.Sprintf(`<sip:%s@%s;transport=%s>;+g.3gpp.icsi-ref="urn:Aurn-7:3gpp-service.ims.icsi.mmtel";+g.3gpp.smsip;video;+sip.instance="<urn:gsma:imei:86728703-952237-0>";+g.3gpp.accesstype="wired"`, ue.Imsi, ue.contactSocket(), ue.transport().URIParam()))
 	// hdrs.AddHeader(Contact, fmt.Sprintf(`<sip:%s>;+g.3gpp.icsi-ref="urn:Aurn-7:3gpp-service.ims.icsi.mmtel";+g.3gpp.smsip;video;+sip.instance="<urn:gsma:imei:86728703-952237-0>";+g.3gpp.accesstype="wired"`, system.GetUDPAddrStringFromConn(ue.UDPListener)))
 
 	if wwwauth != "" {
-		auths := ParseWWWAuthenticateOptimized(wwwauth)
-		author := computeAuthorizationHeader(ImsDomain, auths[0].Params["nonce"], REGISTER.String(), "00000001", ue)
+		if err := ue.processChallenge(wwwauth); err != nil {
+			system.LogError(system.LTRegistration, fmt.Sprintf("UE [%s] - Authentication challenge failed: %v", ue.Imsi, err))
+		}
+		author := computeAuthorizationHeader(REGISTER.String(), ue)
 		hdrs.AddHeader(Authorization, author)
 		ue.RegAuth = author
 	}
@@ -663,26 +846,41 @@ func UnregisterMe(ue *UserEquipment, wwwauth string) {
 	ss.SendSTMessage(trans)
 }
 
-func CallViaUE(ue *UserEquipment, cdpn string) {
+// CallViaUE places the call - QoS preconditions (RFC 3312) are offered only when asked for
+func CallViaUE(ue *UserEquipment, cdpn string, preconditions bool) *SipSession {
+	return placeCall(ue, cdpn, NewSipHeaders(), nil, preconditions)
+}
+
+// placeCall sends the INVITE with the extra headers - calls placed on behalf of a REFER report their progress to the referrer
+func placeCall(ue *UserEquipment, cdpn string, extra SipHeaders, referrer *SipSession, preconditions bool) *SipSession {
 	if PCSCFSocket == nil {
 		system.LogError(system.LTConfiguration, "Missing PCSCF Socket")
-		return
+		return nil
 	}
 
 	ss := NewSS(OUTBOUND)
-	ss.RemoteUDP = PCSCFSocket
-	ss.SIPUDPListenser = ue.UDPListener
+	ss.SIPUDPListenser, ss.RemoteUDP, ss.SIPTransport = ue.signallingPath()
 	ss.UserEquipment = ue
+	ss.IsPRACKSupported = true
 
 	hdrs := NewSipHeaders()
 	hdrs.AddHeader(P_Access_Network_Info, "IEEE-802.3") //"3GPP-E-UTRAN-FDD; utran-cell-id-3gpp=001010001000019B")
 
-	hdrs.AddHeader(Supported, "path")
-	hdrs.AddHeader(Contact, fmt.Sprintf(`<sip:%s@%s>;+g.3gpp.icsi-ref="urn:Aurn-7:3gpp-service.ims.icsi.mmtel";+g.3gpp.smsip;video;+sip.instance="<urn:gsma:imei:86728703-952237-0>";+g.3gpp.accesstype="wired"`, ue.Imsi, system.GetUDPAddrStringFromConn(ue.UDPListener)))
+	hdrs.AddHeader(Supported, "path, "+SupportedOptions)
+	ue.addSecAgreeHeaders(&hdrs, false)
+	hdrs.AddHeader(Contact, fmt.Sprintf(`<sip:%s@%s%s>;+g.3gpp.icsi-ref="urn:Aurn-7:3gpp-service.ims.icsi.mmtel";+g.3gpp.smsip;video;+sip.instance="<urn:gsma:imei:86728703-952237-0>";+g.3gpp.accesstype="wired"`, ue.Imsi, ue.contactSocket(), ue.transportParam()))
 
 	hdrs.AddHeader(Authorization, ue.InvAuth)
+	for k, vs := range extra.InternalMap() {
+		for _, v := range vs {
+			hdrs.Add(k, v)
+		}
+	}
 
 	ss.initMediaParameters()
+	if preconditions {
+		ss.qos = newQoSPrecondition()
+	}
 	ss.buildSDPOffer(false)
 
 	frm := ue.MsIsdn
@@ -693,25 +891,30 @@ func CallViaUE(ue *UserEquipment, cdpn string) {
 	trans := ss.CreateSARequest(RequestPack{Method: INVITE, Max70: true, RUriUP: cdpn, FromUP: frm, CustomHeaders: hdrs}, NewMessageSDPBody(ss.LocalSDP))
 
 	ss.SetState(state.BeingEstablished)
+	if referrer != nil {
+		ss.referrer.Store(referrer)
+	}
 	ss.AddMe()
 	ss.logSessData(nil, nil)
 	ss.SendSTMessage(trans)
+	return ss
 }
 
+const (
+	ResumeAnswer  = "Resume/Answer"
+	RejectRelease = "Reject/Release"
+	HoldCall      = "HoldCall"
+)
+
 func CallAction(ue *UserEquipment, callID, action string) {
 	ses, ok := ue.SesMap.Load(callID)
 	if !ok {
 		return
 	}
-	const (
-		ResumeAnswer  = "Resume/Answer"
-		RejectRelease = "Reject/Release"
-		HoldCall      = "HoldCall"
-	)
 	switch action {
 	case ResumeAnswer:
 		if ses.Direction == INBOUND && ses.IsBeingEstablished() {
-			ses.AnswerChan <- struct{}{}
+			ses.requestAnswer()
 			return
 		}
 		if ses.IsEstablished() && ses.buildSDPOffer(false) {
@@ -737,15 +940,6 @@ func CallAction(ue *UserEquipment, callID, action string) {
 	}
 }
 
-func computeAuthorizationHeader(realm, nonce, method, nonceCount string, ue *UserEquipment) string {
-	uri := "sip:" + realm
-	cnonce := guid.GenerateCNonce()
-	ha1 := guid.Md5Hash(fmt.Sprintf("%s:%s:%s", ue.Imsi, realm, ue.Ki))
-	ha2 := guid.Md5Hash(fmt.Sprintf("%s:%s", method, uri))
-	response := guid.Md5Hash(fmt.Sprintf("%s:%s:%s:%s:auth:%s", ha1, nonce, nonceCount, cnonce, ha2))
-	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s", algorithm=MD5, qop=auth, nc=%s, cnonce="%s"`, ue.Imsi, realm, nonce, uri, response, nonceCount, cnonce)
-}
-
 type AuthScheme struct {
 	Scheme string
 	Params map[string]string
@@ -880,7 +1074,7 @@ func (ss *SipSession) logRegData(sipmsg *SipMessage) {
 	ue := ss.UserEquipment
 
 	msisdn := "N/A"
-	expires := ""
+	expires := 0
 
 	if sipmsg != nil {
 
@@ -894,18 +1088,49 @@ func (ss *SipSession) logRegData(sipmsg *SipMessage) {
 		if cntct := sipmsg.Headers.Value("Contact"); cntct != "" {
 			rgx := regexp.MustCompile(";expires=([0-9]+)")
 			if mtchs := rgx.FindStringSubmatch(cntct); mtchs != nil {
-				expires = mtchs[1]
+				expires = system.Str2Int[int](mtchs[1])
 			}
 		}
+		if expires == 0 {
+			expires = system.Str2Int[int](sipmsg.Headers.ValueHeader(Expires))
+		}
 	}
 
 	ue.MsIsdn = msisdn
-	if expires != "" {
-		ue.Expires = expires
+	if expires == 0 {
+		expires = system.Str2Int[int](ue.requestedExpires())
+	}
+	// challenges and a 423 with a greater Min-Expires are no outcome - the REGISTER is repeated at once
+	var challenged, tooBrief bool
+	if ss.GetState() == state.Failed && sipmsg != nil {
+		challenged = sipmsg.Headers.HeaderExists(WWW_Authenticate.String())
+		tooBrief = !challenged && sipmsg.GetStatusCode() == status.IntervalTooBrief && ue.intervalTooBrief(system.Str2Int[int](sipmsg.Headers.ValueHeader(Min_Expires)))
+	}
+	if challenged || tooBrief {
+		ue.setRegStatus(ss.GetState().String())
+	} else {
+		ue.regOutcome(ss.GetState().String())
+	}
+
+	switch ss.GetState() {
+	case state.Registered:
+		ue.scheduleRefresh(expires)
+	case state.Unregistered:
+		ue.stopRefresh()
+	case state.TimedOut:
+		ue.retryRegistration()
+	case state.Failed:
+		switch {
+		case sipmsg == nil || challenged:
+		case tooBrief:
+			system.LogInfo(system.LTRegistration, fmt.Sprintf("UE [%s] - Registration interval too brief - Retrying with [%s] seconds", ue.Imsi, ue.requestedExpires()))
+			go sendRegister(ue, "", true)
+		default:
+			ue.retryRegistration()
+		}
 	}
-	ue.RegStatus = ss.GetState().String()
 
-	WriteJSONToWebSocket(ue)
+	WriteJSONToWebSocket(ue.View())
 }
 
 func utcNow() *time.Time {
@@ -0,0 +1,117 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	. "sipclientgo/global"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// MRF repository policy - read from mrf.yaml in the repository directory and applied to inbound calls routed to it
+// the repository of an inbound call is the one named after the R-URI user part, the To number or the UE MSISDN
+
+const mrfPolicyFile = "mrf.yaml"
+
+type MRFPolicy struct {
+	AutoAnswer   bool   `json:"autoAnswer" yaml:"autoAnswer"`
+	AnswerDelay  int    `json:"answerDelay,omitempty" yaml:"answerDelay"`   // ms
+	Announcement string `json:"announcement,omitempty" yaml:"announcement"` // audio key played once the call is established
+	Loop         bool   `json:"loop,omitempty" yaml:"loop"`
+	HangUp       bool   `json:"hangup,omitempty" yaml:"hangup"` // release the call when the announcement ends
+}
+
+type MRFRepoInfo struct {
+	Name   string     `json:"name"`
+	Files  int        `json:"files"`
+	Policy *MRFPolicy `json:"policy,omitempty"`
+}
+
+func validRepoName(name string) error {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid repository name [%s]", name)
+	}
+	return nil
+}
+
+// loadPolicy reads the policy file - a missing file clears the policy, an invalid one keeps the previous policy
+func (mrfrp *MRFRepo) loadPolicy() error {
+	fn := filepath.Join(mrfrp.dir, mrfPolicyFile)
+	fi, err := os.Stat(fn)
+	if err != nil {
+		mrfrp.mu.Lock()
+		mrfrp.policy, mrfrp.policyStamp = nil, mediaStamp{}
+		mrfrp.mu.Unlock()
+		return nil
+	}
+	stamp := mediaStamp{size: fi.Size(), modTime: fi.ModTime()}
+	plc, err := readMRFPolicy(fn)
+
+	mrfrp.mu.Lock()
+	defer mrfrp.mu.Unlock()
+	mrfrp.policyStamp = stamp
+	if err != nil {
+		return err
+	}
+	mrfrp.policy = plc
+	return nil
+}
+
+func readMRFPolicy(fn string) (*MRFPolicy, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var plc MRFPolicy
+	if err := yaml.Unmarshal(data, &plc); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	if plc.AnswerDelay < 0 {
+		return nil, errors.New("invalid policy: negative answerDelay")
+	}
+	return &plc, nil
+}
+
+func (mrfrp *MRFRepo) getPolicy() *MRFPolicy {
+	mrfrp.mu.RLock()
+	defer mrfrp.mu.RUnlock()
+	return mrfrp.policy
+}
+
+// ListMRFRepos returns the loaded repositories with their file count and policy
+func ListMRFRepos() []MRFRepoInfo {
+	lst := []MRFRepoInfo{}
+	for _, name := range MRFRepos.Names() {
+		if repo, ok := MRFRepos.GetMRFRepo(name); ok {
+			lst = append(lst, MRFRepoInfo{Name: name, Files: repo.FilesCount(), Policy: repo.getPolicy()})
+		}
+	}
+	return lst
+}
+
+// ---------------------------------------------------------------------------
+
+// selectMRFRepo picks the repository of an inbound call
+func (ss *SipSession) selectMRFRepo(sipmsg *SipMessage) {
+	numbers := []string{sipmsg.StartLine.UserPart}
+	var mtch []string
+	if RMatch(sipmsg.ToHeader, NumberOnly, &mtch) {
+		numbers = append(numbers, mtch[1])
+	}
+	if ss.UserEquipment != nil {
+		numbers = append(numbers, ss.UserEquipment.MsIsdn)
+	}
+	if repo, ok := MRFRepos.SelectMRFRepo(numbers...); ok {
+		ss.MRFRepo = repo
+	}
+}
+
+func (ss *SipSession) mrfPolicy() *MRFPolicy {
+	if ss.MRFRepo == nil {
+		return nil
+	}
+	return ss.MRFRepo.getPolicy()
+}
@@ -7,24 +7,31 @@ import (
 	"sipclientgo/global"
 	"sipclientgo/rtp"
 	"sipclientgo/system"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	ExtRaw string = "raw"
-	ExtWav string = "wav"
-	ExtMp3 string = "mp3"
+	ExtRaw  string = "raw"
+	ExtWav  string = "wav"
+	ExtMp3  string = "mp3"
+	ExtFlac string = "flac"
 )
 
 var MRFRepos *MRFRepoCollection
 
 type MRFRepo struct {
 	name    string
+	dir     string
 	mu      sync.RWMutex
 	pcmdata map[string][]int16
 	txdata  map[string]map[uint8][]byte
+	files   map[string]mediaStamp
+
+	policy      *MRFPolicy
+	policyStamp mediaStamp
 }
 
 type MRFRepoCollection struct {
@@ -54,58 +61,134 @@ func getExtension(fn string) string {
 	return system.ASCIIToLower(fn[idx+1:])
 }
 
+// loadMedia builds the default repository from the files of the media directory and one repository per subdirectory
 func loadMedia(rn string) map[string]*MRFRepo {
 	mrfrepos := make(map[string]*MRFRepo)
-	mrfrepo := MRFRepo{name: rn, pcmdata: make(map[string][]int16), txdata: make(map[string]map[uint8][]byte)}
-	mrfrepos[rn] = &mrfrepo
+	mrfrepo := newMRFRepo(rn, global.MediaPath)
+	mrfrepos[rn] = mrfrepo
 
-	dentries, err := os.ReadDir(global.MediaPath)
-	if err != nil {
+	if err := mrfrepo.loadDir(); err != nil {
 		panic(err)
 	}
+
+	dentries, _ := os.ReadDir(global.MediaPath)
 	for _, dentry := range dentries {
-		if dentry.IsDir() {
+		name := dentry.Name()
+		if !dentry.IsDir() || validRepoName(name) != nil {
+			continue
+		}
+		if _, ok := mrfrepos[name]; ok {
+			fmt.Printf("Repository: %s - Name reserved - Skipped\n", name)
+			continue
+		}
+		fmt.Printf("Loading repository: %s\n", name)
+		repo := newMRFRepo(name, filepath.Join(global.MediaPath, name))
+		if err := repo.loadDir(); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		mrfrepos[name] = repo
+	}
+
+	return mrfrepos
+}
+
+func (mrfrp *MRFRepo) loadDir() error {
+	dentries, err := os.ReadDir(mrfrp.dir)
+	if err != nil {
+		return err
+	}
+	for _, dentry := range dentries {
+		if dentry.IsDir() || strings.HasPrefix(dentry.Name(), ".") {
 			continue
 		}
 		filename := dentry.Name()
-		fullpath := filepath.Join(global.MediaPath, filename)
-
-		var pcmBytes []int16
-		var err error
-		var rawpath string
-
-		filenameonly := dropExtension(filename)
-		var comment string
-
-		switch ext := getExtension(filename); ext {
-		case ExtRaw:
-			pcmBytes, err = rtp.ReadPCMRaw(fullpath)
-		case ExtWav, ExtMp3:
-			rawpath, err = rtp.RunSox(global.SoxPath, global.MediaPath, filename, filenameonly)
-			if err == nil {
-				pcmBytes, err = rtp.ReadPCMRaw(rawpath)
-				comment = " (converted and deleted)"
+		if filename == mrfPolicyFile {
+			if err := mrfrp.loadPolicy(); err != nil {
+				fmt.Printf("Filename: %s - %v - Skipped\n", filename, err)
 			}
-		default:
-			fmt.Printf("Filename: %s - Unsupported Extension: %s - Skipped\n", filename, ext)
+			continue
+		}
+		if !IsMediaFile(filename) {
+			fmt.Printf("Filename: %s - Unsupported Extension: %s - Skipped\n", filename, getExtension(filename))
 			continue
 		}
 
+		duration, err := mrfrp.loadFile(filename)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Printf("Filename: %s - %v - Skipped\n", filename, err)
 			continue
 		}
 
-		// Calculate duration -- TODO duration not accurate vs playback duration
-		duration := float64(len(pcmBytes)) / global.PcmSamplingRate
+		fmt.Printf("Filename: %s, Duration: %s\n", filename, formattedTime(duration))
+	}
+	return nil
+}
+
+func newMRFRepo(rn, dir string) *MRFRepo {
+	return &MRFRepo{name: rn, dir: dir, pcmdata: make(map[string][]int16), txdata: make(map[string]map[uint8][]byte), files: make(map[string]mediaStamp)}
+}
 
-		fmt.Printf("Filename: %s%s, Duration: %s\n", filename, comment, formattedTime(duration))
+func IsMediaFile(fn string) bool {
+	switch getExtension(fn) {
+	case ExtRaw, ExtWav, ExtMp3, ExtFlac:
+		return true
+	}
+	return false
+}
 
-		mrfrepo.pcmdata[filenameonly] = pcmBytes
-		mrfrepo.txdata[filenameonly] = make(map[uint8][]byte)
+// loadFile decodes the file and adds or replaces its audio key
+func (mrfrp *MRFRepo) loadFile(filename string) (float64, error) {
+	fullpath := filepath.Join(mrfrp.dir, filename)
+	fi, err := os.Stat(fullpath)
+	if err != nil {
+		return 0, err
 	}
+	pcm, err := decodeMedia(fullpath)
+	if err != nil {
+		return 0, err
+	}
+	mrfrp.setFile(filename, fi, pcm)
+	return float64(len(pcm)) / global.PcmSamplingRate, nil
+}
 
-	return mrfrepos
+// raw files hold 8 kHz PCM as previously converted for RTP - everything is kept at PcmSamplingRate
+func decodeMedia(fullpath string) ([]int16, error) {
+	return rtp.ReadAudioFile(fullpath, global.SamplingRate, global.PcmSamplingRate)
+}
+
+// setFile stores the PCM of the file audio key and drops the cached codec data
+func (mrfrp *MRFRepo) setFile(filename string, fi os.FileInfo, pcm []int16) {
+	key := dropExtension(filename)
+	mrfrp.mu.Lock()
+	defer mrfrp.mu.Unlock()
+	mrfrp.pcmdata[key] = pcm
+	mrfrp.txdata[key] = make(map[uint8][]byte)
+	mrfrp.files[filename] = mediaStamp{size: fi.Size(), modTime: fi.ModTime()}
+}
+
+// unloadFile drops the audio key of a removed file - or reloads it from another file with the same key
+func (mrfrp *MRFRepo) unloadFile(filename string) {
+	key := dropExtension(filename)
+	mrfrp.mu.Lock()
+	delete(mrfrp.files, filename)
+	other := ""
+	for fn := range mrfrp.files {
+		if dropExtension(fn) == key {
+			other = fn
+			break
+		}
+	}
+	if other == "" {
+		delete(mrfrp.pcmdata, key)
+		delete(mrfrp.txdata, key)
+	}
+	mrfrp.mu.Unlock()
+	if other != "" {
+		if _, err := mrfrp.loadFile(other); err != nil {
+			system.LogError(system.LTFileUpload, fmt.Sprintf("Failed to reload [%s]: %v", other, err))
+		}
+	}
 }
 
 func formattedTime(totsec float64) string {
@@ -135,6 +218,55 @@ func (mrfrps *MRFRepoCollection) GetMRFRepo(upart string) (*MRFRepo, bool) {
 	return mrfrp, ok
 }
 
+// SelectMRFRepo returns the first repository named after one of the called numbers, or the default repository
+func (mrfrps *MRFRepoCollection) SelectMRFRepo(numbers ...string) (*MRFRepo, bool) {
+	mrfrps.mu.RLock()
+	defer mrfrps.mu.RUnlock()
+	for _, num := range numbers {
+		if num == "" {
+			continue
+		}
+		if mrfrp, ok := mrfrps.repos[num]; ok {
+			return mrfrp, true
+		}
+	}
+	mrfrp, ok := mrfrps.repos[global.MRFRepoName]
+	return mrfrp, ok
+}
+
+func (mrfrps *MRFRepoCollection) Names() []string {
+	mrfrps.mu.RLock()
+	defer mrfrps.mu.RUnlock()
+	names := system.Keys(mrfrps.repos)
+	slices.Sort(names)
+	return names
+}
+
+// addRepo creates the repository of a new media subdirectory - or returns the existing one
+func (mrfrps *MRFRepoCollection) addRepo(name string) (*MRFRepo, error) {
+	if err := validRepoName(name); err != nil {
+		return nil, err
+	}
+	mrfrps.mu.Lock()
+	defer mrfrps.mu.Unlock()
+	if mrfrp, ok := mrfrps.repos[name]; ok {
+		return mrfrp, nil
+	}
+	dir := filepath.Join(global.MediaPath, name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	mrfrp := newMRFRepo(name, dir)
+	mrfrps.repos[name] = mrfrp
+	return mrfrp, nil
+}
+
+func (mrfrps *MRFRepoCollection) removeRepo(name string) {
+	mrfrps.mu.Lock()
+	defer mrfrps.mu.Unlock()
+	delete(mrfrps.repos, name)
+}
+
 func (mrfrps *MRFRepoCollection) AudioFileExists(upart, key string) bool {
 	mrfrps.mu.RLock()
 	defer mrfrps.mu.RUnlock()
@@ -166,7 +298,8 @@ func (mrfrp *MRFRepo) GetTx(key string, codec uint8) ([]byte, byte, bool) {
 	}
 	txbytes, ok := txdata[codec]
 	if !ok {
-		txbytes = rtp.EncodePCM(mrfrp.pcmdata[key], codec)
+		// G.711 and G.722 (in its 8 kHz mode) are both fed with 8 kHz samples
+		txbytes = rtp.EncodePCM(rtp.Resample(mrfrp.pcmdata[key], global.PcmSamplingRate, global.SamplingRate), codec)
 		txdata[codec] = txbytes
 	}
 	return txbytes, silence, true
@@ -177,9 +310,3 @@ func (mrfrp *MRFRepo) FilesCount() int {
 	defer mrfrp.mu.RUnlock()
 	return len(mrfrp.pcmdata)
 }
-
-// func (mrfr *MRFRepoCollection) AddOrUpdate(upart, key string, bytes []int16) {
-// 	mrfr.mu.Lock()
-// 	defer mrfr.mu.Unlock()
-// 	mrfr.repos[upart][key] = bytes
-// }
@@ -0,0 +1,282 @@
+package sip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	. "sipclientgo/global"
+	"sipclientgo/sip/mode"
+	"sipclientgo/system"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// packet capture - SIP and RTP written to libpcap files with synthetic IP/UDP headers (LINKTYPE_RAW)
+// one global file per capture run plus one file per call, named after its Call-ID
+
+const (
+	pcapMagic      uint32 = 0xa1b2c3d4
+	pcapSnapLen    uint32 = 65535
+	pcapLinkRaw    uint32 = 101
+	pcapHeaderLen         = 24
+	ipv4HeaderLen         = 20
+	ipv6HeaderLen         = 40
+	pcapTTL               = 64
+	pcapCallPrefix        = "call-"
+)
+
+type packetCapture struct {
+	active     atomic.Bool
+	mu         sync.Mutex
+	global     *os.File
+	globalPath string
+	calls      map[string]*os.File
+}
+
+var capture packetCapture
+
+// StartCapture opens a new global capture file and enables capturing
+func StartCapture() (string, error) {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	if capture.active.Load() {
+		return "", errors.New("capture already running")
+	}
+	if PcapPath == "" {
+		return "", errors.New("no capture directory configured")
+	}
+	if err := os.MkdirAll(PcapPath, 0o755); err != nil {
+		return "", err
+	}
+	fn := filepath.Join(PcapPath, fmt.Sprintf("capture-%s.pcap", time.Now().UTC().Format("20060102-150405")))
+	f, err := openPcap(fn)
+	if err != nil {
+		return "", err
+	}
+	capture.global, capture.globalPath = f, fn
+	capture.calls = make(map[string]*os.File)
+	capture.active.Store(true)
+	system.LogInfo(system.LTSystem, "Packet capture started: "+fn)
+	return filepath.Base(fn), nil
+}
+
+// StopCapture closes the global and all open per call files
+func StopCapture() error {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	if !capture.active.Swap(false) {
+		return errors.New("no capture running")
+	}
+	capture.global.Close()
+	capture.global = nil
+	for k, f := range capture.calls {
+		f.Close()
+		delete(capture.calls, k)
+	}
+	system.LogInfo(system.LTSystem, "Packet capture stopped: "+capture.globalPath)
+	return nil
+}
+
+func IsCapturing() bool {
+	return capture.active.Load()
+}
+
+// CaptureFile returns the path of the per call capture or the latest global capture when callID is empty
+func CaptureFile(callID string) (string, bool) {
+	var fn string
+	if callID == "" {
+		capture.mu.Lock()
+		fn = capture.globalPath
+		capture.mu.Unlock()
+	} else {
+		fn = callCaptureName(callID)
+	}
+	if fn == "" {
+		return "", false
+	}
+	if _, err := os.Stat(fn); err != nil {
+		return "", false
+	}
+	return fn, true
+}
+
+func callCaptureName(callID string) string {
+	return filepath.Join(PcapPath, pcapCallPrefix+fileSafe(callID)+".pcap")
+}
+
+// fileSafe replaces the characters of a Call-ID that are not safe in file names
+func fileSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '.' || r == '@' || r == '_' || ('0' <= r && r <= '9') || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// openPcap appends to an existing capture or creates it with the global header
+func openPcap(fn string) (*os.File, error) {
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+		return f, nil
+	}
+	hdr := make([]byte, pcapHeaderLen)
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkRaw)
+	if _, err := f.Write(hdr); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// capturePacket writes the UDP payload to the global capture and, for calls, to the per call capture
+func capturePacket(ss *SipSession, src, dst net.Addr, payload []byte) {
+	if !capture.active.Load() {
+		return
+	}
+	rec := pcapRecord(time.Now(), src, dst, payload)
+	if rec == nil {
+		return
+	}
+
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	if !capture.active.Load() {
+		return
+	}
+	if _, err := capture.global.Write(rec); err != nil {
+		system.LogError(system.LTSystem, "Failed to write packet capture: "+err.Error())
+	}
+	if ss == nil || ss.Mode != mode.Multimedia || ss.CallID == "" || ss.IsDisposed {
+		return
+	}
+	f, ok := capture.calls[ss.CallID]
+	if !ok {
+		var err error
+		if f, err = openPcap(callCaptureName(ss.CallID)); err != nil {
+			system.LogError(system.LTSystem, "Failed to open call capture: "+err.Error())
+			return
+		}
+		capture.calls[ss.CallID] = f
+	}
+	_, _ = f.Write(rec)
+}
+
+// closeCallCapture is called when the session is disposed
+func closeCallCapture(callID string) {
+	if !capture.active.Load() {
+		return
+	}
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	if f, ok := capture.calls[callID]; ok {
+		f.Close()
+		delete(capture.calls, callID)
+	}
+}
+
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+// pcapRecord builds the record header followed by the IPv4/IPv6 and UDP headers and the payload
+func pcapRecord(tm time.Time, src, dst net.Addr, payload []byte) []byte {
+	shost, sport := addrIPPort(src)
+	dhost, dport := addrIPPort(dst)
+	if shost == nil || dhost == nil {
+		return nil
+	}
+
+	v4 := shost.To4() != nil && dhost.To4() != nil
+	iplen := ipv6HeaderLen
+	if v4 {
+		iplen = ipv4HeaderLen
+	}
+	udplen := udpHeaderLen + len(payload)
+	pktlen := iplen + udplen
+
+	rec := make([]byte, 16, 16+pktlen)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(tm.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(tm.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(pktlen))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(pktlen))
+
+	var srcIP, dstIP net.IP
+	if v4 {
+		srcIP, dstIP = shost.To4(), dhost.To4()
+		ip := rec[len(rec) : len(rec)+ipv4HeaderLen]
+		rec = rec[:len(rec)+ipv4HeaderLen]
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(pktlen))
+		binary.BigEndian.PutUint16(ip[6:], 0x4000) // DF
+		ip[8] = pcapTTL
+		ip[9] = ipProtoUDP
+		copy(ip[12:], srcIP)
+		copy(ip[16:], dstIP)
+		binary.BigEndian.PutUint16(ip[10:], ^checksumFold(checksumSum(0, ip)))
+	} else {
+		srcIP, dstIP = shost.To16(), dhost.To16()
+		ip := rec[len(rec) : len(rec)+ipv6HeaderLen]
+		rec = rec[:len(rec)+ipv6HeaderLen]
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(udplen))
+		ip[6] = ipProtoUDP
+		ip[7] = pcapTTL
+		copy(ip[8:], srcIP)
+		copy(ip[24:], dstIP)
+	}
+
+	udp := rec[len(rec) : len(rec)+udpHeaderLen]
+	rec = rec[:len(rec)+udpHeaderLen]
+	binary.BigEndian.PutUint16(udp[0:], uint16(sport))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dport))
+	binary.BigEndian.PutUint16(udp[4:], uint16(udplen))
+	rec = append(rec, payload...)
+
+	// checksum over the pseudo header, UDP header and payload
+	sum := checksumSum(0, srcIP)
+	sum = checksumSum(sum, dstIP)
+	sum += uint32(ipProtoUDP) + uint32(udplen)
+	sum = checksumSum(sum, rec[len(rec)-udplen:])
+	csum := ^checksumFold(sum)
+	if csum == 0 {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], csum)
+	return rec
+}
+
+func checksumSum(sum uint32, data []byte) uint32 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
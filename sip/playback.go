@@ -0,0 +1,137 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	. "sipclientgo/global"
+	"time"
+)
+
+// playback control of MRF audio files on established calls - used by the REST API, the portal websocket and scenarios
+
+const (
+	PlaybackPlay   = "play"
+	PlaybackStop   = "stop"
+	PlaybackBarge  = "barge"
+	PlaybackStatus = "status"
+)
+
+var (
+	// ErrCallNotFound is returned when no session has the Call-ID of the request
+	ErrCallNotFound = errors.New("call not found")
+	// ErrInvalidRequest is wrapped by the errors of requests that cannot be valid whatever the call state
+	ErrInvalidRequest = errors.New("invalid request")
+)
+
+type PlaybackRequest struct {
+	Action  string `json:"action"`
+	CallID  string `json:"callID"`
+	Audio   string `json:"audio,omitempty"`
+	Loop    bool   `json:"loop,omitempty"`
+	HangUp  bool   `json:"hangup,omitempty"`
+	BargeIn bool   `json:"bargeIn,omitempty"`
+}
+
+type PlaybackState struct {
+	CallID     string `json:"callID"`
+	Audio      string `json:"audio"`
+	Playing    bool   `json:"playing"`
+	Loop       bool   `json:"loop"`
+	HangUp     bool   `json:"hangup"`
+	BargeIn    bool   `json:"bargeIn"`
+	PositionMs int    `json:"positionMs"`
+	DurationMs int    `json:"durationMs"`
+}
+
+// ControlPlayback applies a playback action to the call and returns the resulting playback state
+func ControlPlayback(req PlaybackRequest) (*PlaybackState, error) {
+	ss, ok := findCall(req.CallID)
+	if !ok {
+		return nil, ErrCallNotFound
+	}
+	switch req.Action {
+	case PlaybackPlay:
+		if err := ss.playAudio(req.Audio, req.Loop, req.HangUp); err != nil {
+			return nil, err
+		}
+	case PlaybackStop:
+		if !ss.stopPlayback() {
+			return nil, errors.New("no audio playing")
+		}
+	case PlaybackBarge:
+		ss.bargeEnabled.Store(req.BargeIn)
+	case PlaybackStatus, "":
+	default:
+		return nil, fmt.Errorf("%w: invalid playback action [%s]", ErrInvalidRequest, req.Action)
+	}
+	return ss.playbackState(), nil
+}
+
+// playAudio replaces any ongoing playback with the audio key of the session MRF repository
+func (ss *SipSession) playAudio(key string, loop, hangup bool) error {
+	if !ss.IsEstablished() || ss.RemoteMedia == nil {
+		return errors.New("call not established with media")
+	}
+	return ss.startPlayback(key, loop, hangup)
+}
+
+// playEarlyMedia streams the audio in a loop before an inbound call is answered
+func (ss *SipSession) playEarlyMedia(key string) error {
+	if !ss.IsBeingEstablished() || ss.RemoteMedia == nil {
+		return errors.New("call not being established with media")
+	}
+	return ss.startPlayback(key, true, false)
+}
+
+func (ss *SipSession) startPlayback(key string, loop, hangup bool) error {
+	if ss.MRFRepo == nil {
+		repo, ok := MRFRepos.GetMRFRepo(MRFRepoName)
+		if !ok {
+			return errors.New("MRF repository not found")
+		}
+		ss.MRFRepo = repo
+	}
+	if ss.dtmfSending.Load() {
+		return errors.New("digits being sent")
+	}
+	if !ss.MRFRepo.AudioFileExists(key) {
+		return fmt.Errorf("%w: audio [%s] not found", ErrInvalidRequest, key)
+	}
+	if ss.stopPlayback() && !waitFor(time.Second, func() bool { return !ss.isPlaying() }) {
+		return errors.New("ongoing playback could not be stopped")
+	}
+	go ss.startRTPStreaming(key, true, loop, hangup)
+	return nil
+}
+
+func (ss *SipSession) stopPlayback() bool {
+	if ss.IsDisposed {
+		return false
+	}
+	return ss.stopRTPStreaming()
+}
+
+func (ss *SipSession) isPlaying() bool {
+	ss.rtpmutex.Lock()
+	defer ss.rtpmutex.Unlock()
+	return ss.isrtpstreaming
+}
+
+func (ss *SipSession) playbackState() *PlaybackState {
+	ss.rtpmutex.Lock()
+	defer ss.rtpmutex.Unlock()
+	st := &PlaybackState{
+		CallID:  ss.CallID,
+		Audio:   ss.rtpAudioKey,
+		Playing: ss.isrtpstreaming,
+		Loop:    ss.rtpLoop,
+		HangUp:  ss.rtpHangUp,
+		BargeIn: ss.bargeEnabled.Load(),
+	}
+	// G.711 and G.722 both send RTPPayloadSize bytes per PacketizationTime
+	st.DurationMs = ss.rtpAudioLen * PacketizationTime / RTPPayloadSize
+	if st.Playing {
+		st.PositionMs = int(ss.rtpPosition.Load()) * PacketizationTime / RTPPayloadSize
+	}
+	return st
+}
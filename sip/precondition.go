@@ -0,0 +1,218 @@
+package sip
+
+import (
+	"fmt"
+	. "sipclientgo/global"
+	"sipclientgo/q850"
+	"sipclientgo/sip/state"
+	"sipclientgo/sip/status"
+	"sipclientgo/system"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Moatassem/sdp"
+)
+
+// QoS preconditions (RFC 3312) - segmented status of the audio stream carried in curr/des/conf attributes
+// the local segment (UE access) is reserved once the first reliable 18x is PRACKed, the remote one is as reported by the peer
+// outbound calls offer preconditions and report the reservation in an UPDATE; inbound calls alert only once both segments are met
+
+const (
+	qosNone     = "none"
+	qosSend     = "send"
+	qosRecv     = "recv"
+	qosSendRecv = "sendrecv"
+
+	qosMandatory = "mandatory"
+)
+
+type qosPrecondition struct {
+	mu              sync.Mutex
+	negotiated      bool // peer SDP carried preconditions
+	localCurr       string
+	remoteCurr      string
+	remoteMandatory bool // peer requires its own segment to be reserved
+	confRequested   bool // peer asked to be told once the local segment is reserved
+	reserved        bool
+	dropped         bool // first peer SDP without preconditions - ss.qos itself is never reset once the session is shared
+}
+
+func newQoSPrecondition() *qosPrecondition {
+	return &qosPrecondition{localCurr: qosNone, remoteCurr: qosNone}
+}
+
+// swapQoSDirection mirrors a direction tag of the peer segment - tags are from the point of view of the SDP writer
+func swapQoSDirection(dir string) string {
+	switch dir {
+	case qosSend:
+		return qosRecv
+	case qosRecv:
+		return qosSend
+	}
+	return dir
+}
+
+// preconditions returns the QoS status of the call - nil when preconditions were not offered or were dropped
+func (ss *SipSession) preconditions() *qosPrecondition {
+	qos := ss.qos
+	if qos == nil {
+		return nil
+	}
+	qos.mu.Lock()
+	defer qos.mu.Unlock()
+	if qos.dropped {
+		return nil
+	}
+	return qos
+}
+
+func isQoSAttribute(attr *sdp.Attr) bool {
+	return (attr.Name == "curr" || attr.Name == "des" || attr.Name == "conf") && strings.HasPrefix(attr.Value, "qos ")
+}
+
+// updateQoS reads the peer status from its audio media - preconditions are dropped if the first peer SDP has none
+func (ss *SipSession) updateQoS(media *sdp.Media) {
+	qos := ss.qos
+	if qos == nil || media == nil {
+		return
+	}
+	qos.mu.Lock()
+	defer qos.mu.Unlock()
+	if qos.dropped {
+		return
+	}
+	var found bool
+	for _, attr := range media.Attributes {
+		if !isQoSAttribute(attr) {
+			continue
+		}
+		fields := strings.Fields(attr.Value)
+		switch {
+		case attr.Name == "curr" && len(fields) == 3 && fields[1] == "local":
+			qos.remoteCurr = swapQoSDirection(fields[2])
+		case attr.Name == "des" && len(fields) == 4 && fields[2] == "local":
+			qos.remoteMandatory = fields[1] == qosMandatory
+		case attr.Name == "conf" && len(fields) == 3 && fields[1] == "remote":
+			qos.confRequested = true
+		}
+		found = true
+	}
+	if found {
+		qos.negotiated = true
+		return
+	}
+	if !qos.negotiated {
+		qos.dropped = true
+	}
+}
+
+func (qos *qosPrecondition) met() bool {
+	return qos.localCurr == qosSendRecv && (!qos.remoteMandatory || qos.remoteCurr == qosSendRecv)
+}
+
+func (ss *SipSession) qosMet() bool {
+	qos := ss.qos
+	if qos == nil {
+		return true
+	}
+	qos.mu.Lock()
+	defer qos.mu.Unlock()
+	return qos.dropped || qos.met()
+}
+
+// setQoSAttributes replaces the precondition attributes of the audio media of an SDP built by the UE
+func (ss *SipSession) setQoSAttributes(ses *sdp.Session) {
+	qos := ss.qos
+	if qos == nil || ses == nil {
+		return
+	}
+	media := ses.GetAudioMediaFlow()
+	if media == nil {
+		return
+	}
+	qos.mu.Lock()
+	if qos.dropped {
+		qos.mu.Unlock()
+		return
+	}
+	attrs := []*sdp.Attr{
+		{Name: "curr", Value: "qos local " + qos.localCurr},
+		{Name: "curr", Value: "qos remote " + qos.remoteCurr},
+		{Name: "des", Value: "qos mandatory local sendrecv"},
+		{Name: "des", Value: "qos mandatory remote sendrecv"},
+	}
+	if qos.negotiated && qos.remoteMandatory && qos.remoteCurr != qosSendRecv {
+		attrs = append(attrs, &sdp.Attr{Name: "conf", Value: "qos remote sendrecv"})
+	}
+	qos.mu.Unlock()
+	media.Attributes = append(slices.DeleteFunc(media.Attributes, isQoSAttribute), attrs...)
+}
+
+// processQoSAnswer applies the peer status of an SDP answer received in a response to UPDATE
+func (ss *SipSession) processQoSAnswer(sipmsg *SipMessage) {
+	if ss.preconditions() == nil {
+		return
+	}
+	sdpbytes, ok := sipmsg.GetBodyPart(SDP)
+	if !ok {
+		return
+	}
+	sdpses, err := sdp.Parse(sdpbytes)
+	if err != nil {
+		system.LogError(system.LTSDPStack, "Invalid SDP answer: "+err.Error())
+		return
+	}
+	ss.updateQoS(sdpses.GetAudioMediaFlow())
+}
+
+// reserveQoS marks the local segment as reserved - the peer is told in an UPDATE when it waits for it
+func (ss *SipSession) reserveQoS() {
+	qos := ss.qos
+	if qos == nil || !ss.IsBeingEstablished() {
+		return
+	}
+	qos.mu.Lock()
+	if !qos.negotiated || qos.reserved { // never negotiated once dropped
+		qos.mu.Unlock()
+		return
+	}
+	qos.reserved = true
+	qos.localCurr = qosSendRecv
+	notify := ss.Direction == OUTBOUND || qos.confRequested
+	qos.mu.Unlock()
+
+	system.LogInfo(system.LTSIPStack, fmt.Sprintf("Call [%s] - Local QoS resources reserved", ss.CallID))
+	if !notify {
+		return
+	}
+	ss.setQoSAttributes(ss.LocalSDP)
+	ss.SDPSessionVersion += 1
+	ss.LocalSDP.Origin.SessionVersion = ss.SDPSessionVersion
+	ss.SendRequest(UPDATE, nil, NewMessageSDPBody(ss.LocalSDP))
+}
+
+// awaitPreconditions sends the 183 answer and waits until both segments are met - the call is rejected otherwise
+func (ss *SipSession) awaitPreconditions(trans *Transaction) bool {
+	if !ss.IsPRACKSupported {
+		ss.SetState(state.BeingRejected)
+		hdrs := NewSHQ850OrSIP(q850.QualityOfServiceNotAvailable, "Preconditions require reliable provisional responses", "")
+		hdrs.AddHeader(Require, "100rel")
+		ss.SendResponseDetailed(trans, ResponsePack{StatusCode: status.ExtensionRequired, CustomHeaders: hdrs}, EmptyBody())
+		ss.logSessData(nil, utcNow())
+		return false
+	}
+	ss.sendProvisional(trans, status.SessionProgress, NewMessageSDPBody(ss.LocalSDP))
+	waitFor(time.Duration(PreconditionTimeout)*time.Second, func() bool {
+		return ss.qosMet() || !ss.IsBeingEstablished()
+	})
+	if !ss.IsBeingEstablished() {
+		return false
+	}
+	if !ss.qosMet() {
+		ss.RejectMe(trans, status.PreconditionFailure, q850.QualityOfServiceNotAvailable, "QoS preconditions not met")
+		return false
+	}
+	return true
+}
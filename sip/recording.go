@@ -0,0 +1,304 @@
+package sip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	. "sipclientgo/global"
+	"sipclientgo/rtp"
+	"sipclientgo/system"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// call recording - both RTP directions decoded to PCM, aligned on a common timeline by RTP timestamp and written to WAV
+// the timeline is resynchronised to the wall clock whenever a stream jumps e.g. between two played files
+
+const (
+	wavHeaderLen    = 44
+	recordingWindow = 1   // seconds of audio kept in memory for late packets before flushing to file
+	recordingResync = 200 // ms of drift between RTP timestamps and wall clock that resets the stream base
+)
+
+type recordStream struct {
+	synced bool
+	tsBase uint32
+	base   int64 // timeline position of tsBase in samples
+	pcm    []int16
+}
+
+type callRecorder struct {
+	mu      sync.Mutex
+	mode    RecordingMode
+	path    string
+	file    *os.File
+	rate    int
+	start   time.Time
+	flushed int64 // samples per channel already written
+	tx      recordStream
+	rx      recordStream
+}
+
+func newCallRecorder(ss *SipSession, mode RecordingMode) (*callRecorder, error) {
+	if RecordPath == "" {
+		return nil, errors.New("no recording directory configured")
+	}
+	if err := os.MkdirAll(RecordPath, 0o755); err != nil {
+		return nil, err
+	}
+	rate := SamplingRate // G.722 is decoded in its 8 kHz mode like G.711
+	fn := filepath.Join(RecordPath, fmt.Sprintf("%s_%s_%s.wav", time.Now().UTC().Format("20060102-150405"), ss.UserEquipment.Imsi, fileSafe(ss.CallID)))
+	f, err := os.Create(fn)
+	if err != nil {
+		return nil, err
+	}
+	rec := &callRecorder{mode: mode, path: fn, file: f, rate: rate, start: time.Now()}
+	if _, err := f.Write(rec.wavHeader(0)); err != nil {
+		f.Close()
+		os.Remove(fn)
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (rec *callRecorder) channels() int {
+	if rec.mode == RecordingStereo {
+		return 2
+	}
+	return 1
+}
+
+func (rec *callRecorder) wavHeader(dataLen int) []byte {
+	chnls := rec.channels()
+	hdr := make([]byte, wavHeaderLen)
+	copy(hdr[0:], "RIFF")
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(36+dataLen))
+	copy(hdr[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(hdr[16:], 16)
+	binary.LittleEndian.PutUint16(hdr[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(hdr[22:], uint16(chnls))
+	binary.LittleEndian.PutUint32(hdr[24:], uint32(rec.rate))
+	binary.LittleEndian.PutUint32(hdr[28:], uint32(rec.rate*chnls*2))
+	binary.LittleEndian.PutUint16(hdr[32:], uint16(chnls*2))
+	binary.LittleEndian.PutUint16(hdr[34:], 16)
+	copy(hdr[36:], "data")
+	binary.LittleEndian.PutUint32(hdr[40:], uint32(dataLen))
+	return hdr
+}
+
+// writeRTP decodes the audio of an RTP packet and places it on the timeline of its direction
+func (rec *callRecorder) writeRTP(dir Direction, pkt []byte, pt uint8) {
+	if len(pkt) <= RTPHeaderSize || pkt[1]&0x7f != pt {
+		return
+	}
+	pcm := rtp.DecodeToPCM(pkt[RTPHeaderSize:], pt)
+	if len(pcm) == 0 {
+		return
+	}
+	ts := binary.BigEndian.Uint32(pkt[4:8])
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.file == nil {
+		return
+	}
+
+	strm := &rec.rx
+	if dir == OUTBOUND {
+		strm = &rec.tx
+	}
+	factor := int64(rec.rate / SamplingRate) // RTP clock is 8 kHz for G.711 and G.722
+	wall := int64(time.Since(rec.start)) * int64(rec.rate) / int64(time.Second)
+	pos := strm.base + int64(int32(ts-strm.tsBase))*factor
+	if !strm.synced || abs(pos-wall) > int64(rec.rate*recordingResync/1000) {
+		strm.synced, strm.tsBase, strm.base, pos = true, ts, wall, wall
+	}
+
+	idx := int(pos - rec.flushed)
+	if idx < 0 {
+		return // too late
+	}
+	if end := idx + len(pcm); end > len(strm.pcm) {
+		strm.pcm = append(strm.pcm, make([]int16, end-len(strm.pcm))...)
+	}
+	copy(strm.pcm[idx:], pcm)
+
+	if keep := rec.rate * recordingWindow; max(len(rec.rx.pcm), len(rec.tx.pcm)) > 2*keep {
+		rec.flush(max(len(rec.rx.pcm), len(rec.tx.pcm)) - keep)
+	}
+}
+
+// flush writes the first n samples of both directions - interleaved for stereo, summed for mixed
+func (rec *callRecorder) flush(n int) {
+	sample := func(s []int16, i int) int16 {
+		if i < len(s) {
+			return s[i]
+		}
+		return 0
+	}
+	chnls := rec.channels()
+	buf := make([]byte, 0, n*chnls*2)
+	for i := range n {
+		tx, rx := sample(rec.tx.pcm, i), sample(rec.rx.pcm, i)
+		if chnls == 2 {
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(tx))
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(rx))
+		} else {
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(int16(max(-32768, min(32767, int32(tx)+int32(rx))))))
+		}
+	}
+	if _, err := rec.file.Write(buf); err != nil {
+		system.LogError(system.LTMediaStack, "Failed to write call recording: "+err.Error())
+	}
+	rec.tx.pcm = rec.tx.pcm[min(n, len(rec.tx.pcm)):]
+	rec.rx.pcm = rec.rx.pcm[min(n, len(rec.rx.pcm)):]
+	rec.flushed += int64(n)
+}
+
+// close flushes the remaining audio and completes the WAV header sizes
+func (rec *callRecorder) close() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.file == nil {
+		return
+	}
+	rec.flush(max(len(rec.rx.pcm), len(rec.tx.pcm)))
+	dataLen := int(rec.flushed) * rec.channels() * 2
+	if _, err := rec.file.WriteAt(rec.wavHeader(dataLen), 0); err != nil {
+		system.LogError(system.LTMediaStack, "Failed to complete call recording: "+err.Error())
+	}
+	rec.file.Close()
+	rec.file = nil
+	system.LogInfo(system.LTMediaStack, fmt.Sprintf("Call recording saved: %s (%ds)", rec.path, rec.flushed/int64(rec.rate)))
+}
+
+func abs(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// ---------------------------------------------------------------------------
+
+func (ss *SipSession) startRecording(mode RecordingMode) error {
+	if mode == RecordingNone || mode == "" {
+		return errors.New("no recording mode")
+	}
+	if ss.recorder.Load() != nil {
+		return errors.New("call already being recorded")
+	}
+	rec, err := newCallRecorder(ss, mode)
+	if err != nil {
+		return err
+	}
+	if !ss.recorder.CompareAndSwap(nil, rec) {
+		rec.close()
+		os.Remove(rec.path)
+		return errors.New("call already being recorded")
+	}
+	system.LogInfo(system.LTMediaStack, fmt.Sprintf("Call [%s] - %s started: %s", ss.CallID, CallRecording, rec.path))
+	return nil
+}
+
+func (ss *SipSession) stopRecording() {
+	if rec := ss.recorder.Swap(nil); rec != nil {
+		rec.close()
+	}
+}
+
+// recordRTP is called from the media loops - a no-op unless the call is being recorded
+func (ss *SipSession) recordRTP(dir Direction, pkt []byte) {
+	if rec := ss.recorder.Load(); rec != nil {
+		rec.writeRTP(dir, pkt, ss.rtpPayloadType)
+	}
+}
+
+// markAnswered stamps the answer time and starts recording when enabled for the UE
+func (ss *SipSession) markAnswered() {
+	ss.AnswerTime = time.Now().UTC()
+	ss.autoRecord()
+}
+
+// autoRecord starts recording when enabled for the UE - unless already recording early media
+func (ss *SipSession) autoRecord() {
+	if ss.recorder.Load() != nil {
+		return
+	}
+	if mode, ok := ParseRecordingMode(ss.UserEquipment.Recording); ok && mode != RecordingNone {
+		if err := ss.startRecording(mode); err != nil {
+			system.LogError(system.LTMediaStack, fmt.Sprintf("Call [%s] - Failed to start recording: %v", ss.CallID, err))
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+
+func findCall(callID string) (*SipSession, bool) {
+	for _, ue := range UEs.GetUEs() {
+		if ses, ok := ue.SesMap.Load(callID); ok {
+			return ses, true
+		}
+	}
+	return nil, false
+}
+
+// StartRecording records an established call on demand
+func StartRecording(callID string, mode RecordingMode) error {
+	ses, ok := findCall(callID)
+	if !ok || !ses.IsEstablished() {
+		return errors.New("no established call found")
+	}
+	return ses.startRecording(mode)
+}
+
+func StopRecording(callID string) error {
+	ses, ok := findCall(callID)
+	if !ok || ses.recorder.Load() == nil {
+		return errors.New("call not being recorded")
+	}
+	ses.stopRecording()
+	return nil
+}
+
+type RecordingInfo struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Modified string `json:"modified"`
+}
+
+// ListRecordings returns the saved recordings, newest first
+func ListRecordings() ([]RecordingInfo, error) {
+	entries, err := os.ReadDir(RecordPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []RecordingInfo{}, nil
+		}
+		return nil, err
+	}
+	lst := []RecordingInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".wav") {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		lst = append(lst, RecordingInfo{Name: entry.Name(), Size: fi.Size(), Modified: fi.ModTime().UTC().Format(DicTFs[JsonDateTimeMS])})
+	}
+	slices.SortFunc(lst, func(a, b RecordingInfo) int { return strings.Compare(b.Modified, a.Modified) })
+	return lst, nil
+}
+
+func RecordingFile(name string) (string, bool) {
+	fn := filepath.Join(RecordPath, filepath.Base(name))
+	if fi, err := os.Stat(fn); err != nil || fi.IsDir() {
+		return "", false
+	}
+	return fn, true
+}
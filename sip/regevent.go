@@ -0,0 +1,213 @@
+package sip
+
+import (
+	"encoding/xml"
+	"fmt"
+	. "sipclientgo/global"
+	"sipclientgo/sip/state"
+	"sipclientgo/sip/status"
+	"sipclientgo/system"
+	"strings"
+	"time"
+)
+
+// reg event package (RFC 3680) - the UE subscribes to its own registration state
+
+const regEventExpires = 600000
+
+type regInfo struct {
+	XMLName       xml.Name          `xml:"reginfo"`
+	Version       int               `xml:"version,attr"`
+	State         string            `xml:"state,attr"`
+	Registrations []regRegistration `xml:"registration"`
+}
+
+type regRegistration struct {
+	AOR      string       `xml:"aor,attr"`
+	ID       string       `xml:"id,attr"`
+	State    string       `xml:"state,attr"`
+	Contacts []regContact `xml:"contact"`
+}
+
+type regContact struct {
+	ID         string `xml:"id,attr"`
+	State      string `xml:"state,attr"`
+	Event      string `xml:"event,attr"`
+	Expires    int    `xml:"expires,attr"`
+	RetryAfter int    `xml:"retry-after,attr"`
+	URI        string `xml:"uri"`
+}
+
+func subscribeRegEvent(ue *UserEquipment) {
+	if PCSCFSocket == nil {
+		system.LogError(system.LTConfiguration, "Missing PCSCF Socket")
+		return
+	}
+
+	ue.subMu.Lock()
+	defer ue.subMu.Unlock()
+	if ue.regSub != nil {
+		return
+	}
+
+	ss := NewSS(OUTBOUND)
+	ss.SIPUDPListenser, ss.RemoteUDP, ss.SIPTransport = ue.signallingPath()
+	ss.UserEquipment = ue
+
+	hdrs := NewSipHeaders()
+	hdrs.AddHeader(P_Access_Network_Info, "IEEE-802.3")
+	hdrs.AddHeader(Event, "reg")
+	hdrs.AddHeader(Expires, system.Int2Str(regEventExpires))
+	hdrs.AddHeader(Accept, DicBodyContentType[ReginfoXML])
+	ue.addSecAgreeHeaders(&hdrs, false)
+	hdrs.AddHeader(Contact, fmt.Sprintf("<sip:%s@%s%s>", ue.Imsi, ue.contactSocket(), ue.transportParam()))
+
+	trans := ss.CreateSARequest(RequestPack{Method: SUBSCRIBE, Max70: true, RUriUP: ue.Imsi, FromUP: ue.Imsi, CustomHeaders: hdrs}, EmptyBody())
+
+	ss.SetState(state.BeingEstablished)
+	ss.AddMe()
+	ue.regSub = ss
+	ss.SendSTMessage(trans)
+}
+
+// regEventSubscribed schedules the in-dialogue refresh at half of the granted expiry
+func (ss *SipSession) regEventSubscribed(sipmsg *SipMessage) {
+	ue := ss.UserEquipment
+	expires := system.Str2Int[int](sipmsg.Headers.ValueHeader(Expires))
+	if expires <= 0 {
+		expires = regEventExpires
+	}
+
+	ue.subMu.Lock()
+	defer ue.subMu.Unlock()
+	if ue.regSub != ss {
+		return
+	}
+	if ue.regSubTimer != nil {
+		ue.regSubTimer.Stop()
+	}
+	ue.regSubTimer = time.AfterFunc(time.Duration(expires)*time.Second/2, func() {
+		ue.subMu.Lock()
+		active := ue.regSub == ss
+		ue.subMu.Unlock()
+		if !active {
+			return
+		}
+		hdrs := NewSipHeaders()
+		hdrs.AddHeader(Event, "reg")
+		hdrs.AddHeader(Expires, system.Int2Str(regEventExpires))
+		hdrs.AddHeader(Accept, DicBodyContentType[ReginfoXML])
+		ue.addSecAgreeHeaders(&hdrs, false)
+		ss.SendRequestDetailed(RequestPack{Method: SUBSCRIBE, CustomHeaders: hdrs}, nil, EmptyBody())
+	})
+}
+
+// stopRegEvent forgets the reg event subscription - the session lingers shortly for the final NOTIFY
+func (ue *UserEquipment) stopRegEvent() {
+	ue.subMu.Lock()
+	defer ue.subMu.Unlock()
+	if ue.regSubTimer != nil {
+		ue.regSubTimer.Stop()
+		ue.regSubTimer = nil
+	}
+	if ue.regSub != nil {
+		ue.regSub.DropMeTimed()
+		ue.regSub = nil
+	}
+}
+
+// releaseRegEvent is called when the subscription has failed or been terminated
+func (ss *SipSession) releaseRegEvent() {
+	ue := ss.UserEquipment
+	ue.subMu.Lock()
+	if ue.regSub == ss {
+		if ue.regSubTimer != nil {
+			ue.regSubTimer.Stop()
+			ue.regSubTimer = nil
+		}
+		ue.regSub = nil
+		ue.subMu.Unlock()
+		ss.DropMe()
+		return
+	}
+	ue.subMu.Unlock()
+}
+
+func (ss *SipSession) processRegNotify(trans *Transaction, sipmsg *SipMessage) {
+	ue := ss.UserEquipment
+
+	evnt, _, _ := strings.Cut(sipmsg.Headers.ValueHeader(Event), ";")
+	if !strings.EqualFold(strings.TrimSpace(evnt), "reg") {
+		ss.SendResponse(trans, status.BadEvent, EmptyBody())
+		return
+	}
+	ss.SendResponse(trans, status.OK, EmptyBody())
+
+	if btype, bytes, ok := sipmsg.GetSingleBody(); ok && btype == ReginfoXML {
+		var ri regInfo
+		if err := xml.Unmarshal(bytes, &ri); err != nil {
+			system.LogError(system.LTRegistration, fmt.Sprintf("UE [%s] - Invalid reginfo body: %v", ue.Imsi, err))
+		} else {
+			ue.applyRegInfo(&ri)
+		}
+	}
+
+	substate, _, _ := strings.Cut(sipmsg.Headers.ValueHeader(Subscription_State), ";")
+	if strings.EqualFold(strings.TrimSpace(substate), "terminated") {
+		ss.SetState(state.Cleared)
+		ss.releaseRegEvent()
+	}
+}
+
+func (ue *UserEquipment) isMyContact(uri string) bool {
+	return strings.Contains(uri, ue.contactSocket()) || strings.Contains(uri, system.GetUDPAddrStringFromConn(ue.UDPListener))
+}
+
+// applyRegInfo reacts to network-initiated deregistration, rejection or shortening of the UE binding
+func (ue *UserEquipment) applyRegInfo(ri *regInfo) {
+	for _, reg := range ri.Registrations {
+		matched := false
+		for _, cntct := range reg.Contacts {
+			if !ue.isMyContact(cntct.URI) {
+				continue
+			}
+			matched = true
+			if cntct.State == "active" {
+				if cntct.Event == "shortened" && cntct.Expires > 0 {
+					system.LogInfo(system.LTRegistration, fmt.Sprintf("UE [%s] - Registration shortened to [%d] seconds", ue.Imsi, cntct.Expires))
+					ue.scheduleRefresh(cntct.Expires)
+					WriteJSONToWebSocket(ue.View())
+				}
+				continue
+			}
+			ue.networkDeregistered(reg.AOR, cntct.Event)
+			return
+		}
+		if !matched && reg.State == "terminated" && len(reg.Contacts) == 0 {
+			ue.networkDeregistered(reg.AOR, "unregistered")
+			return
+		}
+	}
+}
+
+func (ue *UserEquipment) networkDeregistered(aor, evnt string) {
+	system.LogWarning(system.LTRegistration, fmt.Sprintf("UE [%s] - Network deregistered [%s] with event [%s]", ue.Imsi, aor, evnt))
+	ue.stopRegEvent()
+	switch evnt {
+	case "deactivated":
+		// re-registration is expected (TS 24.229 section 5.1.1.7)
+		ue.setRegStatus(state.Unregistered.String())
+		ue.setRegistrationWanted(false)
+		go RegisterMe(ue, "")
+	case "probation":
+		ue.setRegStatus(state.Unregistered.String())
+		ue.retryRegistration()
+	case "rejected":
+		ue.setRegStatus(state.Rejected.String())
+		ue.setRegistrationWanted(false)
+	default: // unregistered, expired
+		ue.setRegStatus(state.Unregistered.String())
+		ue.setRegistrationWanted(false)
+	}
+	WriteJSONToWebSocket(ue.View())
+}
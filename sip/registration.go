@@ -0,0 +1,136 @@
+package sip
+
+import (
+	"fmt"
+	. "sipclientgo/global"
+	"sipclientgo/system"
+	"time"
+)
+
+const (
+	regRetryBase = 30 * time.Second
+	regRetryMax  = 30 * time.Minute
+)
+
+// setRegistrationWanted records whether the UE should keep its binding alive - false cancels any pending refresh
+func (ue *UserEquipment) setRegistrationWanted(wanted bool) {
+	ue.regMu.Lock()
+	defer ue.regMu.Unlock()
+	ue.regWanted = wanted
+	if !wanted {
+		ue.stopRegTimer()
+		ue.NextRefresh = "N/A"
+		ue.BindingExpiry = "N/A"
+	}
+}
+
+// setRegStatus records the registration status shown in the portal and asserted by scenarios
+func (ue *UserEquipment) setRegStatus(sts string) {
+	ue.regMu.Lock()
+	defer ue.regMu.Unlock()
+	ue.RegStatus = sts
+}
+
+// regOutcome records the status a REGISTER ended with - challenges are no outcome as the request is repeated at once
+func (ue *UserEquipment) regOutcome(sts string) {
+	ue.regMu.Lock()
+	defer ue.regMu.Unlock()
+	ue.RegStatus = sts
+	ue.regOutcomes++
+}
+
+// registrationStatus returns the registration status with the number of REGISTER outcomes so far
+func (ue *UserEquipment) registrationStatus() (string, uint64) {
+	ue.regMu.Lock()
+	defer ue.regMu.Unlock()
+	return ue.RegStatus, ue.regOutcomes
+}
+
+// requestedExpires is the expiry asked for in REGISTER - the configured one, raised to the Min-Expires of the registrar if any
+func (ue *UserEquipment) requestedExpires() string {
+	ue.regMu.Lock()
+	defer ue.regMu.Unlock()
+	if expires := system.Str2Int[int](ue.Expires); ue.minExpires > expires {
+		return system.Int2Str(ue.minExpires)
+	}
+	return ue.Expires
+}
+
+// intervalTooBrief records the Min-Expires of a 423 response - false when it would not change the requested expiry
+func (ue *UserEquipment) intervalTooBrief(minexp int) bool {
+	requested := system.Str2Int[int](ue.requestedExpires())
+	ue.regMu.Lock()
+	defer ue.regMu.Unlock()
+	if !ue.regWanted || minexp <= requested {
+		return false
+	}
+	ue.minExpires = minexp
+	return true
+}
+
+// scheduleRefresh re-REGISTERs at half of the granted expiry - the configured expiry is left as it is
+func (ue *UserEquipment) scheduleRefresh(expires int) {
+	if expires <= 0 {
+		ue.stopRefresh()
+		return
+	}
+
+	ue.regMu.Lock()
+	defer ue.regMu.Unlock()
+	if !ue.regWanted {
+		return
+	}
+	ue.regFailures = 0
+
+	now := time.Now().UTC()
+	refreshIn := time.Duration(expires) * time.Second / 2
+	ue.BindingExpiry = now.Add(time.Duration(expires) * time.Second).Format(DicTFs[JsonDateTimeMS])
+	ue.startRegTimer(now, refreshIn)
+}
+
+// retryRegistration backs off exponentially after failed or timed-out registrations
+func (ue *UserEquipment) retryRegistration() {
+	ue.regMu.Lock()
+	defer ue.regMu.Unlock()
+	if !ue.regWanted {
+		return
+	}
+
+	delay := regRetryBase << min(ue.regFailures, 6)
+	delay = min(delay, regRetryMax)
+	ue.regFailures++
+
+	system.LogWarning(system.LTRegistration, fmt.Sprintf("UE [%s] - Registration attempt #%d failed - Retrying in %v", ue.Imsi, ue.regFailures, delay))
+	ue.startRegTimer(time.Now().UTC(), delay)
+}
+
+func (ue *UserEquipment) stopRefresh() {
+	ue.regMu.Lock()
+	defer ue.regMu.Unlock()
+	ue.stopRegTimer()
+	ue.regFailures = 0
+	ue.NextRefresh = "N/A"
+	ue.BindingExpiry = "N/A"
+}
+
+// to be called while holding regMu
+func (ue *UserEquipment) startRegTimer(now time.Time, d time.Duration) {
+	ue.stopRegTimer()
+	ue.NextRefresh = now.Add(d).Format(DicTFs[JsonDateTimeMS])
+	ue.regTimer = time.AfterFunc(d, func() {
+		ue.regMu.Lock()
+		wanted := ue.regWanted
+		ue.regMu.Unlock()
+		if wanted {
+			sendRegister(ue, "", true)
+		}
+	})
+}
+
+// to be called while holding regMu
+func (ue *UserEquipment) stopRegTimer() {
+	if ue.regTimer != nil {
+		ue.regTimer.Stop()
+		ue.regTimer = nil
+	}
+}
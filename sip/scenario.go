@@ -0,0 +1,473 @@
+package sip
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "sipclientgo/global"
+	"sipclientgo/guid"
+	"sipclientgo/sip/state"
+	"sipclientgo/system"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// =================================================================================================
+// Scenario engine - declarative per UE call scripts (YAML or JSON) reporting pass/fail per step
+
+const (
+	ScenarioRunning = "running"
+	ScenarioPassed  = "passed"
+	ScenarioFailed  = "failed"
+
+	scenarioDefaultTimeout = 5000 // ms
+	scenarioRegTimeout     = 10000
+	scenarioPollInterval   = 20 * time.Millisecond
+	scenarioDTMFDuration   = 160
+	scenarioMaxReports     = 100
+)
+
+const (
+	StepRegister   = "register"
+	StepUnregister = "unregister"
+	StepCall       = "call"
+	StepExpect     = "expect"
+	StepPlay       = "play"
+	StepDTMF       = "dtmf"
+	StepHold       = "hold"
+	StepResume     = "resume"
+	StepTransfer   = "transfer"
+	StepWait       = "wait"
+	StepBye        = "bye"
+	StepAssert     = "assert"
+)
+
+type Scenario struct {
+	Name  string         `json:"name" yaml:"name"`
+	UE    string         `json:"ue" yaml:"ue"`
+	Steps []ScenarioStep `json:"steps" yaml:"steps"`
+}
+
+type ScenarioStep struct {
+	Action        string `json:"action" yaml:"action"`
+	Number        string `json:"number,omitempty" yaml:"number"`               // call or transfer target
+	Preconditions bool   `json:"preconditions,omitempty" yaml:"preconditions"` // call - offer QoS preconditions
+	Expect        string `json:"expect,omitempty" yaml:"expect"`               // expect - comma separated codes e.g. "180,183" or "18x"
+	Timeout       int    `json:"timeout,omitempty" yaml:"timeout"`             // ms
+	Audio         string `json:"audio,omitempty" yaml:"audio"`                 // play - audio key
+	Digits        string `json:"digits,omitempty" yaml:"digits"`               // dtmf
+	Method        string `json:"method,omitempty" yaml:"method"`               // dtmf - rfc4733, info (default) or inband
+	Duration      int    `json:"duration,omitempty" yaml:"duration"`           // wait or dtmf digit - ms
+	State         string `json:"state,omitempty" yaml:"state"`                 // assert - call state or UE registration state
+}
+
+type ScenarioReport struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	UE        string       `json:"ue"`
+	Status    string       `json:"status"`
+	StartTime string       `json:"startTime"`
+	EndTime   string       `json:"endTime"`
+	CallID    string       `json:"callID,omitempty"`
+	Steps     []StepResult `json:"steps"`
+}
+
+type StepResult struct {
+	Index    int    `json:"index"`
+	Action   string `json:"action"`
+	Passed   bool   `json:"passed"`
+	Details  string `json:"details"`
+	Duration int64  `json:"durationMs"`
+}
+
+type scenarioRun struct {
+	mu     sync.Mutex
+	report ScenarioReport
+	ue     *UserEquipment
+	call   *SipSession
+}
+
+var scenarioRuns = struct {
+	mu    sync.RWMutex
+	runs  map[string]*scenarioRun
+	order []string
+}{runs: make(map[string]*scenarioRun)}
+
+// ParseScenario decodes a JSON or YAML scenario and validates its steps
+func ParseScenario(data []byte) (*Scenario, error) {
+	var sc Scenario
+	var err error
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		err = json.Unmarshal(trimmed, &sc)
+	} else {
+		err = yaml.Unmarshal(data, &sc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid scenario: %w", err)
+	}
+	if sc.UE == "" {
+		return nil, errors.New("scenario without UE")
+	}
+	if len(sc.Steps) == 0 {
+		return nil, errors.New("scenario without steps")
+	}
+	for i := range sc.Steps {
+		stp := &sc.Steps[i]
+		stp.Action = system.ASCIIToLower(strings.TrimSpace(stp.Action))
+		var missing string
+		switch stp.Action {
+		case StepRegister, StepUnregister, StepHold, StepResume, StepBye:
+		case StepCall, StepTransfer:
+			if stp.Number == "" {
+				missing = "number"
+			}
+		case StepExpect:
+			if stp.Expect == "" {
+				missing = "expect"
+			}
+		case StepPlay:
+			if stp.Audio == "" {
+				missing = "audio"
+			}
+		case StepDTMF:
+			if stp.Digits == "" {
+				missing = "digits"
+			}
+		case StepWait:
+			if stp.Duration <= 0 {
+				missing = "duration"
+			}
+		case StepAssert:
+			if stp.State == "" {
+				missing = "state"
+			}
+		default:
+			return nil, fmt.Errorf("step #%d - unknown action [%s]", i+1, stp.Action)
+		}
+		if missing != "" {
+			return nil, fmt.Errorf("step #%d [%s] - missing %s", i+1, stp.Action, missing)
+		}
+	}
+	return &sc, nil
+}
+
+// RunScenario starts the scenario in background and returns its report ID
+func RunScenario(sc *Scenario) (string, error) {
+	ue := UEs.GetUE(sc.UE)
+	if ue == nil {
+		return "", fmt.Errorf("UE [%s] not found", sc.UE)
+	}
+
+	run := &scenarioRun{ue: ue}
+	run.report = ScenarioReport{
+		ID:        guid.NewTag(),
+		Name:      sc.Name,
+		UE:        sc.UE,
+		Status:    ScenarioRunning,
+		StartTime: time.Now().UTC().Format(DicTFs[JsonDateTimeMS]),
+		EndTime:   "N/A",
+	}
+
+	scenarioRuns.mu.Lock()
+	scenarioRuns.runs[run.report.ID] = run
+	scenarioRuns.order = append(scenarioRuns.order, run.report.ID)
+	if len(scenarioRuns.order) > scenarioMaxReports {
+		delete(scenarioRuns.runs, scenarioRuns.order[0])
+		scenarioRuns.order = scenarioRuns.order[1:]
+	}
+	scenarioRuns.mu.Unlock()
+
+	go run.execute(sc)
+	return run.report.ID, nil
+}
+
+func GetScenarioReport(id string) (ScenarioReport, bool) {
+	scenarioRuns.mu.RLock()
+	run, ok := scenarioRuns.runs[id]
+	scenarioRuns.mu.RUnlock()
+	if !ok {
+		return ScenarioReport{}, false
+	}
+	return run.snapshot(), true
+}
+
+func GetScenarioReports() []ScenarioReport {
+	scenarioRuns.mu.RLock()
+	defer scenarioRuns.mu.RUnlock()
+	reports := make([]ScenarioReport, 0, len(scenarioRuns.order))
+	for _, id := range scenarioRuns.order {
+		reports = append(reports, scenarioRuns.runs[id].snapshot())
+	}
+	return reports
+}
+
+func (run *scenarioRun) snapshot() ScenarioReport {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	rpt := run.report
+	rpt.Steps = append([]StepResult(nil), run.report.Steps...)
+	return rpt
+}
+
+func (run *scenarioRun) execute(sc *Scenario) {
+	defer func() {
+		if r := recover(); r != nil {
+			system.LogCallStack(r)
+			run.finish(ScenarioFailed)
+		}
+	}()
+
+	system.LogInfo(system.LTStressTester, fmt.Sprintf("Scenario [%s] started on UE [%s]", sc.Name, sc.UE))
+	for i, stp := range sc.Steps {
+		start := time.Now()
+		details, err := run.runStep(stp)
+		rslt := StepResult{Index: i + 1, Action: stp.Action, Passed: err == nil, Details: details, Duration: time.Since(start).Milliseconds()}
+		if err != nil {
+			rslt.Details = err.Error()
+		}
+		run.mu.Lock()
+		run.report.Steps = append(run.report.Steps, rslt)
+		run.mu.Unlock()
+		if err != nil {
+			system.LogWarning(system.LTStressTester, fmt.Sprintf("Scenario [%s] failed at step #%d [%s]: %v", sc.Name, i+1, stp.Action, err))
+			run.cleanup()
+			run.finish(ScenarioFailed)
+			return
+		}
+	}
+	system.LogInfo(system.LTStressTester, fmt.Sprintf("Scenario [%s] passed", sc.Name))
+	run.finish(ScenarioPassed)
+}
+
+func (run *scenarioRun) finish(sts string) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.report.Status = sts
+	run.report.EndTime = time.Now().UTC().Format(DicTFs[JsonDateTimeMS])
+}
+
+// cleanup releases the call left behind by a failed scenario
+func (run *scenarioRun) cleanup() {
+	if run.call != nil && (run.call.IsBeingEstablished() || run.call.IsEstablished()) {
+		CallAction(run.ue, run.call.CallID, RejectRelease)
+	}
+}
+
+func (run *scenarioRun) runStep(stp ScenarioStep) (string, error) {
+	ue := run.ue
+	timeout := time.Duration(cmp.Or(stp.Timeout, scenarioDefaultTimeout)) * time.Millisecond
+
+	switch stp.Action {
+	case StepRegister, StepUnregister:
+		unreg := stp.Action == StepUnregister
+		_, outcomes := ue.registrationStatus()
+		if err := UEs.DoRegister(ue.Imsi, unreg); err != nil {
+			return "", err
+		}
+		want := state.Registered.String()
+		if unreg {
+			want = state.Unregistered.String()
+		}
+		// the outcome of this REGISTER - a UE already in the wanted state must not pass before the response
+		timeout = time.Duration(cmp.Or(stp.Timeout, scenarioRegTimeout)) * time.Millisecond
+		answered := waitFor(timeout, func() bool {
+			_, n := ue.registrationStatus()
+			return n != outcomes
+		})
+		sts, _ := ue.registrationStatus()
+		if !answered {
+			return "", fmt.Errorf("no registration outcome - status [%s] instead of [%s]", sts, want)
+		}
+		if sts != want {
+			return "", fmt.Errorf("registration status [%s] instead of [%s]", sts, want)
+		}
+		return "UE " + want, nil
+
+	case StepCall:
+		callID, err := UEs.DoCall(ue.Imsi, stp.Number, stp.Preconditions)
+		if err != nil {
+			return "", err
+		}
+		ses, ok := ue.SesMap.Load(callID)
+		if !ok {
+			return "", errors.New("call session not found")
+		}
+		run.call = ses
+		run.mu.Lock()
+		run.report.CallID = callID
+		run.mu.Unlock()
+		return fmt.Sprintf("Calling [%s] - Call-ID [%s]", stp.Number, callID), nil
+
+	case StepWait:
+		time.Sleep(time.Duration(stp.Duration) * time.Millisecond)
+		return fmt.Sprintf("Waited %d ms", stp.Duration), nil
+	}
+
+	// remaining steps act on the call
+	ss := run.call
+	if ss == nil {
+		if stp.Action == StepAssert {
+			sts, _ := ue.registrationStatus()
+			if !strings.EqualFold(sts, stp.State) {
+				return "", fmt.Errorf("UE state [%s] instead of [%s]", sts, stp.State)
+			}
+			return "UE " + sts, nil
+		}
+		return "", errors.New("no call placed")
+	}
+
+	switch stp.Action {
+	case StepExpect:
+		var sc int
+		ok := waitFor(timeout, func() bool {
+			trans := ss.outboundTransaction(INVITE)
+			if trans == nil {
+				return false
+			}
+			trans.Lock.RLock()
+			defer trans.Lock.RUnlock()
+			for _, r := range trans.Responses {
+				if matchStatusCode(stp.Expect, r) {
+					sc = r
+					return true
+				}
+				if r >= 300 { // final failure response - no point in waiting
+					sc = -r
+					return true
+				}
+			}
+			return false
+		})
+		switch {
+		case !ok:
+			return "", fmt.Errorf("no [%s] response received within %v", stp.Expect, timeout)
+		case sc < 0:
+			return "", fmt.Errorf("received [%d %s] instead of [%s]", -sc, DicResponse[-sc], stp.Expect)
+		}
+		return fmt.Sprintf("Received [%d %s]", sc, DicResponse[sc]), nil
+
+	case StepPlay:
+		if err := ss.playAudio(stp.Audio, false, false); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Playing [%s]", stp.Audio), nil
+
+	case StepDTMF:
+		method := cmp.Or(stp.Method, DTMFMethodINFO)
+		if err := ss.sendDigits(stp.Digits, method, cmp.Or(stp.Duration, scenarioDTMFDuration), true); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Sent DTMF [%s] via %s", stp.Digits, method), nil
+
+	case StepHold, StepResume:
+		if !ss.IsEstablished() {
+			return "", errors.New("call not established")
+		}
+		before := ss.outboundTransaction(ReINVITE)
+		action := HoldCall
+		if stp.Action == StepResume {
+			action = ResumeAnswer
+		}
+		if err := UEs.DoCallAction(ue.Imsi, ss.CallID, action); err != nil {
+			return "", err
+		}
+		var final int
+		ok := waitFor(timeout, func() bool {
+			trans := ss.outboundTransaction(ReINVITE)
+			if trans == nil || trans == before {
+				return false
+			}
+			trans.Lock.RLock()
+			defer trans.Lock.RUnlock()
+			if trans.IsFinalized && len(trans.Responses) > 0 {
+				final = trans.Responses[len(trans.Responses)-1]
+				return true
+			}
+			return false
+		})
+		if !ok {
+			return "", fmt.Errorf("no final response to %s re-INVITE within %v", stp.Action, timeout)
+		}
+		if final >= 300 {
+			return "", fmt.Errorf("%s re-INVITE rejected with [%d %s]", stp.Action, final, DicResponse[final])
+		}
+		return fmt.Sprintf("Call %s - Local media [%s]", stp.Action, ss.LocalMedDir), nil
+
+	case StepTransfer:
+		if err := TransferCall(TransferRequest{CallID: ss.CallID, Target: stp.Number}); err != nil {
+			return "", err
+		}
+		if !waitFor(timeout, func() bool { return ss.GetState() == state.Referred }) {
+			return "", fmt.Errorf("call still [%s] after %v", ss.GetState(), timeout)
+		}
+		return fmt.Sprintf("Call transferred to [%s]", stp.Number), nil
+
+	case StepBye:
+		if err := UEs.DoCallAction(ue.Imsi, ss.CallID, RejectRelease); err != nil {
+			return "", err
+		}
+		if !waitFor(timeout, func() bool { return ss.GetState().IsFinalized() && !ss.IsEstablished() }) {
+			return "", fmt.Errorf("call still [%s] after %v", ss.GetState(), timeout)
+		}
+		return "Call " + ss.GetState().String(), nil
+
+	case StepAssert:
+		if sts := ss.GetState().String(); !strings.EqualFold(sts, stp.State) {
+			return "", fmt.Errorf("call state [%s] instead of [%s]", sts, stp.State)
+		}
+		return "Call " + stp.State, nil
+	}
+	return "", fmt.Errorf("unknown action [%s]", stp.Action)
+}
+
+// outboundTransaction returns the latest outbound transaction of the method
+func (session *SipSession) outboundTransaction(m Method) *Transaction {
+	session.TransLock.RLock()
+	defer session.TransLock.RUnlock()
+	for i := len(session.Transactions) - 1; i >= 0; i-- {
+		if trans := session.Transactions[i]; trans.Method == m && trans.Direction == OUTBOUND {
+			return trans
+		}
+	}
+	return nil
+}
+
+// matchStatusCode checks a code against comma separated patterns where x is a wildcard digit e.g. "18x,200"
+func matchStatusCode(patterns string, sc int) bool {
+	code := system.Int2Str(sc)
+	for _, ptrn := range strings.Split(patterns, ",") {
+		ptrn = system.ASCIIToLower(strings.TrimSpace(ptrn))
+		if len(ptrn) != len(code) {
+			continue
+		}
+		matched := true
+		for i := range ptrn {
+			if ptrn[i] != 'x' && ptrn[i] != code[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if cond() {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(scenarioPollInterval)
+	}
+}
@@ -0,0 +1,106 @@
+package sip
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseScenario(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		steps   []string // actions once normalised
+		wantErr string
+	}{
+		{
+			name:  "yaml",
+			data:  "name: s\nue: \"001\"\nsteps:\n  - action: Register\n  - action: ' CALL '\n    number: \"1234\"\n    preconditions: true\n",
+			steps: []string{StepRegister, StepCall},
+		},
+		{
+			name:  "json",
+			data:  ` {"ue": "001", "steps": [{"action": "wait", "duration": 100}, {"action": "bye"}]}`,
+			steps: []string{StepWait, StepBye},
+		},
+		{name: "empty", data: "", wantErr: "without UE"},
+		{name: "malformed yaml", data: "ue: \"001\"\nsteps:\n  - action: call\n   number: 1", wantErr: "invalid scenario"},
+		{name: "malformed json", data: `{"ue": "001", "steps": [}`, wantErr: "invalid scenario"},
+		{name: "steps not a list", data: "ue: \"001\"\nsteps: call\n", wantErr: "invalid scenario"},
+		{name: "wrong field type", data: "ue: \"001\"\nsteps:\n  - action: wait\n    duration: long\n", wantErr: "invalid scenario"},
+		{name: "no UE", data: "steps:\n  - action: bye\n", wantErr: "without UE"},
+		{name: "no steps", data: "ue: \"001\"\n", wantErr: "without steps"},
+		{name: "unknown action", data: "ue: \"001\"\nsteps:\n  - action: bye\n  - action: fly\n", wantErr: "step #2 - unknown action [fly]"},
+		{name: "call without number", data: "ue: \"001\"\nsteps:\n  - action: call\n", wantErr: "missing number"},
+		{name: "transfer without number", data: "ue: \"001\"\nsteps:\n  - action: transfer\n", wantErr: "missing number"},
+		{name: "expect without codes", data: "ue: \"001\"\nsteps:\n  - action: expect\n", wantErr: "missing expect"},
+		{name: "play without audio", data: "ue: \"001\"\nsteps:\n  - action: play\n", wantErr: "missing audio"},
+		{name: "dtmf without digits", data: "ue: \"001\"\nsteps:\n  - action: dtmf\n", wantErr: "missing digits"},
+		{name: "wait without duration", data: "ue: \"001\"\nsteps:\n  - action: wait\n    duration: -5\n", wantErr: "missing duration"},
+		{name: "assert without state", data: "ue: \"001\"\nsteps:\n  - action: assert\n", wantErr: "missing state"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := ParseScenario([]byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseScenario: %v", err)
+			}
+			if len(sc.Steps) != len(tt.steps) {
+				t.Fatalf("steps = %d, want %d", len(sc.Steps), len(tt.steps))
+			}
+			for i, stp := range sc.Steps {
+				if stp.Action != tt.steps[i] {
+					t.Errorf("step #%d action = %q, want %q", i+1, stp.Action, tt.steps[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseScenarioFiles(t *testing.T) {
+	files, _ := filepath.Glob(filepath.Join("..", "scenarios", "*.yaml"))
+	for _, fn := range files {
+		data, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ParseScenario(data); err != nil {
+			t.Errorf("%s: %v", filepath.Base(fn), err)
+		}
+	}
+}
+
+func TestMatchStatusCode(t *testing.T) {
+	tests := []struct {
+		patterns string
+		sc       int
+		want     bool
+	}{
+		{"200", 200, true},
+		{"200", 201, false},
+		{"18x", 180, true},
+		{"18X", 183, true},
+		{"18x", 190, false},
+		{"1xx", 100, true},
+		{"xxx", 486, true},
+		{"180, 183", 183, true},
+		{" 486 ,4x4", 404, true},
+		{"180,183", 200, false},
+		{"2x", 200, false},
+		{"2000", 200, false},
+		{"", 200, false},
+		{",,", 200, false},
+	}
+	for _, tt := range tests {
+		if got := matchStatusCode(tt.patterns, tt.sc); got != tt.want {
+			t.Errorf("matchStatusCode(%q, %d) = %v, want %v", tt.patterns, tt.sc, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package sip
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+	. "sipclientgo/global"
+	"sipclientgo/system"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// security agreement modes (RFC 3329 / TS 33.203) per UE
+const (
+	SecAgreeNone      = "none"      // no sec-agree headers
+	SecAgreeHeaders   = "headers"   // negotiate headers only - keep sending over the unprotected port
+	SecAgreeProtected = "protected" // send follow-up requests over the protected ports in clear
+	SecAgreeESP       = "esp"       // as protected - with userspace null/HMAC-SHA-1-96 ESP encapsulation
+)
+
+const (
+	secMechanism       = "ipsec-3gpp"
+	secIntegrityAlg    = "hmac-sha-1-96"
+	secEncryptionAlg   = "null"
+	protectedPortRange = 100
+
+	espHeaderLen = 8
+	espICVLen    = 12
+	udpHeaderLen = 8
+	ipProtoUDP   = 17
+)
+
+type secParams struct {
+	q     string
+	alg   string
+	ealg  string
+	spiC  uint32
+	spiS  uint32
+	portC int
+	portS int
+}
+
+func (sp *secParams) String() string {
+	var sb strings.Builder
+	sb.WriteString(secMechanism)
+	if sp.q != "" {
+		sb.WriteString(";q=" + sp.q)
+	}
+	sb.WriteString(";alg=" + sp.alg)
+	if sp.ealg != "" {
+		sb.WriteString(";ealg=" + sp.ealg)
+	}
+	sb.WriteString(fmt.Sprintf(";spi-c=%d;spi-s=%d;port-c=%d;port-s=%d", sp.spiC, sp.spiS, sp.portC, sp.portS))
+	return sb.String()
+}
+
+// parseSecurityServer picks the ipsec-3gpp mechanism with the highest preference
+func parseSecurityServer(values []string) *secParams {
+	var best *secParams
+	var bestq float64
+	for _, value := range values {
+		for mech := range strings.SplitSeq(value, ",") {
+			parts := strings.Split(mech, ";")
+			if !strings.EqualFold(strings.TrimSpace(parts[0]), secMechanism) {
+				continue
+			}
+			sp := &secParams{}
+			for _, prm := range parts[1:] {
+				k, v, _ := strings.Cut(strings.TrimSpace(prm), "=")
+				switch strings.ToLower(k) {
+				case "q":
+					sp.q = v
+				case "alg":
+					sp.alg = v
+				case "ealg":
+					sp.ealg = v
+				case "spi-c":
+					sp.spiC = system.Str2Uint[uint32](v)
+				case "spi-s":
+					sp.spiS = system.Str2Uint[uint32](v)
+				case "port-c":
+					sp.portC = system.Str2Int[int](v)
+				case "port-s":
+					sp.portS = system.Str2Int[int](v)
+				}
+			}
+			if sp.portS == 0 || sp.spiS == 0 {
+				continue
+			}
+			q := 1.0
+			if sp.q != "" {
+				if f, err := strconv.ParseFloat(sp.q, 64); err == nil {
+					q = f
+				}
+			}
+			if best == nil || q > bestq {
+				best, bestq = sp, q
+			}
+		}
+	}
+	return best
+}
+
+type secAgreement struct {
+	mu     sync.Mutex
+	local  secParams
+	server *secParams
+	connC  *net.UDPConn // protected client port
+	connS  *net.UDPConn // protected server port
+	espKey []byte
+	seqC   uint32
+	seqS   uint32
+}
+
+func randomSPI() uint32 {
+	var b [4]byte
+	for {
+		_, _ = rand.Read(b[:])
+		// SPI values 1-255 are reserved by IANA
+		if spi := binary.BigEndian.Uint32(b[:]); spi > 255 {
+			return spi
+		}
+	}
+}
+
+func (ue *UserEquipment) secAgreeMode() string {
+	if ue.SecAgree == "" {
+		return SecAgreeNone
+	}
+	return ue.SecAgree
+}
+
+func (ue *UserEquipment) usesProtectedPorts() bool {
+	md := ue.secAgreeMode()
+	return md == SecAgreeProtected || md == SecAgreeESP
+}
+
+// startSecAgreement allocates the protected port pair next to the UE UDP port
+func (ue *UserEquipment) startSecAgreement() error {
+	switch ue.secAgreeMode() {
+	case SecAgreeNone:
+		return nil
+	case SecAgreeHeaders, SecAgreeProtected, SecAgreeESP:
+	default:
+		return fmt.Errorf("invalid security agreement mode: %s", ue.SecAgree)
+	}
+
+	var conns []*net.UDPConn
+	for prt := ue.UdpPort + 1; prt <= ue.UdpPort+protectedPortRange && len(conns) < 2; prt++ {
+		conn, err := system.StartListening(ue.localIP(), prt)
+		if err != nil {
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	if len(conns) < 2 {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return fmt.Errorf("no free protected ports next to UDP port %d", ue.UdpPort)
+	}
+
+	sa := &secAgreement{connC: conns[0], connS: conns[1]}
+	sa.local = secParams{
+		alg:   secIntegrityAlg,
+		ealg:  secEncryptionAlg,
+		portC: conns[0].LocalAddr().(*net.UDPAddr).Port,
+		portS: conns[1].LocalAddr().(*net.UDPAddr).Port,
+	}
+	sa.reset()
+	ue.secAgree = sa
+
+	udpLoopWorkers(ue, sa.connC, ue.DataChan)
+	udpLoopWorkers(ue, sa.connS, ue.DataChan)
+	system.LogInfo(system.LTRegistration, fmt.Sprintf("UE [%s] - Protected ports allocated - port-c [%d] port-s [%d]", ue.Imsi, sa.local.portC, sa.local.portS))
+	return nil
+}
+
+func (ue *UserEquipment) stopSecAgreement() {
+	sa := ue.secAgree
+	if sa == nil {
+		return
+	}
+	sa.connC.Close()
+	sa.connS.Close()
+}
+
+// reset drops the negotiated security associations and picks new SPIs - for a new initial registration
+func (sa *secAgreement) reset() {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	sa.local.spiC = randomSPI()
+	sa.local.spiS = randomSPI()
+	sa.server = nil
+	sa.espKey = nil
+	sa.seqC = 0
+	sa.seqS = 0
+}
+
+func (sa *secAgreement) usesPort(prt int) bool {
+	return sa.local.portC == prt || sa.local.portS == prt
+}
+
+func (sa *secAgreement) isProtected(conn *net.UDPConn) bool {
+	return conn == sa.connC || conn == sa.connS
+}
+
+func (sa *secAgreement) established() bool {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	return sa.server != nil
+}
+
+// setServer stores the Security-Server offered by the P-CSCF in the 401 response
+func (sa *secAgreement) setServer(values []string) bool {
+	sp := parseSecurityServer(values)
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	sa.server = sp
+	sa.seqC = 0
+	sa.seqS = 0
+	return sp != nil
+}
+
+// setKeys derives the ESP integrity key - IK extended with 32 zero bits (TS 33.203 section 6.3)
+func (sa *secAgreement) setKeys(ik []byte) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	if len(ik) == 0 {
+		sa.espKey = nil
+		return
+	}
+	sa.espKey = append(append([]byte{}, ik...), 0, 0, 0, 0)
+}
+
+func (ue *UserEquipment) updateSecurityServer(sipmsg *SipMessage) {
+	sa := ue.secAgree
+	if sa == nil {
+		return
+	}
+	if !sa.setServer(sipmsg.Headers.HeaderValues(Security_Server)) {
+		system.LogWarning(system.LTRegistration, fmt.Sprintf("UE [%s] - No usable Security-Server received", ue.Imsi))
+	}
+}
+
+// addSecAgreeHeaders adds Security-Client (REGISTER only) and Security-Verify once the P-CSCF offered its parameters
+func (ue *UserEquipment) addSecAgreeHeaders(hdrs *SipHeaders, register bool) {
+	sa := ue.secAgree
+	if sa == nil {
+		return
+	}
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	if register {
+		hdrs.AddHeader(Security_Client, sa.local.String())
+	} else if sa.server == nil {
+		return
+	}
+	if sa.server != nil {
+		hdrs.AddHeader(Security_Verify, sa.server.String())
+	}
+	hdrs.AddHeader(Require, "sec-agree")
+	hdrs.AddHeader(Proxy_Require, "sec-agree")
+}
+
+// signallingPath returns the UE socket, the P-CSCF address and the transport to send new requests through
+// protected ports are emulated over UDP only
+func (ue *UserEquipment) signallingPath() (*net.UDPConn, *net.UDPAddr, Transport) {
+	tp := ue.transport()
+	sa := ue.secAgree
+	if sa == nil || !ue.usesProtectedPorts() || tp != TransportUDP {
+		return ue.UDPListener, PCSCFSocket, tp
+	}
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	if sa.server == nil {
+		return ue.UDPListener, PCSCFSocket, tp
+	}
+	return sa.connC, &net.UDPAddr{IP: PCSCFSocket.IP, Port: sa.server.portS}, tp
+}
+
+// contactSocket returns the UE socket to be advertised in Contact - the protected server port once negotiated
+func (ue *UserEquipment) contactSocket() string {
+	if ue.transport().IsWebSocket() {
+		return ue.wsHost
+	}
+	sa := ue.secAgree
+	if sa == nil || !ue.usesProtectedPorts() || !sa.established() {
+		return system.GetUDPAddrStringFromConn(ue.UDPListener)
+	}
+	return system.GetUDPAddrStringFromConn(sa.connS)
+}
+
+// =================================================================================================
+// Userspace ESP - RFC 4303 transport mode with null encryption and HMAC-SHA-1-96, carried over UDP
+
+func (sa *secAgreement) icv(data []byte) []byte {
+	mac := hmac.New(sha1.New, sa.espKey)
+	mac.Write(data)
+	return mac.Sum(nil)[:espICVLen]
+}
+
+// encapsulate wraps the SIP payload into ESP when sent from a protected port - otherwise returns it as is
+func (ue *UserEquipment) encapsulate(conn *net.UDPConn, rmt *net.UDPAddr, payload []byte) []byte {
+	sa := ue.secAgree
+	if sa == nil || ue.secAgreeMode() != SecAgreeESP || !sa.isProtected(conn) {
+		return payload
+	}
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	if sa.server == nil || sa.espKey == nil {
+		return payload
+	}
+
+	var spi, seq uint32
+	if conn == sa.connC {
+		sa.seqC++
+		spi, seq = sa.server.spiS, sa.seqC
+	} else {
+		sa.seqS++
+		spi, seq = sa.server.spiC, sa.seqS
+	}
+
+	inner := udpHeaderLen + len(payload)
+	padlen := (4 - (inner+2)%4) % 4
+	pkt := make([]byte, espHeaderLen, espHeaderLen+inner+padlen+2+espICVLen)
+	binary.BigEndian.PutUint32(pkt[0:], spi)
+	binary.BigEndian.PutUint32(pkt[4:], seq)
+
+	// inner UDP header - checksum left zero
+	pkt = binary.BigEndian.AppendUint16(pkt, uint16(conn.LocalAddr().(*net.UDPAddr).Port))
+	pkt = binary.BigEndian.AppendUint16(pkt, uint16(rmt.Port))
+	pkt = binary.BigEndian.AppendUint16(pkt, uint16(inner))
+	pkt = append(pkt, 0, 0)
+	pkt = append(pkt, payload...)
+
+	for i := 1; i <= padlen; i++ {
+		pkt = append(pkt, byte(i))
+	}
+	pkt = append(pkt, byte(padlen), ipProtoUDP)
+	return append(pkt, sa.icv(pkt)...)
+}
+
+// decapsulate verifies and strips ESP in place - returns the SIP payload length
+func (ue *UserEquipment) decapsulate(conn *net.UDPConn, buf []byte) (int, error) {
+	sa := ue.secAgree
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	if len(buf) < espHeaderLen+udpHeaderLen+2+espICVLen {
+		return 0, fmt.Errorf("ESP packet too short")
+	}
+	if sa.espKey == nil {
+		return 0, fmt.Errorf("no security association keys")
+	}
+
+	spi := binary.BigEndian.Uint32(buf)
+	expected := sa.local.spiS
+	if conn == sa.connC {
+		expected = sa.local.spiC
+	}
+	if spi != expected {
+		return 0, fmt.Errorf("unknown SPI %d", spi)
+	}
+
+	authed := buf[:len(buf)-espICVLen]
+	if !hmac.Equal(sa.icv(authed), buf[len(authed):]) {
+		return 0, fmt.Errorf("ICV verification failed for SPI %d", spi)
+	}
+
+	padlen := int(authed[len(authed)-2])
+	if authed[len(authed)-1] != ipProtoUDP {
+		return 0, fmt.Errorf("unsupported ESP next header %d", authed[len(authed)-1])
+	}
+	end := len(authed) - 2 - padlen
+	start := espHeaderLen + udpHeaderLen
+	if end < start {
+		return 0, fmt.Errorf("bad ESP padding")
+	}
+	return copy(buf, buf[start:end]), nil
+}
@@ -12,8 +12,11 @@ import (
 
 	"sipclientgo/sip/mode"
 	"sipclientgo/sip/state"
+	"sipclientgo/sip/status"
 	. "sipclientgo/system"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Moatassem/sdp"
@@ -38,24 +41,36 @@ type SipSession struct {
 
 	RecordRoutes []string
 
-	MRFRepo *MRFRepo
+	MRFRepo   *MRFRepo
+	answerPlc *AnswerPolicy
+	qos       *qosPrecondition // nil unless QoS preconditions are in use
 
 	Mode mode.SessionMode
 
 	StartTime  time.Time
 	EndTime    time.Time
+	SetupTime  time.Time
+	AnswerTime time.Time
 	AnswerChan chan any
 
+	q850Cause int
+
 	dcmutex          sync.RWMutex
 	dialogueChanging bool
 
 	IsPRACKSupported   bool
 	IsDelayedOfferCall bool
 
-	ReferSubscription bool
-	Relayed18xNotify  []int
+	ReferSubscription bool                       // NOTIFYs are sent for the REFER being served
+	Relayed18xNotify  []int                      // provisional codes already reported to the referrer
+	referCSeq         uint32                     // CSeq of the REFER being served - id of its refer event
+	referPending      atomic.Bool                // transfer in progress, requested or served
+	referrer          atomic.Pointer[SipSession] // call whose REFER placed this one - progress is reported to it
+	replaced          *SipSession                // established call replaced by this one once answered (RFC 3891)
+	ussd              *ussdDialog                // USSI session - set before the INVITE is sent
 
 	SIPUDPListenser *net.UDPConn
+	SIPTransport    Transport
 	RemoteUserAgent *SipUdpUserAgent
 	UserEquipment   *UserEquipment
 
@@ -76,17 +91,26 @@ type SipSession struct {
 	rtpSSRC        uint32
 	rtpIndex       int
 	rtpPayloadType uint8
+	rtpEventType   uint8 // negotiated telephone-event payload type
 	rtpmutex       sync.Mutex
 	isrtpstreaming bool
-	bargeEnabled   bool
+	rtpAudioKey    string
+	rtpAudioLen    int
+	rtpLoop        bool
+	rtpHangUp      bool
+	rtpPosition    atomic.Int64
+	bargeEnabled   atomic.Bool
+	mediaReceiving atomic.Bool
+	dtmfSending    atomic.Bool
 	lastDTMF       string
 
 	// speechBytes   []byte
 	// collectSpeech bool
 
-	FwdCSeq uint32
-	BwdCSeq uint32
-	RSeq    uint32
+	FwdCSeq    uint32
+	BwdCSeq    uint32
+	RSeq       uint32
+	remoteRSeq uint32 // last reliable provisional PRACKed on outbound sessions
 
 	SDPSessionID      int64
 	SDPSessionVersion int64
@@ -102,13 +126,19 @@ type SipSession struct {
 
 	Transactions []*Transaction
 	TransLock    sync.RWMutex
+
+	trace     []TraceEntry
+	traceLock sync.Mutex
+
+	recorder atomic.Pointer[callRecorder]
 }
 
 func NewSS(dir Direction) *SipSession {
 	ss := &SipSession{
 		Direction:        dir,
+		SetupTime:        time.Now().UTC(),
 		maxDprobDoneChan: make(chan any),
-		AnswerChan:       make(chan any),
+		AnswerChan:       make(chan any, 1), // keeps a portal answer given before awaitAnswer waits for it
 		rtpChan:          make(chan any),
 	}
 	return ss
@@ -382,8 +412,6 @@ func (session *SipSession) PrepareRequestHeaders(trans *Transaction, rqstpk Requ
 	hdrs := NewSHsPointer(true)
 	sipmsg.Headers = hdrs
 
-	localsocket := GetUDPAddrFromConn(session.SIPUDPListenser)
-
 	sl := sipmsg.StartLine
 	if trans.UseRemoteURI {
 		sl.RUri = session.RemoteURI
@@ -433,9 +461,9 @@ func (session *SipSession) PrepareRequestHeaders(trans *Transaction, rqstpk Requ
 	}
 
 	// Add Contact, Call-ID, and Via headers
-	hdrs.SetHeader(Contact, GenerateContact(localsocket))
+	hdrs.SetHeader(Contact, session.localContact())
 	hdrs.SetHeader(Call_ID, session.CallID)
-	hdrs.AddHeader(Via, fmt.Sprintf("%s;branch=%s", GenerateViaWithoutBranch(session.SIPUDPListenser), trans.ViaBranch))
+	hdrs.AddHeader(Via, fmt.Sprintf("%s;branch=%s", session.viaWithoutBranch(), trans.ViaBranch))
 }
 
 func (session *SipSession) ProcessRequestHeaders(trans *Transaction, sipmsg *SipMessage, rqstpk RequestPack, msgBody MessageBody) {
@@ -527,6 +555,12 @@ func (session *SipSession) CreateSARequest(rqstpk RequestPack, body MessageBody)
 	case INVITE:
 		session.Mode = mode.Multimedia
 		session.FwdCSeq = uint32(RandomNum(1, 500))
+	case SUBSCRIBE:
+		session.Mode = mode.Subscription
+		session.FwdCSeq = uint32(RandomNum(1, 500))
+	case MESSAGE:
+		session.Mode = mode.Messaging
+		session.FwdCSeq = uint32(RandomNum(1, 500))
 	default: // Any other
 	}
 	st := NewSIPTransaction_CRL(session.FwdCSeq, rqstpk.Method, nil)
@@ -547,8 +581,8 @@ func (session *SipSession) PrepareSARequestHeaders(st *Transaction, rqstpk Reque
 
 func (session *SipSession) BuildSARequestHeaders(st *Transaction, rqstpk RequestPack, sipmsg *SipMessage) {
 	localsocket := GetUDPAddrFromConn(session.SIPUDPListenser)
-	localIP := localsocket.IP.String()
-	remoteIP := session.RemoteUDP.IP.String()
+	localIP := URIHost(localsocket.IP)
+	remoteIP := URIHost(session.RemoteUDP.IP)
 
 	// Set Start line
 	sl := sipmsg.StartLine
@@ -559,8 +593,15 @@ func (session *SipSession) BuildSARequestHeaders(st *Transaction, rqstpk Request
 		sl.HostPart = ImsDomain
 		localIP = sl.HostPart
 		remoteIP = sl.HostPart
-	case INVITE:
+	case SUBSCRIBE:
+		sl.HostPart = ImsDomain
+		localIP = sl.HostPart
+		remoteIP = sl.HostPart
+	case INVITE, MESSAGE:
 		sl.UriParameters = &map[string]string{"user": "phone"}
+		if strings.ContainsAny(rqstpk.RUriUP, "*#%") { // RFC 4967 dial string - service codes
+			sl.UriParameters = &map[string]string{"user": "dialstring"}
+		}
 		sl.HostPart = ImsDomain
 		localIP = sl.HostPart
 		remoteIP = sl.HostPart
@@ -578,7 +619,7 @@ func (session *SipSession) BuildSARequestHeaders(st *Transaction, rqstpk Request
 	hdrs.AddHeader(Call_ID, session.CallID)
 
 	// Set Via and Branch
-	hdrs.AddHeader(Via, fmt.Sprintf("%s;branch=%s", GenerateViaWithoutBranch(session.SIPUDPListenser), st.ViaBranch))
+	hdrs.AddHeader(Via, fmt.Sprintf("%s;branch=%s", session.viaWithoutBranch(), st.ViaBranch))
 
 	// Set From Header with tag
 	session.FromTag = guid.NewTag()
@@ -611,7 +652,7 @@ func (session *SipSession) BuildSARequestHeaders(st *Transaction, rqstpk Request
 
 	// Set Contact
 	if !hdrs.HeaderExists("Contact") {
-		hdrs.SetHeader(Contact, GenerateContact(localsocket))
+		hdrs.SetHeader(Contact, session.localContact())
 	}
 
 	// Set Date
@@ -648,8 +689,7 @@ func (session *SipSession) CreateHeadersForResponse(trans *Transaction, rspnspk
 
 	// Add Contact header
 	if rspnspk.ContactHeader == "" {
-		localsocket := GetUDPAddrFromConn(session.SIPUDPListenser)
-		hdrs.AddHeader(Contact, GenerateContact(localsocket))
+		hdrs.AddHeader(Contact, session.localContact())
 	} else {
 		hdrs.AddHeader(Contact, rspnspk.ContactHeader)
 	}
@@ -974,10 +1014,12 @@ func (session *SipSession) Send(tx *Transaction) {
 	if len(tx.SentMessage.Body.MessageBytes) == 0 {
 		tx.SentMessage.PrepareMessageBytes(session)
 	}
+	session.noteReleaseCause(tx.Method, tx.SentMessage)
 
 	// response
 	if tx.SentMessage.IsResponse() {
-		if tx.ViaUdpAddr != nil {
+		// responses over stream transports go back on the connection the request came from
+		if tx.ViaUdpAddr != nil && !session.transport().IsStream() {
 			session.sendmessage(tx.SentMessage, tx.ViaUdpAddr)
 		} else {
 			session.sendmessage(tx.SentMessage, session.RemoteUDP)
@@ -994,11 +1036,76 @@ func (session *SipSession) Send(tx *Transaction) {
 	session.sendmessage(tx.SentMessage, session.RemoteUDP)
 }
 
+func (session *SipSession) transport() Transport {
+	if session.SIPTransport == "" {
+		return TransportUDP
+	}
+	return session.SIPTransport
+}
+
+// sentBy returns the local host:port for Via and Contact - the UE random .invalid domain over WebSocket (RFC 7118)
+func (session *SipSession) sentBy() string {
+	if ue := session.UserEquipment; ue != nil && session.transport().IsWebSocket() {
+		return ue.wsHost
+	}
+	return GetUDPAddrStringFromConn(session.SIPUDPListenser)
+}
+
+func (session *SipSession) viaWithoutBranch() string {
+	return fmt.Sprintf("SIP/2.0/%s %s", session.transport().ViaName(), session.sentBy())
+}
+
+func (session *SipSession) localContact() string {
+	return fmt.Sprintf("<sip:%s;transport=%s>", session.sentBy(), session.transport().URIParam())
+}
+
+// setViaTransport rewrites the top Via sent-protocol and rebuilds the message bytes
+func (session *SipSession) setViaTransport(msg *SipMessage, tp Transport) {
+	via := msg.Headers.ValueHeader(Via)
+	idx := strings.IndexAny(via, " \t")
+	if idx == -1 {
+		return
+	}
+	msg.Headers.SetHeader(Via, fmt.Sprintf("SIP/2.0/%s%s", tp.ViaName(), via[idx:]))
+	msg.PrepareMessageBytes(session)
+}
+
 func (session *SipSession) sendmessage(msg *SipMessage, rmt *net.UDPAddr) {
-	_, err := session.SIPUDPListenser.WriteToUDP(msg.Body.MessageBytes, rmt)
+	ue := session.UserEquipment
+	tp := session.transport()
+
+	// RFC 3261 section 18.1.1 - large requests switch to TCP, falling back to UDP if the connection fails
+	if ue != nil && tp == TransportUDP && msg.IsRequest() && len(msg.Body.MessageBytes) > MaxUDPMessageSize {
+		session.setViaTransport(msg, TransportTCP)
+		sc, err := ue.streamSend(TransportTCP, rmt, msg.Body.MessageBytes)
+		if err == nil {
+			session.messageSent(TransportTCP, sc.conn.LocalAddr(), rmt, msg.Body.MessageBytes)
+			return
+		}
+		LogWarning(LTSIPStack, fmt.Sprintf("Failed to send large request over TCP - Falling back to UDP: %v", err))
+		session.setViaTransport(msg, TransportUDP)
+	}
+
+	if ue != nil && tp.IsStream() {
+		sc, err := ue.streamSend(tp, rmt, msg.Body.MessageBytes)
+		if err != nil {
+			LogError(LTSystem, "Failed to send message: "+err.Error())
+			return
+		}
+		session.messageSent(tp, sc.conn.LocalAddr(), rmt, msg.Body.MessageBytes)
+		return
+	}
+
+	bytes := msg.Body.MessageBytes
+	if ue := session.UserEquipment; ue != nil {
+		bytes = ue.encapsulate(session.SIPUDPListenser, rmt, bytes)
+	}
+	_, err := session.SIPUDPListenser.WriteToUDP(bytes, rmt)
 	if err != nil {
 		LogError(LTSystem, "Failed to send message: "+err.Error())
+		return
 	}
+	session.messageSent(tp, session.SIPUDPListenser.LocalAddr(), rmt, msg.Body.MessageBytes)
 }
 
 func CheckPendingTransaction(ss *SipSession, tx *Transaction) {
@@ -1014,6 +1121,11 @@ func CheckPendingTransaction(ss *SipSession, tx *Transaction) {
 			ss.ReleaseMe("Probing timed-out")
 		}
 	case INVITE:
+		if tx.Direction == INBOUND && ss.IsBeingEstablished() && ss.UnPRACKed18xCountSYNC() > 0 {
+			// RFC 3262 section 3 - reliable provisional not PRACKed; the transaction lock is held by the caller
+			go ss.RejectMe(tx, status.ServerTimeout, q850.RecoveryOnTimerExpiry, "No PRACK received")
+			return
+		}
 		if ss.IsPending() {
 			ss.SetState(state.TimedOut)
 			ss.DropMe()
@@ -1029,6 +1141,13 @@ func CheckPendingTransaction(ss *SipSession, tx *Transaction) {
 		ss.SetState(state.TimedOut)
 		ss.logRegData(nil)
 		ss.DropMe()
+	case SUBSCRIBE:
+		ss.SetState(state.TimedOut)
+		ss.releaseRegEvent()
+	case MESSAGE:
+		ss.SetState(state.TimedOut)
+		ss.smsRejected(status.RequestTimeout)
+		ss.DropMe()
 	default:
 		ss.ReleaseMe(fmt.Sprintf("In-dialogue %s timed-out", tx.Method.String()))
 	}
@@ -1314,13 +1433,19 @@ func (session *SipSession) DropMe() {
 		return
 	}
 	session.IsDisposed = true
+	session.notifyReferrer(status.RequestTimeout) // placed by a transfer yet ended without a final response
+	session.ussdClosed()
 	fmt.Println("Disposed - UEPort:", session.UserEquipment.UdpPort, "Session:", session.CallID, "State:", session.state.String())
+	session.stopRecording()
 	MediaPorts.ReleaseSocket(session.MediaListener)
 	close(session.maxDprobDoneChan)
 	close(session.AnswerChan)
 	close(session.rtpChan)
 	session.killTimers()
 	session.UserEquipment.SesMap.Delete(session.CallID)
+	go session.writeCDR() // transaction locks may be held by the caller
+	closeCallCapture(session.CallID)
+	session.archiveTrace()
 }
 
 func (ss *SipSession) DropMeTimed() {
@@ -0,0 +1,433 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	. "sipclientgo/global"
+	"sipclientgo/guid"
+	"sipclientgo/sip/state"
+	"sipclientgo/sip/status"
+	"sipclientgo/sms"
+	"sipclientgo/system"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMS over IP (3GPP TS 24.341) - RP messages (TS 24.011) carrying TPDUs (TS 23.040) in MESSAGE requests to and from the SMSC
+
+const (
+	SMSSending     = "sending"
+	SMSSubmitted   = "submitted"   // RP-ACK received for all parts
+	SMSFailed      = "failed"      // MESSAGE rejected or RP-ERROR received
+	SMSDelivered   = "delivered"   // status reports received for all parts
+	SMSUndelivered = "undelivered" // permanent error in a status report
+	SMSReceived    = "received"
+
+	smsMaxRecords = 100
+	smsConcatTTL  = 5 * time.Minute
+)
+
+type SMSRequest struct {
+	Imsi         string `json:"imsi"`
+	To           string `json:"to"`
+	Text         string `json:"text"`
+	StatusReport bool   `json:"statusReport,omitempty"`
+	SMSC         string `json:"smsc,omitempty"` // SMSCAddress when omitted
+}
+
+type SMSRecord struct {
+	ID        string `json:"id"`
+	Imsi      string `json:"imsi"`
+	Direction string `json:"direction"`
+	Peer      string `json:"peer"`
+	Text      string `json:"text"`
+	Encoding  string `json:"encoding"`
+	Parts     int    `json:"parts"`
+	Status    string `json:"status"`
+	Cause     string `json:"cause,omitempty"`
+	Time      string `json:"time"`
+}
+
+type smsEvent struct {
+	SMS SMSRecord `json:"sms"`
+}
+
+type smsEntry struct {
+	SMSRecord
+	acked     int
+	delivered int
+}
+
+// smsConcat collects the parts of a concatenated inbound message
+type smsConcat struct {
+	parts    map[byte]string
+	total    byte
+	encoding string
+	started  time.Time
+}
+
+type smsStore struct {
+	mu      sync.Mutex
+	records []*smsEntry
+	byCall  map[string]string    // Call-ID of a MESSAGE carrying an RP-DATA -> RP key
+	byRPMR  map[string]*smsEntry // imsi/RP-MR awaiting RP-ACK
+	byTPMR  map[string]*smsEntry // imsi/TP-MR awaiting a status report
+	concat  map[string]*smsConcat
+}
+
+var smsRecords = &smsStore{
+	byCall: make(map[string]string),
+	byRPMR: make(map[string]*smsEntry),
+	byTPMR: make(map[string]*smsEntry),
+	concat: make(map[string]*smsConcat),
+}
+
+func smsKey(imsi string, mr byte) string {
+	return fmt.Sprintf("%s/%d", imsi, mr)
+}
+
+// add stores the record - the oldest ones and their pending references are dropped beyond the limit
+func (st *smsStore) add(ent *smsEntry) {
+	st.records = append(st.records, ent)
+	if len(st.records) <= smsMaxRecords {
+		return
+	}
+	old := st.records[0]
+	st.records = st.records[1:]
+	for _, mp := range []map[string]*smsEntry{st.byRPMR, st.byTPMR} {
+		for k, e := range mp {
+			if e == old {
+				delete(mp, k)
+			}
+		}
+	}
+}
+
+// update changes the record under the lock and pushes it to the portal
+func (st *smsStore) update(ent *smsEntry, fn func(*smsEntry)) {
+	st.mu.Lock()
+	fn(ent)
+	rec := ent.SMSRecord
+	st.mu.Unlock()
+	WriteJSONToWebSocket(smsEvent{SMS: rec})
+}
+
+// ListSMS returns the sent and received messages of the UE, or of all UEs when imsi is empty
+func ListSMS(imsi string) []SMSRecord {
+	smsRecords.mu.Lock()
+	defer smsRecords.mu.Unlock()
+	recs := make([]SMSRecord, 0, len(smsRecords.records))
+	for _, ent := range smsRecords.records {
+		if imsi == "" || ent.Imsi == imsi {
+			recs = append(recs, ent.SMSRecord)
+		}
+	}
+	return recs
+}
+
+// SendSMS submits the text to the SMSC - one MESSAGE per part, the record is updated as RP-ACKs and status reports arrive
+func SendSMS(req SMSRequest) (SMSRecord, error) {
+	ue := UEs.GetUE(req.Imsi)
+	if ue == nil {
+		return SMSRecord{}, ErrUENotFound
+	}
+	if PCSCFSocket == nil {
+		return SMSRecord{}, errors.New("missing P-CSCF socket")
+	}
+	smsc := system.DropVisualSeparators(req.SMSC)
+	if smsc == "" {
+		smsc = SMSCAddress
+	}
+	if smsc == "" {
+		return SMSRecord{}, fmt.Errorf("%w: missing SMSC address", ErrInvalidRequest)
+	}
+	dest := system.DropVisualSeparators(req.To)
+	tpdus, encoding, err := sms.Submit(dest, req.Text, byte(ue.smsRef.Add(1)), req.StatusReport)
+	if err != nil {
+		return SMSRecord{}, fmt.Errorf("%w: %w", ErrInvalidRequest, err)
+	}
+
+	ent := &smsEntry{SMSRecord: SMSRecord{
+		ID:        guid.NewTag(),
+		Imsi:      ue.Imsi,
+		Direction: OUTBOUND.String(),
+		Peer:      dest,
+		Text:      req.Text,
+		Encoding:  encoding,
+		Parts:     len(tpdus),
+		Status:    SMSSending,
+		Time:      time.Now().UTC().Format(DicTFs[JsonDateTimeMS]),
+	}}
+	type rpPart struct {
+		mr   byte
+		body []byte
+	}
+	parts := make([]rpPart, 0, len(tpdus))
+	for _, tpdu := range tpdus {
+		mr := byte(ue.smsRef.Add(1))
+		tpdu[1] = mr
+		rp := sms.RPMessage{MTI: sms.RPDataMS, MR: mr, Destination: smsc, UserData: tpdu}
+		body, err := rp.Bytes()
+		if err != nil {
+			return SMSRecord{}, fmt.Errorf("%w: %w", ErrInvalidRequest, err)
+		}
+		parts = append(parts, rpPart{mr, body})
+	}
+
+	smsRecords.mu.Lock()
+	smsRecords.add(ent)
+	for _, p := range parts {
+		smsRecords.byRPMR[smsKey(ue.Imsi, p.mr)] = ent
+		if req.StatusReport {
+			smsRecords.byTPMR[smsKey(ue.Imsi, p.mr)] = ent
+		}
+	}
+	rec := ent.SMSRecord
+	smsRecords.mu.Unlock()
+	WriteJSONToWebSocket(smsEvent{SMS: rec})
+
+	for _, p := range parts {
+		sendSMSMessage(ue, smsc, p.body, "", smsKey(ue.Imsi, p.mr))
+	}
+	system.LogInfo(system.LTChatMessage, fmt.Sprintf("UE [%s] - SMS to [%s] submitted via [%s] in %d part(s)", ue.Imsi, dest, smsc, len(parts)))
+	return rec, nil
+}
+
+// sendSMSMessage sends the RP message to the SMSC - inReplyTo is the Call-ID of the MESSAGE being acknowledged, if any,
+// key the RP key of the part carried, mapped to the Call-ID before sending so that a fast rejection finds it
+func sendSMSMessage(ue *UserEquipment, smsc string, rp []byte, inReplyTo, key string) {
+	ss := NewSS(OUTBOUND)
+	ss.SIPUDPListenser, ss.RemoteUDP, ss.SIPTransport = ue.signallingPath()
+	ss.UserEquipment = ue
+
+	hdrs := NewSipHeaders()
+	hdrs.AddHeader(P_Access_Network_Info, "IEEE-802.3")
+	hdrs.AddHeader(Request_Disposition, "no-fork")
+	hdrs.AddHeader(Accept_Contact, "*;+g.3gpp.smsip")
+	if inReplyTo != "" {
+		hdrs.AddHeader(In_Reply_To, inReplyTo)
+	}
+	ue.addSecAgreeHeaders(&hdrs, false)
+
+	frm := ue.MsIsdn
+	if frm == "N/A" {
+		frm = ue.Imsi
+	}
+
+	trans := ss.CreateSARequest(RequestPack{Method: MESSAGE, Max70: true, RUriUP: smsc, FromUP: frm, CustomHeaders: hdrs},
+		MessageBody{PartsContents: map[BodyType]ContentPart{VndSMS: {Bytes: rp}}})
+
+	if key != "" {
+		smsRecords.mu.Lock()
+		smsRecords.byCall[ss.CallID] = key
+		smsRecords.mu.Unlock()
+	}
+
+	ss.SetState(state.BeingEstablished)
+	ss.AddMe()
+	ss.SendSTMessage(trans)
+}
+
+// smsRejected fails the part carried by the MESSAGE - sc is its final response or 408 when timed out
+func (ss *SipSession) smsRejected(sc int) {
+	smsRecords.mu.Lock()
+	key, ok := smsRecords.byCall[ss.CallID]
+	delete(smsRecords.byCall, ss.CallID)
+	ent := smsRecords.byRPMR[key]
+	delete(smsRecords.byRPMR, key)
+	delete(smsRecords.byTPMR, key)
+	smsRecords.mu.Unlock()
+	if !ok || ent == nil {
+		return
+	}
+	system.LogWarning(system.LTChatMessage, fmt.Sprintf("UE [%s] - SMS MESSAGE failed with [%d]", ent.Imsi, sc))
+	smsRecords.update(ent, func(e *smsEntry) {
+		e.Status = SMSFailed
+		e.Cause = fmt.Sprintf("SIP %d %s", sc, DicResponse[sc])
+	})
+}
+
+// smsAccepted forgets the MESSAGE once accepted - the part is then awaiting its RP-ACK
+func (ss *SipSession) smsAccepted() {
+	smsRecords.mu.Lock()
+	delete(smsRecords.byCall, ss.CallID)
+	smsRecords.mu.Unlock()
+}
+
+// processSMS handles a MESSAGE from the SMSC - RP-DATA carrying an SMS-DELIVER or SMS-STATUS-REPORT is acknowledged
+// with RP-ACK (or RP-ERROR) in a new MESSAGE, RP-ACK and RP-ERROR conclude the submission of a part
+func (ss *SipSession) processSMS(trans *Transaction, sipmsg *SipMessage) {
+	defer ss.DropMeTimed()
+	btype, body, ok := sipmsg.GetSingleBody()
+	if !ok || btype != VndSMS {
+		ss.SetState(state.Rejected)
+		ss.SendResponse(trans, status.UnsupportedMediaType, EmptyBody())
+		return
+	}
+	rp, err := sms.ParseRP(body)
+	if err != nil {
+		ss.SetState(state.Rejected)
+		ss.SendResponseDetailed(trans, NewResponsePackRFWarning(status.BadRequest, "", err.Error()), EmptyBody())
+		return
+	}
+	ss.SetState(state.Established)
+	ss.SendResponse(trans, status.OK, EmptyBody())
+
+	ue := ss.UserEquipment
+	switch rp.MTI {
+	case sms.RPDataNet:
+		smsc := smsOriginator(sipmsg)
+		if smsc == "" {
+			smsc = rp.Originator
+		}
+		reply := sms.RPMessage{MTI: sms.RPAckMS, MR: rp.MR}
+		if err := ss.smsReceived(rp); err != nil {
+			system.LogWarning(system.LTChatMessage, fmt.Sprintf("UE [%s] - Invalid TPDU from [%s]: %v", ue.Imsi, smsc, err))
+			reply = sms.RPMessage{MTI: sms.RPErrorMS, MR: rp.MR, Cause: sms.RPCauseProtocolError}
+		}
+		rpbytes, _ := reply.Bytes()
+		sendSMSMessage(ue, smsc, rpbytes, sipmsg.CallID, "")
+	case sms.RPAckNet, sms.RPErrorNet:
+		key := smsKey(ue.Imsi, rp.MR)
+		smsRecords.mu.Lock()
+		ent := smsRecords.byRPMR[key]
+		delete(smsRecords.byRPMR, key)
+		if rp.MTI == sms.RPErrorNet {
+			delete(smsRecords.byTPMR, key)
+		}
+		smsRecords.mu.Unlock()
+		if ent == nil {
+			system.LogWarning(system.LTChatMessage, fmt.Sprintf("UE [%s] - Unmatched RP message reference [%d]", ue.Imsi, rp.MR))
+			return
+		}
+		if rp.MTI == sms.RPErrorNet {
+			system.LogWarning(system.LTChatMessage, fmt.Sprintf("UE [%s] - SMS to [%s] rejected: %s", ue.Imsi, ent.Peer, rp.CauseString()))
+			smsRecords.update(ent, func(e *smsEntry) {
+				e.Status = SMSFailed
+				e.Cause = rp.CauseString()
+			})
+			return
+		}
+		smsRecords.update(ent, func(e *smsEntry) {
+			e.acked++
+			if e.Status == SMSSending && e.acked == e.Parts {
+				e.Status = SMSSubmitted
+			}
+		})
+	default:
+		system.LogWarning(system.LTChatMessage, fmt.Sprintf("UE [%s] - Unexpected RP message type [%d]", ue.Imsi, rp.MTI))
+	}
+}
+
+// smsReceived stores the delivered message once all its parts are received, or applies the status report
+func (ss *SipSession) smsReceived(rp *sms.RPMessage) error {
+	ue := ss.UserEquipment
+	switch sms.TPMTI(rp.UserData) {
+	case sms.MTIDeliver:
+		dlv, err := sms.ParseDeliver(rp.UserData)
+		if err != nil {
+			return err
+		}
+		text, parts, complete := collectParts(ue.Imsi, dlv)
+		if !complete {
+			return nil
+		}
+		ent := &smsEntry{SMSRecord: SMSRecord{
+			ID:        guid.NewTag(),
+			Imsi:      ue.Imsi,
+			Direction: INBOUND.String(),
+			Peer:      dlv.Originator,
+			Text:      text,
+			Encoding:  dlv.Encoding,
+			Parts:     parts,
+			Status:    SMSReceived,
+			Time:      time.Now().UTC().Format(DicTFs[JsonDateTimeMS]),
+		}}
+		smsRecords.mu.Lock()
+		smsRecords.add(ent)
+		smsRecords.mu.Unlock()
+		system.LogInfo(system.LTChatMessage, fmt.Sprintf("UE [%s] - SMS received from [%s]", ue.Imsi, dlv.Originator))
+		WriteJSONToWebSocket(smsEvent{SMS: ent.SMSRecord})
+	case sms.MTIStatusReport:
+		sr, err := sms.ParseStatusReport(rp.UserData)
+		if err != nil {
+			return err
+		}
+		key := smsKey(ue.Imsi, sr.MR)
+		smsRecords.mu.Lock()
+		ent := smsRecords.byTPMR[key]
+		if sr.Delivered() || sr.Status >= 0x40 { // 0x20-0x3F - the SC is still trying
+			delete(smsRecords.byTPMR, key)
+		}
+		smsRecords.mu.Unlock()
+		if ent == nil {
+			system.LogWarning(system.LTChatMessage, fmt.Sprintf("UE [%s] - Unmatched status report reference [%d]", ue.Imsi, sr.MR))
+			return nil
+		}
+		smsRecords.update(ent, func(e *smsEntry) {
+			switch {
+			case sr.Delivered():
+				e.delivered++
+				if e.delivered == e.Parts && e.Status != SMSUndelivered {
+					e.Status = SMSDelivered
+				}
+			case sr.Status >= 0x40:
+				e.Status = SMSUndelivered
+				e.Cause = fmt.Sprintf("TP-ST 0x%02X", sr.Status)
+			}
+		})
+	default:
+		return fmt.Errorf("unexpected TP message type [%d]", sms.TPMTI(rp.UserData))
+	}
+	return nil
+}
+
+// collectParts reassembles a concatenated message - stale incomplete messages are discarded
+func collectParts(imsi string, dlv *sms.Deliver) (string, int, bool) {
+	if dlv.Concat == nil || dlv.Concat.Total <= 1 {
+		return dlv.Text, 1, true
+	}
+	key := fmt.Sprintf("%s/%s/%d", imsi, dlv.Originator, dlv.Concat.Ref)
+	smsRecords.mu.Lock()
+	defer smsRecords.mu.Unlock()
+	for k, c := range smsRecords.concat {
+		if time.Since(c.started) > smsConcatTTL {
+			delete(smsRecords.concat, k)
+		}
+	}
+	cc, ok := smsRecords.concat[key]
+	if !ok {
+		cc = &smsConcat{parts: make(map[byte]string), total: dlv.Concat.Total, started: time.Now()}
+		smsRecords.concat[key] = cc
+	}
+	cc.parts[dlv.Concat.Seq] = dlv.Text
+	if len(cc.parts) < int(cc.total) {
+		return "", 0, false
+	}
+	delete(smsRecords.concat, key)
+	seqs := make([]byte, 0, len(cc.parts))
+	for seq := range cc.parts {
+		seqs = append(seqs, seq)
+	}
+	slices.Sort(seqs)
+	var sb strings.Builder
+	for _, seq := range seqs {
+		sb.WriteString(cc.parts[seq])
+	}
+	return sb.String(), int(cc.total), true
+}
+
+// smsOriginator returns the SMSC address asserted in the MESSAGE
+func smsOriginator(sipmsg *SipMessage) string {
+	hdr := sipmsg.FromHeader
+	if len(sipmsg.PAIHeaders) > 0 {
+		hdr = sipmsg.PAIHeaders[0]
+	}
+	var mtch []string
+	if RMatch(hdr, URIFull, &mtch) {
+		return uriUser(mtch[1])
+	}
+	return ""
+}
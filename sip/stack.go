@@ -157,9 +157,10 @@ func processPDU(payload []byte) (*SipMessage, []byte, error) {
 					if via == nil {
 						break
 					}
-					skt := DicFieldRegEx[ViaIPv4Socket].FindStringSubmatch(value)
-					if len(skt) > 0 {
-						sipmsg.ViaUdpAddr, _ = system.BuildUdpAddrSocket(skt[2]+":"+skt[3], SipPort)
+					if skt := DicFieldRegEx[ViaIPv4Socket].FindStringSubmatch(value); len(skt) > 0 {
+						sipmsg.ViaUdpAddr, _ = system.BuildUdpAddrSocket(skt[2]+skt[3], SipPort)
+					} else if skt := DicFieldRegEx[ViaIPv6Socket].FindStringSubmatch(value); len(skt) > 0 {
+						sipmsg.ViaUdpAddr, _ = system.BuildUdpAddrSocket("["+skt[2]+"]"+skt[3], SipPort)
 					}
 					sipmsg.ViaBranch = via[1]
 					if !strings.HasPrefix(via[1], MagicCookie) {
@@ -320,7 +321,7 @@ func sessionGetter(sipmsg *SipMessage, ue *UserEquipment) (*SipSession, NewSessi
 			switch sipmsg.GetMethod() {
 			case INVITE:
 				sipses.Mode = mode.Multimedia
-				sipses.IsPRACKSupported = sipmsg.IsOptionSupported("100rel")
+				sipses.IsPRACKSupported = sipmsg.IsOptionSupportedOrRequired("100rel")
 				sipses.IsDelayedOfferCall = !sipmsg.Body.ContainsSDP()
 				sipses.SetState(state.BeingEstablished)
 				if !sipmsg.IsKnownRURIScheme() {
@@ -329,7 +330,7 @@ func sessionGetter(sipmsg *SipMessage, ue *UserEquipment) (*SipSession, NewSessi
 				if sipmsg.Body.WithUnknownBodyPart() {
 					return sipses, UnsupportedBody
 				}
-				if sipmsg.Headers.HeaderExists("Require") {
+				if len(sipmsg.UnsupportedOptions()) > 0 {
 					return sipses, WithRequireHeader
 				}
 				if sipmsg.MaxFwds <= MinMaxFwds {
@@ -348,7 +349,9 @@ func sessionGetter(sipmsg *SipMessage, ue *UserEquipment) (*SipSession, NewSessi
 			case REGISTER:
 				sipses.Mode = mode.Registration
 				return sipses, ValidRequest
-			case REFER, NOTIFY, UPDATE, PRACK, INFO, PUBLISH, NEGOTIATE:
+			case NOTIFY: // no matching subscription
+				return sipses, CallLegTransactionNotExist
+			case REFER, UPDATE, PRACK, INFO, PUBLISH, NEGOTIATE: // transfers are in-dialogue only
 				return sipses, InvalidRequest
 			case ACK:
 				return sipses, UnExpectedMessage
@@ -383,6 +386,7 @@ func sipStack(sipmsg *SipMessage, ss *SipSession, newSesType NewSessionType) {
 		ss.DropMe()
 		return
 	}
+	ss.noteReleaseCause(trans.Method, sipmsg)
 
 	switch newSesType {
 	case Response:
@@ -394,7 +398,11 @@ func sipStack(sipmsg *SipMessage, ss *SipSession, newSesType NewSessionType) {
 		ss.RejectMe(trans, status.TooManyHops, q850.NoRCProvided, "INVITE with too low MF")
 		return
 	case WithRequireHeader:
-		ss.RejectMe(trans, status.BadExtension, q850.NoRCProvided, "INVITE with Require header")
+		ss.SetState(state.BeingRejected)
+		hdrs := NewSHQ850OrSIP(q850.NoRCProvided, "INVITE with unsupported Require option", "")
+		hdrs.AddHeader(Unsupported, strings.Join(sipmsg.UnsupportedOptions(), ", "))
+		ss.SendResponseDetailed(trans, ResponsePack{StatusCode: status.BadExtension, CustomHeaders: hdrs}, EmptyBody())
+		ss.logSessData(nil, utcNow())
 		return
 	case UnsupportedURIScheme:
 		ss.RejectMe(trans, status.UnsupportedURIScheme, q850.NoRCProvided, "URI scheme unsupported")
@@ -459,7 +467,8 @@ func sipStack(sipmsg *SipMessage, ss *SipSession, newSesType NewSessionType) {
 				ss.logSessData(utcNow(), nil)
 				ss.StartMaxCallDuration()
 				ss.StartInDialogueProbing()
-				go ss.mediaReceiver()
+				ss.startMediaReceiver()
+				ss.playAnnouncement()
 			} else { //ReINVITE
 				if trans.IsFinalResponsePositiveSYNC() {
 					ss.ChecknSetDialogueChanging(false)
@@ -481,6 +490,7 @@ func sipStack(sipmsg *SipMessage, ss *SipSession, newSesType NewSessionType) {
 			}
 			ss.SetState(state.Cleared)
 			ss.SendResponse(trans, status.OK, EmptyBody())
+			ss.ussdReceived(sipmsg)
 			ss.logSessData(nil, utcNow())
 			ss.DropMe()
 		case OPTIONS:
@@ -506,7 +516,26 @@ func sipStack(sipmsg *SipMessage, ss *SipSession, newSesType NewSessionType) {
 				ss.SendResponseDetailed(trans, NewResponsePackSIPQ850Details(status.ServiceUnavailable, q850.InterworkingUnspecified, "Not supported action"), EmptyBody())
 			}
 		case PRACK:
-			ss.SendResponse(trans, status.OK, EmptyBody())
+			switch trans.PrackStatus {
+			case PRACKUnexpected:
+				ss.SendResponse(trans, status.CallTransactionDoesNotExist, EmptyBody())
+				return
+			case PRACKMissingBadRAck:
+				ss.SendResponseDetailed(trans, NewResponsePackRFWarning(status.BadRequest, "", "Missing or malformed RAck header"), EmptyBody())
+				return
+			}
+			if !sipmsg.Body.ContainsSDP() {
+				ss.SendResponse(trans, status.OK, EmptyBody())
+				ss.reserveQoS()
+				return
+			}
+			sc, qc, wr := ss.buildSDPAnswer(sipmsg)
+			if sc != 0 {
+				ss.SendResponseDetailed(trans, NewResponsePackSIPQ850Details(sc, qc, wr), EmptyBody())
+				return
+			}
+			ss.SendResponse(trans, status.OK, NewMessageSDPBody(ss.LocalSDP))
+			ss.reserveQoS()
 		case INFO:
 			if sipmsg.Body.WithNoBody() {
 				ss.SendResponse(trans, status.OK, EmptyBody())
@@ -521,8 +550,29 @@ func sipStack(sipmsg *SipMessage, ss *SipSession, newSesType NewSessionType) {
 			case DTMF, DTMFRelay:
 				ss.parseDTMF(bytes, method, btype)
 				ss.SendResponse(trans, status.OK, EmptyBody())
+			case VndUSSDXML:
+				ss.processUSSDInfo(trans, sipmsg, bytes)
+			default:
+				ss.SendResponse(trans, status.BadInfoPackage, EmptyBody())
+			}
+		case NOTIFY:
+			switch ss.Mode {
+			case mode.Subscription:
+				ss.processRegNotify(trans, sipmsg)
+			case mode.Multimedia:
+				ss.processReferNotify(trans, sipmsg)
+			default:
+				ss.SendResponse(trans, status.CallTransactionDoesNotExist, EmptyBody())
 			}
-		default: //REFER, REGISTER, SUBSCRIBE, MESSAGE, PUBLISH, NEGOTIATE
+		case REFER:
+			ss.processRefer(trans, sipmsg)
+		case MESSAGE:
+			ss.processSMS(trans, sipmsg)
+		case SUBSCRIBE: // no event package is served by the UE
+			ss.SetState(state.Rejected)
+			ss.SendResponse(trans, status.BadEvent, EmptyBody())
+			ss.DropMe()
+		default: //REGISTER, PUBLISH, NEGOTIATE
 			ss.SetState(state.Dropped)
 			ss.SendResponse(trans, status.MethodNotAllowed, EmptyBody())
 			ss.DropMe()
@@ -535,6 +585,9 @@ func sipStack(sipmsg *SipMessage, ss *SipSession, newSesType NewSessionType) {
 		switch {
 		case 180 <= stsCode && stsCode <= 189:
 			ss.StopTimer(No18x)
+			ss.prackProvisional(sipmsg)
+			ss.applyEarlyMedia(sipmsg)
+			ss.notifyReferrer(stsCode)
 			ss.logSessData(utcNow(), nil, stsCode)
 		case stsCode <= 199:
 			ss.StartTimer(No18x)
@@ -544,15 +597,43 @@ func sipStack(sipmsg *SipMessage, ss *SipSession, newSesType NewSessionType) {
 			case INVITE:
 				ss.StopNoTimers()
 				ss.FinalizeState()
+				ss.markAnswered()
 				ss.SendRequest(ACK, trans, EmptyBody())
+				ss.ussdReceived(sipmsg)
 				ss.logSessData(utcNow(), nil)
+				if ss.RemoteMedia != nil || ss.processSDPAnswer(sipmsg) {
+					ss.startMediaReceiver()
+				}
+				ss.notifyReferrer(stsCode)
 			case REGISTER:
-				ss.FinalizeState()
+				ue := ss.UserEquipment
+				switch ss.FinalizeState() {
+				case state.Registered:
+					go subscribeRegEvent(ue)
+				case state.Unregistered:
+					ue.stopRegEvent()
+					if ue.secAgree != nil {
+						ue.secAgree.reset()
+					}
+				}
 				ss.logRegData(sipmsg)
 				ss.DropMe()
+			case SUBSCRIBE:
+				ss.FinalizeState()
+				ss.regEventSubscribed(sipmsg)
+			case MESSAGE:
+				ss.FinalizeState()
+				ss.smsAccepted()
+				ss.DropMe()
 			case ReINVITE:
 				ss.SendRequest(ACK, trans, EmptyBody())
 				ss.logSessData(nil, nil)
+			case PRACK:
+				ss.reserveQoS()
+			case UPDATE:
+				ss.processQoSAnswer(sipmsg)
+			case REFER:
+				ss.referAnswered(sipmsg)
 			case INFO:
 			case OPTIONS: //probing or keepalive
 				if ss.Mode == mode.KeepAlive {
@@ -570,6 +651,7 @@ func sipStack(sipmsg *SipMessage, ss *SipSession, newSesType NewSessionType) {
 			ss.StopNoTimers()
 			ss.Ack3xxTo6xx(state.Redirected)
 			ss.SendRequest(ACK, trans, EmptyBody())
+			ss.notifyReferrer(stsCode)
 		default: // 400-699
 			switch trans.Method {
 			case INVITE:
@@ -580,19 +662,32 @@ func sipStack(sipmsg *SipMessage, ss *SipSession, newSesType NewSessionType) {
 					ss.FinalizeState()
 				}
 				ss.SendRequest(ACK, trans, EmptyBody())
+				ss.notifyReferrer(stsCode)
+				ss.ussdFailed(stsCode)
 				ss.logSessData(nil, utcNow())
 				ss.DropMe()
+			case REFER:
+				ss.referFailed(stsCode)
 			case REGISTER:
 				sipstate := ss.SetState(state.Failed)
 				ss.logRegData(sipmsg)
 				defer ss.DropMe()
 				if wwwauth := sipmsg.Headers.ValueHeader(WWW_Authenticate); wwwauth != "" {
+					ss.UserEquipment.updateSecurityServer(sipmsg)
 					if sipstate == state.BeingUnregistered {
 						go UnregisterMe(ss.UserEquipment, wwwauth)
 					} else {
 						go RegisterMe(ss.UserEquipment, wwwauth)
 					}
 				}
+			case SUBSCRIBE:
+				system.LogWarning(system.LTRegistration, fmt.Sprintf("UE [%s] - reg event subscription failed with [%d]", ss.UserEquipment.Imsi, stsCode))
+				ss.SetState(state.Failed)
+				ss.releaseRegEvent()
+			case MESSAGE:
+				ss.SetState(state.Failed)
+				ss.smsRejected(stsCode)
+				ss.DropMe()
 			case OPTIONS: //probing or keepalive
 				if ss.Mode == mode.KeepAlive {
 					ss.FinalizeState()
@@ -0,0 +1,93 @@
+package sip
+
+import (
+	"net"
+	. "sipclientgo/global"
+	"strings"
+	"sync"
+	"time"
+)
+
+// per session SIP message trace - kept while the session lives and for the last finished sessions
+
+const maxFinishedTraces = 200
+
+type TraceEntry struct {
+	Time      string `json:"time"`
+	Direction string `json:"direction"`
+	Transport string `json:"transport"`
+	Local     string `json:"local"`
+	Remote    string `json:"remote"`
+	StartLine string `json:"startLine"`
+	Message   string `json:"message"`
+}
+
+type finishedTraces struct {
+	mu     sync.Mutex
+	order  []string
+	traces map[string][]TraceEntry
+}
+
+var traces = finishedTraces{traces: make(map[string][]TraceEntry)}
+
+func (session *SipSession) traceMessage(dir Direction, tp Transport, local, remote net.Addr, raw []byte) {
+	msg := string(raw)
+	sl, _, _ := strings.Cut(msg, "\r\n")
+	entry := TraceEntry{
+		Time:      time.Now().UTC().Format(DicTFs[JsonDateTimeMS]),
+		Direction: dir.String(),
+		Transport: tp.ViaName(),
+		StartLine: sl,
+		Message:   msg,
+	}
+	if local != nil {
+		entry.Local = local.String()
+	}
+	if remote != nil {
+		entry.Remote = remote.String()
+	}
+	session.traceLock.Lock()
+	session.trace = append(session.trace, entry)
+	session.traceLock.Unlock()
+}
+
+// messageSent records an outgoing message in the session trace and the packet capture
+func (session *SipSession) messageSent(tp Transport, local net.Addr, rmt *net.UDPAddr, raw []byte) {
+	capturePacket(session, local, rmt, raw)
+	session.traceMessage(OUTBOUND, tp, local, rmt, raw)
+}
+
+func (session *SipSession) getTrace() []TraceEntry {
+	session.traceLock.Lock()
+	defer session.traceLock.Unlock()
+	return append([]TraceEntry{}, session.trace...)
+}
+
+// archiveTrace keeps the trace of a disposed session, evicting the oldest beyond maxFinishedTraces
+func (session *SipSession) archiveTrace() {
+	trc := session.getTrace()
+	if len(trc) == 0 {
+		return
+	}
+	traces.mu.Lock()
+	defer traces.mu.Unlock()
+	if _, ok := traces.traces[session.CallID]; !ok {
+		traces.order = append(traces.order, session.CallID)
+	}
+	traces.traces[session.CallID] = trc
+	for len(traces.order) > maxFinishedTraces {
+		delete(traces.traces, traces.order[0])
+		traces.order = traces.order[1:]
+	}
+}
+
+// GetSessionTrace returns the ordered sent and received messages of a live or recently finished session
+func GetSessionTrace(callID string) ([]TraceEntry, bool) {
+	if ses, ok := findCall(callID); ok {
+		return ses.getTrace(), true
+	}
+	traces.mu.Lock()
+	defer traces.mu.Unlock()
+	trc, ok := traces.traces[callID]
+	return trc, ok
+}
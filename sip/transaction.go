@@ -225,7 +225,9 @@ func (transaction *Transaction) TransTimerHandler(sipSes *SipSession) {
 		CheckPendingTransaction(sipSes, transaction)
 		return
 	}
-	sipSes.Send(transaction)
+	if !sipSes.transport().IsStream() { // no retransmissions over reliable transports
+		sipSes.Send(transaction)
+	}
 	transaction.ReTXCount++
 	transaction.TransTimeOut *= 2 //doubling retransmission interval
 	transaction.restartTransTimer(sipSes)
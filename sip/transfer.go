@@ -0,0 +1,315 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	. "sipclientgo/global"
+	"sipclientgo/q850"
+	"sipclientgo/sip/mode"
+	"sipclientgo/sip/state"
+	"sipclientgo/sip/status"
+	"sipclientgo/system"
+	"slices"
+	"strings"
+)
+
+// call transfer (RFC 3515, RFC 5589) - REFER within an established call
+// blind transfers refer the peer to the target, attended ones to the consultation call peer with a Replaces header (RFC 3891)
+// as transferee the UE places the new call and reports its progress in message/sipfrag NOTIFYs,
+// as transferor it releases the transferred call once the new call is answered
+
+const referSubscriptionExpires = 60 // s
+
+type TransferRequest struct {
+	CallID        string `json:"callID"`
+	Target        string `json:"target,omitempty"`        // blind - number or SIP/tel URI
+	ConsultCallID string `json:"consultCallID,omitempty"` // attended - established call with the transfer target
+}
+
+// TransferCall sends the REFER - the transfer outcome is reported by the transferee in NOTIFYs
+func TransferCall(req TransferRequest) error {
+	ss, ok := findCall(req.CallID)
+	if !ok {
+		return ErrCallNotFound
+	}
+	if !ss.IsEstablished() {
+		return errors.New("call not established")
+	}
+	var referTo string
+	switch {
+	case req.ConsultCallID != "":
+		consult, ok := ss.UserEquipment.SesMap.Load(req.ConsultCallID)
+		if !ok || consult == ss || consult.Mode != mode.Multimedia {
+			return fmt.Errorf("consultation %w", ErrCallNotFound)
+		}
+		if !consult.IsEstablished() {
+			return errors.New("consultation call not established")
+		}
+		local, remote := consult.dialogueTags()
+		replaces := fmt.Sprintf("%s;to-tag=%s;from-tag=%s", consult.CallID, remote, local)
+		referTo = fmt.Sprintf("<%s?Replaces=%s>", consult.remoteIdentity(), url.QueryEscape(replaces))
+	case req.Target != "":
+		referTo = "<" + targetURI(req.Target) + ">"
+	default:
+		return fmt.Errorf("%w: missing transfer target", ErrInvalidRequest)
+	}
+	if !ss.referPending.CompareAndSwap(false, true) {
+		return errors.New("transfer already in progress")
+	}
+	hdrs := NewSipHeaders()
+	hdrs.AddHeader(Refer_To, referTo)
+	hdrs.AddHeader(Referred_By, "<"+ss.localIdentity()+">")
+	ss.SendRequestDetailed(RequestPack{Method: REFER, CustomHeaders: hdrs}, nil, EmptyBody())
+	system.LogInfo(system.LTSIPStack, fmt.Sprintf("Call [%s] - Transfer to %s requested", ss.CallID, referTo))
+	return nil
+}
+
+// targetURI builds the URI of a number - URIs are kept as they are
+func targetURI(target string) string {
+	var mtch []string
+	if RMatch(target, URIFull, &mtch) {
+		return mtch[1]
+	}
+	return fmt.Sprintf("sip:%s@%s;user=phone", system.DropVisualSeparators(target), ImsDomain)
+}
+
+// uriUser returns the user part of a SIP URI or the number of a tel URI
+func uriUser(uri string) string {
+	_, rest, _ := strings.Cut(uri, ":")
+	user, _, _ := strings.Cut(rest, "@")
+	user, _, _ = strings.Cut(user, ";")
+	return system.DropVisualSeparators(user)
+}
+
+// dialogueTags returns the local and remote tags of the dialogue
+func (ss *SipSession) dialogueTags() (local, remote string) {
+	if ss.Direction == OUTBOUND {
+		return ss.FromTag, ss.ToTag
+	}
+	return ss.ToTag, ss.FromTag
+}
+
+func (ss *SipSession) localIdentity() string {
+	hdr := ss.FromHeader
+	if ss.Direction == INBOUND {
+		hdr = ss.ToHeader
+	}
+	var mtch []string
+	if RMatch(hdr, URIFull, &mtch) {
+		return mtch[1]
+	}
+	return hdr
+}
+
+func (ss *SipSession) remoteIdentity() string {
+	hdr := ss.ToHeader
+	if ss.Direction == INBOUND {
+		hdr = ss.FromHeader
+	}
+	var mtch []string
+	if RMatch(hdr, URIFull, &mtch) {
+		return mtch[1]
+	}
+	return hdr
+}
+
+// ---------------------------------------------------------------------------
+// transferor
+
+// referAnswered handles the 2xx to the REFER - no progress is reported when the implicit subscription is declined
+func (ss *SipSession) referAnswered(sipmsg *SipMessage) {
+	system.LogInfo(system.LTSIPStack, fmt.Sprintf("Call [%s] - Transfer accepted", ss.CallID))
+	if strings.EqualFold(sipmsg.Headers.ValueHeader(Refer_Sub), "false") {
+		ss.referPending.Store(false)
+	}
+}
+
+func (ss *SipSession) referFailed(sc int) {
+	ss.referPending.Store(false)
+	system.LogWarning(system.LTSIPStack, fmt.Sprintf("Call [%s] - Transfer rejected with [%d %s]", ss.CallID, sc, DicResponse[sc]))
+}
+
+// processReferNotify handles the transfer progress - the call is released once the new call is answered
+func (ss *SipSession) processReferNotify(trans *Transaction, sipmsg *SipMessage) {
+	evnt, _, _ := strings.Cut(sipmsg.Headers.ValueHeader(Event), ";")
+	if !strings.EqualFold(strings.TrimSpace(evnt), "refer") {
+		ss.SendResponse(trans, status.BadEvent, EmptyBody())
+		return
+	}
+	if !ss.referPending.Load() {
+		ss.SendResponse(trans, status.CallTransactionDoesNotExist, EmptyBody())
+		return
+	}
+	frag, ok := sipmsg.GetBodyPart(SIPFragment)
+	line, _, _ := strings.Cut(string(frag), "\n")
+	var mtch []string
+	if !ok || !RMatch(strings.TrimSpace(line), ResponseStartLinePattern, &mtch) {
+		ss.SendResponseDetailed(trans, NewResponsePackRFWarning(status.BadRequest, "", "Missing or malformed message/sipfrag body"), EmptyBody())
+		return
+	}
+	ss.SendResponse(trans, status.OK, EmptyBody())
+
+	sc := system.Str2Int[int](mtch[2])
+	system.LogInfo(system.LTSIPStack, fmt.Sprintf("Call [%s] - Transfer progress [%d %s]", ss.CallID, sc, mtch[3]))
+	substate, _, _ := strings.Cut(sipmsg.Headers.ValueHeader(Subscription_State), ";")
+	switch {
+	case sc <= 199:
+		if strings.EqualFold(strings.TrimSpace(substate), "terminated") {
+			ss.referPending.Store(false)
+		}
+	case sc <= 299:
+		ss.referPending.Store(false)
+		ss.releaseReferred()
+	default:
+		ss.referPending.Store(false)
+		system.LogWarning(system.LTSIPStack, fmt.Sprintf("Call [%s] - Transfer failed with [%d %s]", ss.CallID, sc, mtch[3]))
+	}
+}
+
+// releaseReferred clears the transferred call - the session ends as Referred
+func (ss *SipSession) releaseReferred() {
+	if !ss.IsEstablished() {
+		return
+	}
+	ss.SetState(state.BeingReferred)
+	ss.SendRequestDetailed(RequestPack{Method: BYE, Max70: true, CustomHeaders: NewSHQ850OrSIP(0, "Call transferred", "")}, nil, EmptyBody())
+	ss.logSessData(nil, utcNow())
+}
+
+// ---------------------------------------------------------------------------
+// transferee
+
+// processRefer accepts the REFER and places the new call on behalf of the referrer
+func (ss *SipSession) processRefer(trans *Transaction, sipmsg *SipMessage) {
+	if ss.Mode != mode.Multimedia || !ss.IsEstablished() {
+		ss.SendResponseDetailed(trans, NewResponsePackRFWarning(status.Forbidden, "", "Transfer of non established call"), EmptyBody())
+		return
+	}
+	uri, replaces, err := sipmsg.GetReferTo()
+	if err != nil {
+		ss.SendResponseDetailed(trans, NewResponsePackRFWarning(status.BadRequest, "", err.Error()), EmptyBody())
+		return
+	}
+	cdpn := uriUser(uri)
+	if cdpn == "" {
+		ss.SendResponseDetailed(trans, NewResponsePackRFWarning(status.BadRequest, "", "Refer-To URI without user"), EmptyBody())
+		return
+	}
+	if !ss.referPending.CompareAndSwap(false, true) {
+		ss.SendResponseDetailed(trans, NewResponsePackRFWarning(status.RequestPending, "", "Transfer already in progress"), EmptyBody())
+		return
+	}
+	ss.multiUseMutex.Lock()
+	ss.ReferSubscription = !sipmsg.WithNoReferSubscription()
+	ss.Relayed18xNotify = nil
+	ss.referCSeq = sipmsg.CSeqNum
+	ss.multiUseMutex.Unlock()
+
+	ss.SendResponse(trans, status.Accepted, EmptyBody())
+	system.LogInfo(system.LTSIPStack, fmt.Sprintf("Call [%s] - Referred to [%s]", ss.CallID, uri))
+	ss.sendReferNotify(status.Trying)
+
+	hdrs := NewSipHeaders()
+	if rb := sipmsg.Headers.ValueHeader(Referred_By); rb != "" {
+		hdrs.AddHeader(Referred_By, rb)
+	}
+	if replaces != "" {
+		hdrs.AddHeader(Replaces, replaces)
+		hdrs.AddHeader(Require, "replaces")
+	}
+	if placeCall(ss.UserEquipment, cdpn, hdrs, ss, ss.preconditions() != nil) == nil {
+		ss.sendReferNotify(status.ServiceUnavailable)
+	}
+}
+
+// notifyReferrer reports the progress of a call placed on behalf of a REFER - reporting ends with the first final code
+func (ss *SipSession) notifyReferrer(sc int) {
+	var rs *SipSession
+	if sc >= 200 {
+		rs = ss.referrer.Swap(nil)
+	} else {
+		rs = ss.referrer.Load()
+	}
+	if rs != nil {
+		rs.sendReferNotify(sc)
+	}
+}
+
+// sendReferNotify sends the status in a message/sipfrag NOTIFY - once per provisional code
+func (ss *SipSession) sendReferNotify(sc int) {
+	final := sc >= 200
+	if final {
+		ss.referPending.Store(false)
+	}
+	if !ss.IsEstablished() {
+		return
+	}
+	ss.multiUseMutex.Lock()
+	if !ss.ReferSubscription || (!final && slices.Contains(ss.Relayed18xNotify, sc)) {
+		ss.multiUseMutex.Unlock()
+		return
+	}
+	if !final {
+		ss.Relayed18xNotify = append(ss.Relayed18xNotify, sc)
+	}
+	id := ss.referCSeq
+	ss.multiUseMutex.Unlock()
+
+	hdrs := NewSipHeaders()
+	hdrs.AddHeader(Event, fmt.Sprintf("refer;id=%d", id))
+	if final {
+		hdrs.AddHeader(Subscription_State, "terminated;reason=noresource")
+	} else {
+		hdrs.AddHeader(Subscription_State, fmt.Sprintf("active;expires=%d", referSubscriptionExpires))
+	}
+	frag := fmt.Appendf(nil, "%s %d %s\r\n", SipVersion, sc, DicResponse[sc])
+	ss.SendRequestDetailed(RequestPack{Method: NOTIFY, CustomHeaders: hdrs}, nil, MessageBody{PartsContents: map[BodyType]ContentPart{SIPFragment: {Bytes: frag}}})
+}
+
+// ---------------------------------------------------------------------------
+// transfer target
+
+// matchReplaced finds the established call named in the Replaces header of the INVITE - the INVITE is rejected otherwise
+func (ss *SipSession) matchReplaced(trans *Transaction, sipmsg *SipMessage) bool {
+	params := strings.Split(sipmsg.Headers.ValueHeader(Replaces), ";")
+	callID := strings.TrimSpace(params[0])
+	var toTag, fromTag string
+	var earlyOnly bool
+	for _, prm := range params[1:] {
+		k, v, _ := strings.Cut(strings.TrimSpace(prm), "=")
+		switch system.ASCIIToLower(k) {
+		case "to-tag":
+			toTag = v
+		case "from-tag":
+			fromTag = v
+		case "early-only":
+			earlyOnly = true
+		}
+	}
+	old, ok := ss.UserEquipment.SesMap.Load(callID)
+	if ok {
+		local, remote := old.dialogueTags()
+		ok = old != ss && old.Mode == mode.Multimedia && local == toTag && remote == fromTag
+	}
+	switch {
+	case !ok:
+		ss.RejectMe(trans, status.CallTransactionDoesNotExist, q850.NoRCProvided, "Replaced dialogue not found")
+		return false
+	case earlyOnly:
+		ss.RejectMe(trans, status.BusyHere, q850.UserBusy, "Replaced dialogue already confirmed")
+		return false
+	case !old.IsEstablished():
+		ss.RejectMe(trans, status.CallTransactionDoesNotExist, q850.NoRCProvided, "Only established dialogues can be replaced")
+		return false
+	}
+	ss.replaced = old
+	system.LogInfo(system.LTSIPStack, fmt.Sprintf("Call [%s] - Replacing call [%s]", ss.CallID, old.CallID))
+	return true
+}
+
+func (ss *SipSession) releaseReplaced() {
+	if ss.replaced != nil {
+		ss.replaced.ReleaseMe("Call replaced")
+	}
+}
@@ -0,0 +1,367 @@
+package sip
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	. "sipclientgo/global"
+	"sipclientgo/guid"
+	"sipclientgo/system"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// =================================================================================================
+// Stream transports (TCP/TLS/WS/WSS) - connections are reused per remote socket
+// TCP/TLS are framed by Content-Length, WebSocket carries one SIP message per frame (RFC 7118)
+
+const (
+	streamDialTimeout = 5 * time.Second
+	maxStreamHeaders  = 16 * 1024
+	wsSubprotocol     = "sip"
+)
+
+type streamConn struct {
+	conn      net.Conn
+	ws        *websocket.Conn
+	transport Transport
+	raddr     *net.UDPAddr
+	wmu       sync.Mutex
+}
+
+func (sc *streamConn) write(payload []byte) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	if sc.ws != nil {
+		return sc.ws.WriteMessage(websocket.TextMessage, payload)
+	}
+	_, err := sc.conn.Write(payload)
+	return err
+}
+
+type streamPool struct {
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[string]*streamConn
+}
+
+func streamKey(tp Transport, raddr *net.UDPAddr) string {
+	return fmt.Sprintf("%s|%s", tp, raddr)
+}
+
+var (
+	tlsOnce       sync.Once
+	tlsClientConf *tls.Config
+	tlsServerConf *tls.Config
+	tlsErr        error
+)
+
+// loadTLSConfigs builds the client and server TLS configurations from the configured CA and certificate files
+func loadTLSConfigs() error {
+	tlsOnce.Do(func() {
+		clnt := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: TLSServerName}
+		srvr := &tls.Config{MinVersion: tls.VersionTLS12}
+
+		if TLSCAFile != "" {
+			pem, err := os.ReadFile(TLSCAFile)
+			if err != nil {
+				tlsErr = fmt.Errorf("cannot read TLS CA file: %w", err)
+				return
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				tlsErr = errors.New("no certificates found in TLS CA file")
+				return
+			}
+			clnt.RootCAs = pool
+			srvr.ClientCAs = pool
+		}
+
+		if TLSCertFile != "" && TLSKeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(TLSCertFile, TLSKeyFile)
+			if err != nil {
+				tlsErr = fmt.Errorf("cannot load TLS client certificate: %w", err)
+				return
+			}
+			clnt.Certificates = []tls.Certificate{cert}
+			srvr.Certificates = clnt.Certificates
+		}
+
+		tlsClientConf = clnt
+		tlsServerConf = srvr
+	})
+	return tlsErr
+}
+
+func (ue *UserEquipment) transport() Transport {
+	if tp, ok := ParseTransport(ue.Transport); ok {
+		return tp
+	}
+	return PCSCFTransport
+}
+
+// transportParam returns the Contact URI transport parameter - omitted for UDP
+func (ue *UserEquipment) transportParam() string {
+	if tp := ue.transport(); tp != TransportUDP {
+		return ";transport=" + tp.URIParam()
+	}
+	return ""
+}
+
+// startStreamListener listens for TCP (or TLS for TLS UEs) on the UE port - UDP UEs still accept TCP for large messages
+// WebSocket UEs are clients only and receive everything over the connection they opened
+func (ue *UserEquipment) startStreamListener() error {
+	ue.streams = &streamPool{conns: make(map[string]*streamConn)}
+	ue.wsHost = guid.NewTag() + ".invalid"
+	if ue.transport().IsWebSocket() {
+		return nil
+	}
+
+	tp := TransportTCP
+	laddr := net.JoinHostPort(ue.localIP().String(), system.Int2Str(ue.UdpPort))
+	var ln net.Listener
+	var err error
+	if ue.transport() == TransportTLS {
+		tp = TransportTLS
+		if err = loadTLSConfigs(); err != nil {
+			return err
+		}
+		if len(tlsServerConf.Certificates) == 0 {
+			system.LogWarning(system.LTConfiguration, fmt.Sprintf("UE [%s] - No TLS certificate configured - Inbound TLS connections disabled", ue.Imsi))
+			return nil
+		}
+		ln, err = tls.Listen("tcp", laddr, tlsServerConf)
+	} else {
+		ln, err = net.Listen("tcp", laddr)
+	}
+	if err != nil {
+		return err
+	}
+	ue.streams.listener = ln
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			raddr := conn.RemoteAddr().(*net.TCPAddr)
+			sc := &streamConn{conn: conn, transport: tp, raddr: &net.UDPAddr{IP: raddr.IP, Port: raddr.Port, Zone: raddr.Zone}}
+			ue.addStream(sc)
+			go ue.readStream(sc)
+		}
+	}()
+	return nil
+}
+
+func (ue *UserEquipment) stopStreams() {
+	sp := ue.streams
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.listener != nil {
+		sp.listener.Close()
+	}
+	for k, sc := range sp.conns {
+		sc.conn.Close()
+		delete(sp.conns, k)
+	}
+}
+
+func (ue *UserEquipment) addStream(sc *streamConn) {
+	sp := ue.streams
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.conns[streamKey(sc.transport, sc.raddr)] = sc
+}
+
+func (ue *UserEquipment) dropStream(sc *streamConn) {
+	sc.conn.Close()
+	sp := ue.streams
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	key := streamKey(sc.transport, sc.raddr)
+	if sp.conns[key] == sc {
+		delete(sp.conns, key)
+	}
+}
+
+// getStream reuses an open connection to the remote socket or dials a new one
+func (ue *UserEquipment) getStream(tp Transport, rmt *net.UDPAddr) (*streamConn, error) {
+	sp := ue.streams
+	if sp == nil {
+		return nil, errors.New("stream transports not started")
+	}
+	key := streamKey(tp, rmt)
+	sp.mu.Lock()
+	sc, ok := sp.conns[key]
+	sp.mu.Unlock()
+	if ok {
+		return sc, nil
+	}
+
+	if tp.IsWebSocket() {
+		return ue.dialWebSocket(tp, rmt)
+	}
+
+	dialer := &net.Dialer{Timeout: streamDialTimeout, LocalAddr: &net.TCPAddr{IP: ue.localIP()}}
+	var conn net.Conn
+	var err error
+	if tp == TransportTLS {
+		if err = loadTLSConfigs(); err != nil {
+			return nil, err
+		}
+		conf := tlsClientConf.Clone()
+		if conf.ServerName == "" {
+			conf.ServerName = rmt.IP.String()
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", rmt.String(), conf)
+	} else {
+		conn, err = dialer.Dial("tcp", rmt.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sc = &streamConn{conn: conn, transport: tp, raddr: rmt}
+	ue.addStream(sc)
+	go ue.readStream(sc)
+	return sc, nil
+}
+
+func (ue *UserEquipment) streamSend(tp Transport, rmt *net.UDPAddr, payload []byte) (*streamConn, error) {
+	sc, err := ue.getStream(tp, rmt)
+	if err != nil {
+		return nil, err
+	}
+	if err = sc.write(payload); err != nil {
+		ue.dropStream(sc)
+		return nil, err
+	}
+	return sc, nil
+}
+
+func (ue *UserEquipment) readStream(sc *streamConn) {
+	defer func() {
+		if r := recover(); r != nil {
+			system.LogCallStack(r)
+		}
+	}()
+	defer ue.dropStream(sc)
+
+	rdr := bufio.NewReaderSize(sc.conn, BufferSize)
+	for {
+		msg, err := readStreamMessage(rdr)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				system.LogWarning(system.LTSIPStack, fmt.Sprintf("UE [%s] - %s connection with [%s] closed: %v", ue.Imsi, sc.transport.ViaName(), sc.raddr, err))
+			}
+			return
+		}
+		ue.DataChan <- Packet{sourceAddr: sc.raddr, buffer: &msg, bytesCount: len(msg), stream: sc}
+	}
+}
+
+// dialWebSocket opens a WebSocket to the P-CSCF negotiating the sip subprotocol
+func (ue *UserEquipment) dialWebSocket(tp Transport, rmt *net.UDPAddr) (*streamConn, error) {
+	dialer := &websocket.Dialer{
+		NetDialContext:   (&net.Dialer{Timeout: streamDialTimeout, LocalAddr: &net.TCPAddr{IP: ue.localIP()}}).DialContext,
+		HandshakeTimeout: streamDialTimeout,
+		Subprotocols:     []string{wsSubprotocol},
+	}
+	if tp == TransportWSS {
+		if err := loadTLSConfigs(); err != nil {
+			return nil, err
+		}
+		conf := tlsClientConf.Clone()
+		if conf.ServerName == "" {
+			conf.ServerName = rmt.IP.String()
+		}
+		dialer.TLSClientConfig = conf
+	}
+
+	ws, _, err := dialer.Dial(fmt.Sprintf("%s://%s%s", tp, rmt, WSPath), nil)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Subprotocol() != wsSubprotocol {
+		ws.Close()
+		return nil, fmt.Errorf("WebSocket server did not accept [%s] subprotocol", wsSubprotocol)
+	}
+
+	sc := &streamConn{conn: ws.NetConn(), ws: ws, transport: tp, raddr: rmt}
+	ue.addStream(sc)
+	go ue.readWebSocket(sc)
+	return sc, nil
+}
+
+func (ue *UserEquipment) readWebSocket(sc *streamConn) {
+	defer func() {
+		if r := recover(); r != nil {
+			system.LogCallStack(r)
+		}
+	}()
+	defer ue.dropStream(sc)
+
+	for {
+		mt, msg, err := sc.ws.ReadMessage()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				system.LogWarning(system.LTSIPStack, fmt.Sprintf("UE [%s] - %s connection with [%s] closed: %v", ue.Imsi, sc.transport.ViaName(), sc.raddr, err))
+			}
+			return
+		}
+		if mt != websocket.TextMessage && mt != websocket.BinaryMessage {
+			continue
+		}
+		ue.DataChan <- Packet{sourceAddr: sc.raddr, buffer: &msg, bytesCount: len(msg), stream: sc}
+	}
+}
+
+// readStreamMessage reads one SIP message - headers up to the empty line then Content-Length bytes of body
+func readStreamMessage(rdr *bufio.Reader) ([]byte, error) {
+	var hdrs bytes.Buffer
+	cntntLen := 0
+	for {
+		line, err := rdr.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			if hdrs.Len() == 0 { // CRLF keep-alive (RFC 5626)
+				continue
+			}
+			hdrs.Write(line)
+			break
+		}
+		hdrs.Write(line)
+		if hdrs.Len() > maxStreamHeaders {
+			return nil, errors.New("too long message headers")
+		}
+		name, value, ok := strings.Cut(string(line), ":")
+		if !ok {
+			continue
+		}
+		name = strings.TrimSpace(name)
+		if strings.EqualFold(name, "Content-Length") || strings.EqualFold(name, "l") {
+			cntntLen = system.Str2Int[int](strings.TrimSpace(value))
+		}
+	}
+	msg := make([]byte, hdrs.Len()+cntntLen)
+	copy(msg, hdrs.Bytes())
+	if _, err := io.ReadFull(rdr, msg[hdrs.Len():]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -1,33 +1,72 @@
 package sip
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"sipclientgo/global"
 	"sipclientgo/sip/mode"
 	"sipclientgo/system"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var UEs *UserEquipments = NewUserEquipments()
 
+// ErrUENotFound is returned when no UE has the IMSI of the request
+var ErrUENotFound = errors.New("UE not found")
+
 type SessionsMap = *ConcurrentMapMutex[SipSession]
 
 type UserEquipment struct {
-	Enabled   bool        `json:"enabled"`
-	Imsi      string      `json:"imsi"`
-	Ki        string      `json:"ki"`
-	Opc       string      `json:"opc"`
-	MsIsdn    string      `json:"msisdn"`
-	RegStatus string      `json:"regStatus"`
-	Expires   string      `json:"expires"`
-	UdpPort   int         `json:"udpPort"`
-	RegAuth   string      `json:"-"`
-	InvAuth   string      `json:"-"`
-	SesMap    SessionsMap `json:"-"`
+	Enabled       bool        `json:"enabled"`
+	Imsi          string      `json:"imsi"`
+	Ki            string      `json:"ki"`
+	Opc           string      `json:"opc"`
+	MsIsdn        string      `json:"msisdn"`
+	RegStatus     string      `json:"regStatus"`
+	Expires       string      `json:"expires"`
+	UdpPort       int         `json:"udpPort"`
+	SecAgree      string      `json:"secAgree"`
+	Transport     string      `json:"transport"`
+	IPFamily      string      `json:"ipFamily"`
+	Recording     string      `json:"recording"`
+	AnswerPolicy  string      `json:"answerPolicy"`
+	NextRefresh   string      `json:"-"` // runtime only - shown through UEView
+	BindingExpiry string      `json:"-"`
+	RegAuth       string      `json:"-"`
+	InvAuth       string      `json:"-"`
+	SesMap        SessionsMap `json:"-"`
 
 	UDPListener *net.UDPConn `json:"-"`
 	DataChan    chan Packet  `json:"-"`
+
+	authMu sync.Mutex
+	auth   *authContext
+	sqnMS  uint64 // highest SQN accepted from the network (USIM SQNms)
+
+	secAgree *secAgreement
+	streams  *streamPool
+	wsHost   string // RFC 7118 - random domain advertised in Via and Contact over WebSocket
+
+	regMu       sync.Mutex
+	regWanted   bool
+	regTimer    *time.Timer
+	regFailures int
+	minExpires  int    // Min-Expires of the last 423 response
+	regOutcomes uint64 // final REGISTER responses and timeouts - scenarios wait for the one of their request
+
+	subMu       sync.Mutex
+	regSub      *SipSession
+	regSubTimer *time.Timer
+
+	answerPlc atomic.Pointer[AnswerPolicy]
+
+	smsRef atomic.Uint32 // SMS message references and concatenation references
+
+	utMu   sync.Mutex
+	utAuth *authContext // digest challenge of the XCAP server - guarded by authMu
 }
 
 type UserEquipments struct {
@@ -47,21 +86,26 @@ func (ues *UserEquipments) AddUE(ue *UserEquipment) error {
 	if _, ok := ues.eqs[ue.Imsi]; ok {
 		return fmt.Errorf("UE already exists")
 	}
+	if err := ue.setAnswerPolicy(ue.AnswerPolicy); err != nil {
+		return err
+	}
 
 	for k, v := range ues.eqs {
-		if ue.UdpPort == v.UdpPort {
+		if ue.UdpPort == v.UdpPort || (v.secAgree != nil && v.secAgree.usesPort(ue.UdpPort)) {
 			return fmt.Errorf("UDP port already in use with UE: %s", k)
 		}
 	}
 
 	ue.SesMap = NewConcurrentMapMutex[SipSession]()
+	ue.NextRefresh = "N/A"
+	ue.BindingExpiry = "N/A"
 
 	err := StartUEListener(ue)
 	if err != nil {
 		return err
 	}
 	ues.eqs[ue.Imsi] = ue
-	system.LogInfo(system.LTRegistration, fmt.Sprintf("New UE started on [%s:%d]", global.ClientIPv4.String(), ue.UdpPort))
+	system.LogInfo(system.LTRegistration, fmt.Sprintf("New UE started on [%s]", system.GetUDPAddrStringFromConn(ue.UDPListener)))
 	return nil
 }
 
@@ -79,12 +123,15 @@ func (ues *UserEquipments) DeleteUEs(imsis ...string) {
 	defer ues.mu.Unlock()
 	for _, imsi := range imsis {
 		if ue, ok := ues.eqs[imsi]; ok {
+			ue.stopStreams()
 			if ue.DataChan != nil {
 				close(ue.DataChan)
 			}
 			if ue.UDPListener != nil {
 				ue.UDPListener.Close()
 			}
+			ue.stopSecAgreement()
+			ue.setRegistrationWanted(false)
 			delete(ues.eqs, imsi)
 		}
 	}
@@ -100,6 +147,16 @@ func (ues *UserEquipments) GetUEs() []*UserEquipment {
 	return uesList
 }
 
+// GetUEViews returns the UEs with their registration state as shown in the portal
+func (ues *UserEquipments) GetUEViews() []UEView {
+	uesList := ues.GetUEs()
+	views := make([]UEView, 0, len(uesList))
+	for _, ue := range uesList {
+		views = append(views, ue.View())
+	}
+	return views
+}
+
 func (ues *UserEquipments) DoRegister(imsi string, unreg bool) error {
 	ues.mu.RLock()
 	defer ues.mu.RUnlock()
@@ -115,18 +172,22 @@ func (ues *UserEquipments) DoRegister(imsi string, unreg bool) error {
 	return nil
 }
 
-func (ues *UserEquipments) DoCall(imsi, cdpn string) error {
+// DoCall places the call and returns its Call-ID - with QoS preconditions offered when asked for
+func (ues *UserEquipments) DoCall(imsi, cdpn string, preconditions bool) (string, error) {
 	ues.mu.RLock()
-	defer ues.mu.RUnlock()
 	ue, ok := ues.eqs[imsi]
+	ues.mu.RUnlock()
 	if !ok {
-		return fmt.Errorf("UE not found")
+		return "", fmt.Errorf("UE not found")
 	}
 	if cdpn == "" {
-		return fmt.Errorf("invalid CDPN")
+		return "", fmt.Errorf("invalid CDPN")
 	}
-	go CallViaUE(ue, cdpn)
-	return nil
+	ss := CallViaUE(ue, cdpn, preconditions)
+	if ss == nil {
+		return "", fmt.Errorf("call could not be placed")
+	}
+	return ss.CallID, nil
 }
 
 func (ues *UserEquipments) DoCallAction(imsi, callID, action string) error {
@@ -160,3 +221,37 @@ func (ues *UserEquipments) GetCalls() []sessData {
 	}
 	return calls
 }
+
+// UEView is a UE as shown in the portal and over the websocket - its configuration with the runtime registration
+// state, which is not kept in data.json
+type UEView struct {
+	*UserEquipment
+	RegStatus     string `json:"regStatus"`
+	NextRefresh   string `json:"nextRefresh"`
+	BindingExpiry string `json:"bindingExpiry"`
+}
+
+// View snapshots the registration state under regMu - it is updated by REGISTER responses and the refresh timer
+func (ue *UserEquipment) View() UEView {
+	ue.regMu.Lock()
+	defer ue.regMu.Unlock()
+	return UEView{UserEquipment: ue, RegStatus: ue.RegStatus, NextRefresh: ue.NextRefresh, BindingExpiry: ue.BindingExpiry}
+}
+
+// ipFamily returns the UE address family - following the P-CSCF socket unless set explicitly
+func (ue *UserEquipment) ipFamily() global.IPFamily {
+	if f, ok := global.ParseIPFamily(ue.IPFamily); ok {
+		return f
+	}
+	if global.PCSCFSocket != nil && global.PCSCFSocket.IP.To4() == nil {
+		return global.IPFamilyV6
+	}
+	return global.IPFamilyV4
+}
+
+func (ue *UserEquipment) localIP() net.IP {
+	if ue.ipFamily() == global.IPFamilyV6 {
+		return global.ClientIPv6
+	}
+	return global.ClientIPv4
+}
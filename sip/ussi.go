@@ -0,0 +1,320 @@
+package sip
+
+import (
+	"cmp"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	. "sipclientgo/global"
+	"sipclientgo/sip/state"
+	"sipclientgo/sip/status"
+	"sipclientgo/system"
+	"strings"
+	"sync"
+	"time"
+)
+
+// USSI (3GPP TS 24.390) - USSD strings exchanged in an INVITE dialogue: the service code in the INVITE,
+// menus and answers in INFO requests of the g.3gpp.ussd info package, the final result in the 200 OK or BYE
+
+const (
+	USSDActive = "active"
+	USSDEnded  = "ended"
+	USSDFailed = "failed"
+
+	ussdInfoPackage = "g.3gpp.ussd"
+	ussdLanguage    = "en"
+	ussdMaxDialogs  = 100
+)
+
+type USSDRequest struct {
+	Imsi     string `json:"imsi"`
+	Code     string `json:"code"`               // service code, e.g. *100#
+	Language string `json:"language,omitempty"` // en when omitted
+}
+
+type USSDReply struct {
+	CallID string `json:"callID"`
+	Text   string `json:"text"`
+}
+
+type USSDExchange struct {
+	Direction string `json:"direction"`
+	Text      string `json:"text"`
+	Time      string `json:"time"`
+}
+
+type USSDSession struct {
+	CallID    string         `json:"callID"`
+	Imsi      string         `json:"imsi"`
+	Code      string         `json:"code"`
+	State     string         `json:"state"`
+	Prompt    bool           `json:"prompt"` // the network awaits an answer
+	Error     string         `json:"error,omitempty"`
+	Exchanges []USSDExchange `json:"exchanges"`
+}
+
+type ussdEvent struct {
+	USSD USSDSession `json:"ussd"`
+}
+
+// ussdData is the application/vnd.3gpp.ussd+xml body (TS 24.390 section 7)
+type ussdData struct {
+	XMLName    xml.Name `xml:"ussd-data"`
+	Language   string   `xml:"language,omitempty"`
+	USSDString string   `xml:"ussd-string,omitempty"`
+	ErrorCode  int      `xml:"error-code,omitempty"`
+	AnyExt     *ussdExt `xml:"anyExt,omitempty"`
+}
+
+type ussdExt struct {
+	Request *struct{} `xml:"UnstructuredSS-Request"`
+	Notify  *struct{} `xml:"UnstructuredSS-Notify"`
+}
+
+type ussdDialog struct {
+	mu       sync.Mutex
+	language string
+	USSDSession
+}
+
+type ussdStore struct {
+	mu     sync.Mutex
+	order  []string
+	byCall map[string]*ussdDialog
+}
+
+var ussdDialogs = &ussdStore{byCall: make(map[string]*ussdDialog)}
+
+func (st *ussdStore) add(dlg *ussdDialog) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.order = append(st.order, dlg.CallID)
+	st.byCall[dlg.CallID] = dlg
+	if len(st.order) > ussdMaxDialogs {
+		delete(st.byCall, st.order[0])
+		st.order = st.order[1:]
+	}
+}
+
+// update changes the dialogue under its lock and pushes it to the portal
+func (dlg *ussdDialog) update(fn func(*ussdDialog)) USSDSession {
+	dlg.mu.Lock()
+	fn(dlg)
+	snap := dlg.snapshot()
+	dlg.mu.Unlock()
+	WriteJSONToWebSocket(ussdEvent{USSD: snap})
+	return snap
+}
+
+func (dlg *ussdDialog) snapshot() USSDSession {
+	snap := dlg.USSDSession
+	snap.Exchanges = append([]USSDExchange(nil), dlg.Exchanges...)
+	return snap
+}
+
+func (dlg *ussdDialog) addExchange(dir Direction, text string) {
+	dlg.Exchanges = append(dlg.Exchanges, USSDExchange{Direction: dir.String(), Text: text, Time: time.Now().UTC().Format(DicTFs[JsonDateTimeMS])})
+}
+
+// GetUSSD returns the USSI session, or all of them when callID is empty
+func GetUSSD(callID string) ([]USSDSession, error) {
+	ussdDialogs.mu.Lock()
+	dlgs := make([]*ussdDialog, 0, len(ussdDialogs.order))
+	for _, cid := range ussdDialogs.order {
+		if callID == "" || cid == callID {
+			dlgs = append(dlgs, ussdDialogs.byCall[cid])
+		}
+	}
+	ussdDialogs.mu.Unlock()
+	if callID != "" && len(dlgs) == 0 {
+		return nil, fmt.Errorf("USSD session not found: %w", ErrCallNotFound)
+	}
+	sessions := make([]USSDSession, 0, len(dlgs))
+	for _, dlg := range dlgs {
+		dlg.mu.Lock()
+		sessions = append(sessions, dlg.snapshot())
+		dlg.mu.Unlock()
+	}
+	return sessions, nil
+}
+
+// StartUSSD sends the service code in an INVITE - network menus and results are pushed on the websocket
+func StartUSSD(req USSDRequest) (USSDSession, error) {
+	ue := UEs.GetUE(req.Imsi)
+	if ue == nil {
+		return USSDSession{}, ErrUENotFound
+	}
+	if PCSCFSocket == nil {
+		return USSDSession{}, errors.New("missing P-CSCF socket")
+	}
+	code := strings.TrimSpace(req.Code)
+	if code == "" || strings.ContainsFunc(code, func(r rune) bool { return !strings.ContainsRune("0123456789*#", r) }) {
+		return USSDSession{}, fmt.Errorf("%w: invalid service code [%s]", ErrInvalidRequest, req.Code)
+	}
+	lang := req.Language
+	if lang == "" {
+		lang = ussdLanguage
+	}
+
+	ss := NewSS(OUTBOUND)
+	ss.SIPUDPListenser, ss.RemoteUDP, ss.SIPTransport = ue.signallingPath()
+	ss.UserEquipment = ue
+	ss.ussd = &ussdDialog{language: lang, USSDSession: USSDSession{Imsi: ue.Imsi, Code: code, State: USSDActive}}
+
+	hdrs := NewSipHeaders()
+	hdrs.AddHeader(P_Access_Network_Info, "IEEE-802.3")
+	hdrs.AddHeader(Supported, "path, "+SupportedOptions)
+	hdrs.AddHeader(Recv_Info, ussdInfoPackage)
+	hdrs.AddHeader(Accept, fmt.Sprintf("%s, %s", DicBodyContentType[SDP], DicBodyContentType[VndUSSDXML]))
+	hdrs.AddHeader(Accept_Contact, `*;+g.3gpp.icsi-ref="urn%3Aurn-7%3A3gpp-service.ims.icsi.mmtel"`)
+	ue.addSecAgreeHeaders(&hdrs, false)
+	hdrs.AddHeader(Contact, fmt.Sprintf(`<sip:%s@%s%s>;+g.3gpp.icsi-ref="urn%%3Aurn-7%%3A3gpp-service.ims.icsi.mmtel"`, ue.Imsi, ue.contactSocket(), ue.transportParam()))
+	hdrs.AddHeader(Authorization, ue.InvAuth)
+
+	ss.initMediaParameters()
+	ss.buildSDPOffer(false)
+
+	ussdpart := NewContentPart(VndUSSDXML, ussdBody(lang, code))
+	ussdpart.Headers.AddHeader(Content_Disposition, "render;handling=optional")
+	body := MessageBody{PartsContents: map[BodyType]ContentPart{
+		SDP:        NewContentPart(SDP, ss.LocalSDP.Bytes()),
+		VndUSSDXML: ussdpart,
+	}}
+
+	frm := ue.MsIsdn
+	if frm == "N/A" {
+		frm = ue.Imsi
+	}
+
+	trans := ss.CreateSARequest(RequestPack{Method: INVITE, Max70: true, RUriUP: strings.ReplaceAll(code, "#", "%23"), FromUP: frm, CustomHeaders: hdrs}, body)
+
+	ss.ussd.CallID = ss.CallID
+	ss.ussd.addExchange(OUTBOUND, code)
+	ussdDialogs.add(ss.ussd)
+
+	ss.SetState(state.BeingEstablished)
+	ss.AddMe()
+	ss.SendSTMessage(trans)
+	system.LogInfo(system.LTSIPStack, fmt.Sprintf("UE [%s] - USSD session [%s] started with [%s]", ue.Imsi, ss.CallID, code))
+	return ss.ussd.update(func(*ussdDialog) {}), nil
+}
+
+// ReplyUSSD answers the menu of the network in an INFO
+func ReplyUSSD(req USSDReply) error {
+	ss, ok := findCall(req.CallID)
+	if !ok || ss.ussd == nil {
+		return fmt.Errorf("USSD session not found: %w", ErrCallNotFound)
+	}
+	if !ss.IsEstablished() {
+		return errors.New("USSD session not established")
+	}
+	if req.Text == "" {
+		return fmt.Errorf("%w: empty answer", ErrInvalidRequest)
+	}
+	dlg := ss.ussd
+	dlg.mu.Lock()
+	lang := dlg.language
+	dlg.mu.Unlock()
+
+	hdrs := NewSipHeaders()
+	hdrs.AddHeader(Info_Package, ussdInfoPackage)
+	ss.SendRequestDetailed(RequestPack{Method: INFO, CustomHeaders: hdrs}, nil,
+		MessageBody{PartsContents: map[BodyType]ContentPart{VndUSSDXML: {Bytes: ussdBody(lang, req.Text)}}})
+	dlg.update(func(d *ussdDialog) {
+		d.Prompt = false
+		d.addExchange(OUTBOUND, req.Text)
+	})
+	return nil
+}
+
+// EndUSSD releases the USSI session with BYE - or CANCEL while not yet answered
+func EndUSSD(callID string) error {
+	ss, ok := findCall(callID)
+	if !ok || ss.ussd == nil {
+		return fmt.Errorf("USSD session not found: %w", ErrCallNotFound)
+	}
+	if ss.ReleaseMe("USSD session ended") || ss.CancelMe(-1, "") {
+		return nil
+	}
+	return errors.New("USSD session not active")
+}
+
+func ussdBody(lang, text string) []byte {
+	bytes, _ := xml.Marshal(ussdData{Language: lang, USSDString: text})
+	return append([]byte(xml.Header), bytes...)
+}
+
+// ussdReceived records the USSD string carried by the 200 OK to the INVITE or by the BYE, if any
+func (ss *SipSession) ussdReceived(sipmsg *SipMessage) {
+	if ss.ussd == nil {
+		return
+	}
+	if bytes, ok := sipmsg.GetBodyPart(VndUSSDXML); ok {
+		ss.applyUSSDData(bytes)
+	}
+}
+
+// processUSSDInfo handles an INFO of the g.3gpp.ussd info package
+func (ss *SipSession) processUSSDInfo(trans *Transaction, sipmsg *SipMessage, bytes []byte) {
+	if ss.ussd == nil || !strings.EqualFold(strings.TrimSpace(sipmsg.Headers.ValueHeader(Info_Package)), ussdInfoPackage) {
+		ss.SendResponse(trans, status.BadInfoPackage, EmptyBody())
+		return
+	}
+	if !ss.applyUSSDData(bytes) {
+		ss.SendResponseDetailed(trans, NewResponsePackRFWarning(status.BadRequest, "", "Invalid USSD data"), EmptyBody())
+		return
+	}
+	ss.SendResponse(trans, status.OK, EmptyBody())
+}
+
+func (ss *SipSession) applyUSSDData(bytes []byte) bool {
+	var data ussdData
+	if err := xml.Unmarshal(bytes, &data); err != nil {
+		system.LogWarning(system.LTSIPStack, fmt.Sprintf("Call [%s] - Invalid USSD data: %v", ss.CallID, err))
+		return false
+	}
+	ss.ussd.update(func(d *ussdDialog) {
+		if data.Language != "" {
+			d.language = data.Language
+		}
+		if data.USSDString != "" {
+			d.addExchange(INBOUND, data.USSDString)
+		}
+		if data.ErrorCode != 0 {
+			d.Error = fmt.Sprintf("USSD error code %d", data.ErrorCode)
+		}
+		d.Prompt = data.AnyExt != nil && data.AnyExt.Request != nil
+	})
+	return true
+}
+
+// ussdFailed records the final response rejecting the INVITE
+func (ss *SipSession) ussdFailed(sc int) {
+	if ss.ussd == nil {
+		return
+	}
+	ss.ussd.update(func(d *ussdDialog) {
+		d.State = USSDFailed
+		d.Error = fmt.Sprintf("SIP %d %s", sc, DicResponse[sc])
+	})
+}
+
+// ussdClosed concludes the USSI session once disposed
+func (ss *SipSession) ussdClosed() {
+	if ss.ussd == nil {
+		return
+	}
+	answered := !ss.AnswerTime.IsZero()
+	go ss.ussd.update(func(d *ussdDialog) {
+		d.Prompt = false
+		switch {
+		case d.State != USSDActive:
+		case answered:
+			d.State = USSDEnded
+		default:
+			d.State = USSDFailed
+			d.Error = cmp.Or(d.Error, "No final response")
+		}
+	})
+}
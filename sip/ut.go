@@ -0,0 +1,105 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	. "sipclientgo/global"
+	"sipclientgo/system"
+	"sipclientgo/xcap"
+)
+
+// Ut interface (3GPP TS 24.623) - the UE reads and updates its supplementary services in the simservs document over XCAP
+
+type utAuthorizer struct {
+	ue *UserEquipment
+}
+
+func (ua utAuthorizer) Authorization(method, uri string) string {
+	ue := ua.ue
+	ue.authMu.Lock()
+	defer ue.authMu.Unlock()
+	if ue.utAuth == nil {
+		return ""
+	}
+	return ue.utAuth.authorization(method, uri)
+}
+
+func (ua utAuthorizer) Challenge(wwwauth string) error {
+	ac, err := parseDigestChallenge(wwwauth)
+	if err != nil {
+		return err
+	}
+	ue := ua.ue
+	ue.authMu.Lock()
+	defer ue.authMu.Unlock()
+	ue.utAuth = ac
+	if _, err := ue.solveChallenge(ac); err != nil {
+		ue.utAuth = nil
+		return err
+	}
+	return nil
+}
+
+// xcapClient returns the XCAP client of the UE - the user identity is its MSISDN when known, its IMSI otherwise
+func (ue *UserEquipment) xcapClient() (*xcap.Client, error) {
+	if XCAPRoot == "" {
+		return nil, errors.New("missing XCAP root")
+	}
+	usr := ue.MsIsdn
+	if usr == "N/A" || usr == "" {
+		usr = ue.Imsi
+	}
+	impu := fmt.Sprintf("sip:%s@%s", usr, ImsDomain)
+	return &xcap.Client{Root: XCAPRoot, XUI: impu, Identity: impu, Auth: utAuthorizer{ue}}, nil
+}
+
+// GetSimServs fetches the supplementary services of the UE
+func GetSimServs(imsi string) (*xcap.SimServs, error) {
+	ue := UEs.GetUE(imsi)
+	if ue == nil {
+		return nil, ErrUENotFound
+	}
+	client, err := ue.xcapClient()
+	if err != nil {
+		return nil, err
+	}
+	doc, _, err := client.Get()
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return &xcap.SimServs{}, nil
+	}
+	return xcap.Parse(doc)
+}
+
+// SetSimServs updates the services set in changes and returns all the services of the UE
+// the document is read, modified and written back conditionally - serialised per UE
+func SetSimServs(imsi string, changes xcap.SimServs) (*xcap.SimServs, error) {
+	ue := UEs.GetUE(imsi)
+	if ue == nil {
+		return nil, ErrUENotFound
+	}
+	client, err := ue.xcapClient()
+	if err != nil {
+		return nil, err
+	}
+	ue.utMu.Lock()
+	defer ue.utMu.Unlock()
+	doc, etag, err := client.Get()
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		doc = xcap.EmptyDocument()
+	}
+	doc, err = xcap.Apply(doc, &changes)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.Put(doc, etag); err != nil {
+		return nil, err
+	}
+	system.LogInfo(system.LTConfiguration, fmt.Sprintf("UE [%s] - Supplementary services updated at [%s]", ue.Imsi, client.DocumentURL()))
+	return xcap.Parse(doc)
+}
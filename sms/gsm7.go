@@ -0,0 +1,108 @@
+package sms
+
+import "strings"
+
+// GSM 7-bit default alphabet and extension table (3GPP TS 23.038 section 6.2.1)
+
+const gsm7Escape = 0x1B
+
+var (
+	gsm7Basic = []rune("@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞ\x1bÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà")
+
+	gsm7Extension = map[byte]rune{
+		0x0A: '\f',
+		0x14: '^',
+		0x28: '{',
+		0x29: '}',
+		0x2F: '\\',
+		0x3C: '[',
+		0x3D: '~',
+		0x3E: ']',
+		0x40: '|',
+		0x65: '€',
+	}
+
+	gsm7BasicIndex     = make(map[rune]byte, len(gsm7Basic))
+	gsm7ExtensionIndex = make(map[rune]byte, len(gsm7Extension))
+)
+
+func init() {
+	for i, r := range gsm7Basic {
+		if i != gsm7Escape {
+			gsm7BasicIndex[r] = byte(i)
+		}
+	}
+	for k, r := range gsm7Extension {
+		gsm7ExtensionIndex[r] = k
+	}
+}
+
+// EncodeGSM7 maps the text to septets - extension characters take two - false if a character is not in the alphabet
+func EncodeGSM7(text string) ([]byte, bool) {
+	septets := make([]byte, 0, len(text))
+	for _, r := range text {
+		if s, ok := gsm7BasicIndex[r]; ok {
+			septets = append(septets, s)
+		} else if s, ok := gsm7ExtensionIndex[r]; ok {
+			septets = append(septets, gsm7Escape, s)
+		} else {
+			return nil, false
+		}
+	}
+	return septets, true
+}
+
+// DecodeGSM7 maps the septets back to text - unknown extension characters are shown as spaces
+func DecodeGSM7(septets []byte) string {
+	var sb strings.Builder
+	for i := 0; i < len(septets); i++ {
+		s := septets[i] & 0x7F
+		if s != gsm7Escape {
+			sb.WriteRune(gsm7Basic[s])
+			continue
+		}
+		i++
+		if i == len(septets) {
+			break
+		}
+		if r, ok := gsm7Extension[septets[i]&0x7F]; ok {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteByte(' ')
+		}
+	}
+	return sb.String()
+}
+
+// PackSeptets packs the septets least significant bit first, after fill bits aligning them on a septet boundary
+func PackSeptets(septets []byte, fill int) []byte {
+	out := make([]byte, (fill+7*len(septets)+7)/8)
+	pos := fill
+	for _, s := range septets {
+		idx, sh := pos/8, pos%8
+		out[idx] |= s << sh
+		if sh > 1 {
+			out[idx+1] |= s >> (8 - sh)
+		}
+		pos += 7
+	}
+	return out
+}
+
+// UnpackSeptets extracts count septets following the fill bits
+func UnpackSeptets(data []byte, count, fill int) []byte {
+	septets := make([]byte, 0, count)
+	for i := range count {
+		pos := fill + 7*i
+		idx, sh := pos/8, pos%8
+		if idx >= len(data) {
+			break
+		}
+		s := data[idx] >> sh
+		if sh > 1 && idx+1 < len(data) {
+			s |= data[idx+1] << (8 - sh)
+		}
+		septets = append(septets, s&0x7F)
+	}
+	return septets
+}
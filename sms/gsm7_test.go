@@ -0,0 +1,103 @@
+package sms
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestGSM7RoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		septets int
+		ok      bool
+	}{
+		{"basic", "Hello @ £5", 10, true},
+		{"extension", "[€]", 6, true},
+		{"newline", "a\nb", 3, true},
+		{"not in alphabet", "naïve", 0, false},
+		{"emoji", "hi 😀", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			septets, ok := EncodeGSM7(tt.text)
+			if ok != tt.ok {
+				t.Fatalf("EncodeGSM7 ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if len(septets) != tt.septets {
+				t.Errorf("septets = %d, want %d", len(septets), tt.septets)
+			}
+			if got := DecodeGSM7(septets); got != tt.text {
+				t.Errorf("DecodeGSM7 = %q, want %q", got, tt.text)
+			}
+		})
+	}
+}
+
+func TestDecodeGSM7Escape(t *testing.T) {
+	tests := []struct {
+		name    string
+		septets []byte
+		want    string
+	}{
+		{"unknown extension", []byte{0x61, gsm7Escape, 0x01}, "a "},
+		{"trailing escape", []byte{0x61, gsm7Escape}, "a"},
+		{"eighth bit ignored", []byte{0xE1}, "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DecodeGSM7(tt.septets); got != tt.want {
+				t.Errorf("DecodeGSM7 = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPackSeptets(t *testing.T) {
+	hello, _ := EncodeGSM7("hellohello")
+	tests := []struct {
+		name    string
+		septets []byte
+		fill    int
+		want    string
+	}{
+		{"TS 23.038 example", hello, 0, "e8329bfd4697d9ec37"},
+		{"single", []byte{0x7F}, 0, "7f"},
+		{"fill after 6 octet header", []byte{0x41}, 1, "82"},
+		{"empty", nil, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packed := PackSeptets(tt.septets, tt.fill)
+			if got := hex.EncodeToString(packed); got != tt.want {
+				t.Fatalf("PackSeptets = %s, want %s", got, tt.want)
+			}
+			if got := UnpackSeptets(packed, len(tt.septets), tt.fill); !bytes.Equal(got, tt.septets) {
+				t.Errorf("UnpackSeptets = %x, want %x", got, tt.septets)
+			}
+		})
+	}
+}
+
+func TestUnpackSeptetsLengths(t *testing.T) {
+	for n := 1; n <= 16; n++ {
+		for fill := range 7 {
+			septets, _ := EncodeGSM7(strings.Repeat("z", n))
+			packed := PackSeptets(septets, fill)
+			if want := (fill + 7*n + 7) / 8; len(packed) != want {
+				t.Errorf("n %d fill %d: packed %d octets, want %d", n, fill, len(packed), want)
+			}
+			if got := UnpackSeptets(packed, n, fill); !bytes.Equal(got, septets) {
+				t.Errorf("n %d fill %d: UnpackSeptets = %x, want %x", n, fill, got, septets)
+			}
+		}
+	}
+	if got := UnpackSeptets([]byte{0x41}, 5, 0); len(got) != 2 {
+		t.Errorf("truncated data: %d septets, want 2", len(got))
+	}
+}
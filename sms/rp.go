@@ -0,0 +1,141 @@
+package sms
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SM-RL (3GPP TS 24.011 section 7.3) - RP messages carried in SIP MESSAGE bodies (3GPP TS 24.341)
+
+const (
+	RPDataMS   byte = 0x00
+	RPDataNet  byte = 0x01
+	RPAckMS    byte = 0x02
+	RPAckNet   byte = 0x03
+	RPErrorMS  byte = 0x04
+	RPErrorNet byte = 0x05
+
+	rpUserDataIEI byte = 0x41
+
+	RPCauseProtocolError byte = 111
+)
+
+var CauseText = map[byte]string{
+	1:   "Unassigned (unallocated) number",
+	8:   "Operator determined barring",
+	10:  "Call barred",
+	21:  "Short message transfer rejected",
+	22:  "Memory capacity exceeded",
+	27:  "Destination out of order",
+	28:  "Unidentified subscriber",
+	29:  "Facility rejected",
+	30:  "Unknown subscriber",
+	38:  "Network out of order",
+	41:  "Temporary failure",
+	42:  "Congestion",
+	47:  "Resources unavailable, unspecified",
+	50:  "Requested facility not subscribed",
+	69:  "Requested facility not implemented",
+	81:  "Invalid short message transfer reference value",
+	95:  "Semantically incorrect message",
+	96:  "Invalid mandatory information",
+	97:  "Message type non-existent or not implemented",
+	98:  "Message not compatible with short message protocol state",
+	99:  "Information element non-existent or not implemented",
+	111: "Protocol error, unspecified",
+	127: "Interworking, unspecified",
+}
+
+type RPMessage struct {
+	MTI         byte
+	MR          byte
+	Originator  string // RP-DATA from the network only
+	Destination string // RP-DATA from the MS only - the service centre
+	Cause       byte   // RP-ERROR only
+	UserData    []byte // the TPDU
+}
+
+// CauseString returns the RP cause with its description
+func (rp *RPMessage) CauseString() string {
+	if txt, ok := CauseText[rp.Cause]; ok {
+		return fmt.Sprintf("%d %s", rp.Cause, txt)
+	}
+	return fmt.Sprintf("%d", rp.Cause)
+}
+
+func (rp *RPMessage) Bytes() ([]byte, error) {
+	data := []byte{rp.MTI & 0x07, rp.MR}
+	switch rp.MTI {
+	case RPDataMS, RPDataNet:
+		for _, num := range []string{rp.Originator, rp.Destination} {
+			if num == "" {
+				data = append(data, 0x00)
+				continue
+			}
+			addr, _, err := encodeAddress(num)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, byte(len(addr)))
+			data = append(data, addr...)
+		}
+		data = append(data, byte(len(rp.UserData)))
+		data = append(data, rp.UserData...)
+	case RPAckMS, RPAckNet, RPErrorMS, RPErrorNet:
+		if rp.MTI >= RPErrorMS {
+			data = append(data, 0x01, rp.Cause&0x7F)
+		}
+		if len(rp.UserData) > 0 {
+			data = append(data, rpUserDataIEI, byte(len(rp.UserData)))
+			data = append(data, rp.UserData...)
+		}
+	default:
+		return nil, fmt.Errorf("invalid RP message type [%d]", rp.MTI)
+	}
+	return data, nil
+}
+
+func ParseRP(data []byte) (*RPMessage, error) {
+	if len(data) < 2 {
+		return nil, errors.New("truncated RP message")
+	}
+	rp := &RPMessage{MTI: data[0] & 0x07, MR: data[1]}
+	i := 2
+	switch rp.MTI {
+	case RPDataMS, RPDataNet:
+		var addrs [2]string
+		for k := range addrs {
+			if i >= len(data) || i+1+int(data[i]) > len(data) {
+				return nil, errors.New("truncated RP address")
+			}
+			l := int(data[i])
+			if l > 0 {
+				toa := data[i+1]
+				addrs[k] = decodeSemiOctets(data[i+2 : i+1+l])
+				if toa&0x70 == 0x10 {
+					addrs[k] = "+" + addrs[k]
+				}
+			}
+			i += 1 + l
+		}
+		rp.Originator, rp.Destination = addrs[0], addrs[1]
+		if i >= len(data) || i+1+int(data[i]) > len(data) {
+			return nil, errors.New("truncated RP user data")
+		}
+		rp.UserData = data[i+1 : i+1+int(data[i])]
+	case RPAckMS, RPAckNet, RPErrorMS, RPErrorNet:
+		if rp.MTI >= RPErrorMS {
+			if i >= len(data) || data[i] == 0 || i+1+int(data[i]) > len(data) {
+				return nil, errors.New("missing RP cause")
+			}
+			rp.Cause = data[i+1] & 0x7F
+			i += 1 + int(data[i])
+		}
+		if i+1 < len(data) && data[i] == rpUserDataIEI && i+2+int(data[i+1]) <= len(data) {
+			rp.UserData = data[i+2 : i+2+int(data[i+1])]
+		}
+	default:
+		return nil, fmt.Errorf("invalid RP message type [%d]", rp.MTI)
+	}
+	return rp, nil
+}
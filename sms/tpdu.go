@@ -0,0 +1,353 @@
+package sms
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// SM-TL (3GPP TS 23.040) - SMS-SUBMIT built by the UE, SMS-DELIVER and SMS-STATUS-REPORT received from the SC
+
+const (
+	MTIDeliver      byte = 0x00
+	MTISubmit       byte = 0x01
+	MTIStatusReport byte = 0x02
+
+	EncodingGSM7 = "gsm7"
+	EncodingUCS2 = "ucs2"
+	Encoding8Bit = "8bit"
+
+	dcsGSM7 byte = 0x00
+	dcsUCS2 byte = 0x08
+
+	validityPeriod byte = 0xA7 // relative - 24 hours
+
+	gsm7Single = 160 // septets
+	gsm7Part   = 153 // septets after a concatenation header
+	ucs2Single = 70  // UTF-16 units
+	ucs2Part   = 67
+
+	maxParts = 255
+)
+
+// Concat is the concatenation information element of a message part
+type Concat struct {
+	Ref   uint16 `json:"ref"`
+	Total byte   `json:"total"`
+	Seq   byte   `json:"seq"`
+}
+
+type Deliver struct {
+	Originator   string
+	Timestamp    time.Time
+	Encoding     string
+	Text         string
+	Concat       *Concat // nil unless part of a concatenated message
+	StatusReport bool    // the originator asked for a status report
+}
+
+type StatusReport struct {
+	MR        byte
+	Recipient string
+	Timestamp time.Time
+	Discharge time.Time
+	Status    byte
+}
+
+// Delivered reports whether the message reached the recipient - TP-ST 0x00-0x1F
+func (sr *StatusReport) Delivered() bool {
+	return sr.Status <= 0x1F
+}
+
+// TPMTI returns the message type of the TPDU
+func TPMTI(tpdu []byte) byte {
+	if len(tpdu) == 0 {
+		return 0xFF
+	}
+	return tpdu[0] & 0x03
+}
+
+// Submit builds the SMS-SUBMIT TPDUs of the text - GSM 7-bit when possible, UCS-2 otherwise, concatenated when it does not fit
+// in a single message using the reference - the TP-MR (second octet) of each part is left to the caller
+func Submit(dest, text string, ref byte, statusReport bool) ([][]byte, string, error) {
+	if text == "" {
+		return nil, "", errors.New("empty text")
+	}
+	da, digits, err := encodeAddress(dest)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var chunks [][]byte
+	encoding, dcs := EncodingGSM7, dcsGSM7
+	if septets, ok := EncodeGSM7(text); ok {
+		chunks = split(septets, gsm7Single, gsm7Part, func(s []byte, end int) bool { return s[end-1] == gsm7Escape })
+	} else {
+		encoding, dcs = EncodingUCS2, dcsUCS2
+		units := utf16.Encode([]rune(text))
+		var buf []byte
+		for _, u := range units {
+			buf = append(buf, byte(u>>8), byte(u))
+		}
+		// UCS-2 chunks are split on unit pairs, never between the two units of a surrogate pair
+		chunks = split(buf, 2*ucs2Single, 2*ucs2Part, func(s []byte, end int) bool {
+			return end%2 != 0 || (s[end-2] >= 0xD8 && s[end-2] <= 0xDB)
+		})
+	}
+	if len(chunks) > maxParts {
+		return nil, "", fmt.Errorf("text too long - %d parts", len(chunks))
+	}
+
+	first := MTISubmit | 0x10 // relative validity period
+	if statusReport {
+		first |= 0x20
+	}
+	tpdus := make([][]byte, 0, len(chunks))
+	for i, chunk := range chunks {
+		var udh []byte
+		fo := first
+		if len(chunks) > 1 {
+			udh = []byte{0x05, 0x00, 0x03, ref, byte(len(chunks)), byte(i + 1)}
+			fo |= 0x40
+		}
+		tpdu := []byte{fo, 0x00, digits}
+		tpdu = append(tpdu, da...)
+		tpdu = append(tpdu, 0x00, dcs, validityPeriod)
+		if dcs == dcsGSM7 {
+			fill := (7 - len(udh)*8%7) % 7
+			udl := (len(udh)*8+fill)/7 + len(chunk)
+			tpdu = append(tpdu, byte(udl))
+			tpdu = append(tpdu, udh...)
+			tpdu = append(tpdu, PackSeptets(chunk, fill)...)
+		} else {
+			tpdu = append(tpdu, byte(len(udh)+len(chunk)))
+			tpdu = append(tpdu, udh...)
+			tpdu = append(tpdu, chunk...)
+		}
+		tpdus = append(tpdus, tpdu)
+	}
+	return tpdus, encoding, nil
+}
+
+// split cuts the data in chunks of part size when longer than single - shortened while the cut is not allowed
+func split(data []byte, single, part int, badCut func(s []byte, end int) bool) [][]byte {
+	if len(data) <= single {
+		return [][]byte{data}
+	}
+	var chunks [][]byte
+	for len(data) > 0 {
+		end := min(part, len(data))
+		for end < len(data) && end > 1 && badCut(data, end) {
+			end--
+		}
+		chunks = append(chunks, data[:end])
+		data = data[end:]
+	}
+	return chunks
+}
+
+// ParseDeliver decodes an SMS-DELIVER
+func ParseDeliver(tpdu []byte) (*Deliver, error) {
+	if TPMTI(tpdu) != MTIDeliver {
+		return nil, errors.New("not an SMS-DELIVER")
+	}
+	dlv := &Deliver{StatusReport: tpdu[0]&0x20 != 0}
+	oa, i, err := readAddress(tpdu, 1)
+	if err != nil {
+		return nil, err
+	}
+	dlv.Originator = oa
+	if len(tpdu) < i+10 {
+		return nil, errors.New("truncated SMS-DELIVER")
+	}
+	dcs := tpdu[i+1]
+	dlv.Timestamp = decodeTimestamp(tpdu[i+2 : i+9])
+	udl := int(tpdu[i+9])
+	dlv.Encoding, dlv.Text, dlv.Concat, err = decodeUserData(tpdu[i+10:], udl, dcs, tpdu[0]&0x40 != 0)
+	if err != nil {
+		return nil, err
+	}
+	return dlv, nil
+}
+
+// ParseStatusReport decodes an SMS-STATUS-REPORT
+func ParseStatusReport(tpdu []byte) (*StatusReport, error) {
+	if TPMTI(tpdu) != MTIStatusReport || len(tpdu) < 3 {
+		return nil, errors.New("not an SMS-STATUS-REPORT")
+	}
+	sr := &StatusReport{MR: tpdu[1]}
+	ra, i, err := readAddress(tpdu, 2)
+	if err != nil {
+		return nil, err
+	}
+	sr.Recipient = ra
+	if len(tpdu) < i+15 {
+		return nil, errors.New("truncated SMS-STATUS-REPORT")
+	}
+	sr.Timestamp = decodeTimestamp(tpdu[i : i+7])
+	sr.Discharge = decodeTimestamp(tpdu[i+7 : i+14])
+	sr.Status = tpdu[i+14]
+	return sr, nil
+}
+
+// dcsAlphabet returns the character set of the data coding scheme (3GPP TS 23.038 section 4)
+func dcsAlphabet(dcs byte) string {
+	switch {
+	case dcs&0x80 == 0: // general data coding
+		switch dcs & 0x0C {
+		case 0x04:
+			return Encoding8Bit
+		case 0x08:
+			return EncodingUCS2
+		}
+	case dcs&0xF0 == 0xE0: // message waiting indication - UCS-2
+		return EncodingUCS2
+	case dcs&0xF0 == 0xF0: // data coding/message class
+		if dcs&0x04 != 0 {
+			return Encoding8Bit
+		}
+	}
+	return EncodingGSM7
+}
+
+// decodeUserData returns the text of TP-UD and the concatenation element of its header, if any
+func decodeUserData(ud []byte, udl int, dcs byte, udhi bool) (string, string, *Concat, error) {
+	enc := dcsAlphabet(dcs)
+	var concat *Concat
+	hdrLen := 0
+	if udhi {
+		if len(ud) == 0 || len(ud) < int(ud[0])+1 {
+			return "", "", nil, errors.New("truncated user data header")
+		}
+		hdrLen = int(ud[0]) + 1
+		concat = parseConcat(ud[1:hdrLen])
+	}
+	if enc != EncodingGSM7 {
+		if udl > len(ud) || udl < hdrLen {
+			return "", "", nil, errors.New("invalid user data length")
+		}
+		data := ud[hdrLen:udl]
+		if enc == Encoding8Bit {
+			return enc, fmt.Sprintf("%X", data), concat, nil
+		}
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		}
+		return enc, string(utf16.Decode(units)), concat, nil
+	}
+	fill := (7 - hdrLen*8%7) % 7
+	hdrSeptets := (hdrLen*8 + fill) / 7
+	if udl < hdrSeptets || len(ud) < (udl*7+7)/8 {
+		return "", "", nil, errors.New("invalid user data length")
+	}
+	return enc, DecodeGSM7(UnpackSeptets(ud[hdrLen:], udl-hdrSeptets, fill)), concat, nil
+}
+
+// parseConcat finds the 8 or 16 bit reference concatenation element of the header
+func parseConcat(hdr []byte) *Concat {
+	for i := 0; i+1 < len(hdr); i += 2 + int(hdr[i+1]) {
+		iei, l := hdr[i], int(hdr[i+1])
+		if i+2+l > len(hdr) {
+			break
+		}
+		ie := hdr[i+2 : i+2+l]
+		switch {
+		case iei == 0x00 && l == 3:
+			return &Concat{Ref: uint16(ie[0]), Total: ie[1], Seq: ie[2]}
+		case iei == 0x08 && l == 4:
+			return &Concat{Ref: uint16(ie[0])<<8 | uint16(ie[1]), Total: ie[2], Seq: ie[3]}
+		}
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// addresses and time stamps
+
+// encodeAddress returns the type of number followed by the semi-octets of the number and its digit count
+func encodeAddress(number string) ([]byte, byte, error) {
+	toa := byte(0x81) // unknown type, ISDN numbering plan
+	if n, ok := strings.CutPrefix(number, "+"); ok {
+		toa, number = 0x91, n
+	}
+	if number == "" || len(number) > 20 {
+		return nil, 0, fmt.Errorf("invalid address [%s]", number)
+	}
+	bcd := make([]byte, 0, 1+(len(number)+1)/2)
+	bcd = append(bcd, toa)
+	for i := 0; i < len(number); i += 2 {
+		lo, ok := bcdDigit(number[i])
+		if !ok {
+			return nil, 0, fmt.Errorf("invalid address [%s]", number)
+		}
+		hi := byte(0x0F)
+		if i+1 < len(number) {
+			if hi, ok = bcdDigit(number[i+1]); !ok {
+				return nil, 0, fmt.Errorf("invalid address [%s]", number)
+			}
+		}
+		bcd = append(bcd, hi<<4|lo)
+	}
+	return bcd, byte(len(number)), nil
+}
+
+func bcdDigit(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c == '*':
+		return 0x0A, true
+	case c == '#':
+		return 0x0B, true
+	}
+	return 0, false
+}
+
+// decodeSemiOctets returns the digits up to the filler nibble
+func decodeSemiOctets(bcd []byte) string {
+	const digits = "0123456789*#abc"
+	var sb strings.Builder
+	for _, b := range bcd {
+		for _, n := range []byte{b & 0x0F, b >> 4} {
+			if n == 0x0F {
+				return sb.String()
+			}
+			sb.WriteByte(digits[n])
+		}
+	}
+	return sb.String()
+}
+
+// readAddress decodes the TP address at the offset and returns the offset following it
+func readAddress(tpdu []byte, i int) (string, int, error) {
+	if len(tpdu) < i+2 {
+		return "", 0, errors.New("truncated address")
+	}
+	digits, toa := int(tpdu[i]), tpdu[i+1]
+	end := i + 2 + (digits+1)/2
+	if len(tpdu) < end {
+		return "", 0, errors.New("truncated address")
+	}
+	val := tpdu[i+2 : end]
+	switch toa & 0x70 {
+	case 0x50: // alphanumeric - GSM 7-bit packed
+		return DecodeGSM7(UnpackSeptets(val, digits*4/7, 0)), end, nil
+	case 0x10:
+		return "+" + decodeSemiOctets(val), end, nil
+	}
+	return decodeSemiOctets(val), end, nil
+}
+
+// decodeTimestamp decodes the 7 semi-octet time stamp - the time zone is in quarters of an hour
+func decodeTimestamp(b []byte) time.Time {
+	swap := func(x byte) int { return int(x&0x0F)*10 + int(x>>4) }
+	tz := int(b[6]&0x07)*10 + int(b[6]>>4)
+	if b[6]&0x08 != 0 {
+		tz = -tz
+	}
+	loc := time.FixedZone("", tz*15*60)
+	return time.Date(2000+swap(b[0]), time.Month(swap(b[1])), swap(b[2]), swap(b[3]), swap(b[4]), swap(b[5]), 0, loc)
+}
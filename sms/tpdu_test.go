@@ -0,0 +1,150 @@
+package sms
+
+import (
+	"strings"
+	"testing"
+)
+
+// toDeliver turns an SMS-SUBMIT into the SMS-DELIVER the recipient would get from the SC - same PID, DCS and user data
+func toDeliver(t *testing.T, submit []byte, originator []byte) []byte {
+	t.Helper()
+	daEnd := 4 + (int(submit[2])+1)/2
+	if len(submit) < daEnd+4 {
+		t.Fatalf("truncated SMS-SUBMIT %x", submit)
+	}
+	fo := MTIDeliver | submit[0]&0x40 // UDHI
+	if submit[0]&0x20 != 0 {
+		fo |= 0x20 // status report request becomes status report indication
+	}
+	pid, dcs := submit[daEnd], submit[daEnd+1]
+	ud := submit[daEnd+3:] // after the relative validity period - UDL first
+	dlv := append([]byte{fo}, originator...)
+	dlv = append(dlv, pid, dcs)
+	dlv = append(dlv, 0x52, 0x10, 0x71, 0x21, 0x43, 0x65, 0x00) // 2025-01-17 12:34:56 UTC
+	return append(dlv, ud...)
+}
+
+func TestSubmitDeliverRoundTrip(t *testing.T) {
+	oa := []byte{0x0B, 0x91, 0x94, 0x71, 0x10, 0x32, 0x54, 0xF6} // +49170123456
+	tests := []struct {
+		name     string
+		text     string
+		encoding string
+		parts    []int // characters of each part
+	}{
+		{"single GSM 7-bit", "Hello world", EncodingGSM7, []int{11}},
+		{"full GSM 7-bit", strings.Repeat("a", 160), EncodingGSM7, []int{160}},
+		{"concatenated GSM 7-bit", strings.Repeat("b", 161), EncodingGSM7, []int{153, 8}},
+		{"escape kept whole at the split", strings.Repeat("c", 152) + "€" + strings.Repeat("d", 9), EncodingGSM7, []int{152, 10}},
+		{"escape before the split", strings.Repeat("c", 151) + "€" + strings.Repeat("d", 10), EncodingGSM7, []int{152, 10}},
+		{"single UCS-2", "Привет", EncodingUCS2, []int{6}},
+		{"full UCS-2", strings.Repeat("й", 70), EncodingUCS2, []int{70}},
+		{"concatenated UCS-2", strings.Repeat("й", 71), EncodingUCS2, []int{67, 4}},
+		{"surrogate pair kept whole at the split", strings.Repeat("й", 66) + "😀" + strings.Repeat("й", 5), EncodingUCS2, []int{66, 6}},
+		{"surrogate pair before the split", strings.Repeat("й", 65) + "😀" + strings.Repeat("й", 6), EncodingUCS2, []int{66, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpdus, enc, err := Submit("+4917099", tt.text, 0x2A, true)
+			if err != nil {
+				t.Fatalf("Submit: %v", err)
+			}
+			if enc != tt.encoding {
+				t.Errorf("encoding = %s, want %s", enc, tt.encoding)
+			}
+			if len(tpdus) != len(tt.parts) {
+				t.Fatalf("parts = %d, want %d", len(tpdus), len(tt.parts))
+			}
+			var sb strings.Builder
+			for i, tpdu := range tpdus {
+				if TPMTI(tpdu) != MTISubmit {
+					t.Fatalf("part %d: TP-MTI = %d, want SMS-SUBMIT", i+1, TPMTI(tpdu))
+				}
+				dlv, err := ParseDeliver(toDeliver(t, tpdu, oa))
+				if err != nil {
+					t.Fatalf("part %d: ParseDeliver: %v", i+1, err)
+				}
+				if dlv.Originator != "+49170123456" || dlv.Encoding != tt.encoding || !dlv.StatusReport {
+					t.Errorf("part %d: originator %s encoding %s status report %v", i+1, dlv.Originator, dlv.Encoding, dlv.StatusReport)
+				}
+				if n := len([]rune(dlv.Text)); n != tt.parts[i] {
+					t.Errorf("part %d: %d characters, want %d", i+1, n, tt.parts[i])
+				}
+				switch {
+				case len(tpdus) == 1 && dlv.Concat != nil:
+					t.Errorf("single part with concatenation %+v", dlv.Concat)
+				case len(tpdus) > 1 && (dlv.Concat == nil || *dlv.Concat != Concat{Ref: 0x2A, Total: byte(len(tpdus)), Seq: byte(i + 1)}):
+					t.Errorf("part %d: concatenation %+v", i+1, dlv.Concat)
+				}
+				sb.WriteString(dlv.Text)
+			}
+			if sb.String() != tt.text {
+				t.Errorf("text = %q, want %q", sb.String(), tt.text)
+			}
+		})
+	}
+}
+
+func TestSubmitInvalid(t *testing.T) {
+	tests := []struct {
+		name, dest, text string
+	}{
+		{"empty text", "123", ""},
+		{"empty destination", "", "hi"},
+		{"letters in destination", "12a", "hi"},
+		{"destination too long", strings.Repeat("1", 21), "hi"},
+		{"too many parts", "123", strings.Repeat("x", 153*256)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := Submit(tt.dest, tt.text, 1, false); err == nil {
+				t.Error("Submit succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestParseDeliverMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		tpdu []byte
+	}{
+		{"empty", nil},
+		{"SMS-SUBMIT", []byte{0x01, 0x00}},
+		{"truncated address", []byte{0x00, 0x0B, 0x91, 0x94}},
+		{"truncated header", []byte{0x00, 0x02, 0x81, 0x21, 0x00, 0x00}},
+		{"user data longer than TPDU", []byte{0x00, 0x02, 0x81, 0x21, 0x00, 0x00, 0x52, 0x10, 0x71, 0x21, 0x43, 0x65, 0x00, 0x0A, 0x41}},
+		{"truncated user data header", []byte{0x40, 0x02, 0x81, 0x21, 0x00, 0x08, 0x52, 0x10, 0x71, 0x21, 0x43, 0x65, 0x00, 0x06, 0x05, 0x00}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if dlv, err := ParseDeliver(tt.tpdu); err == nil {
+				t.Errorf("ParseDeliver = %+v, want an error", dlv)
+			}
+		})
+	}
+}
+
+func TestParseStatusReport(t *testing.T) {
+	scts := []byte{0x52, 0x10, 0x71, 0x21, 0x43, 0x65, 0x00}
+	tpdu := append([]byte{0x06, 0x2A, 0x04, 0x81, 0x21, 0x43}, scts...)
+	tpdu = append(tpdu, scts...)
+	for _, tt := range []struct {
+		status    byte
+		delivered bool
+	}{{0x00, true}, {0x1F, true}, {0x20, false}, {0x41, false}} {
+		sr, err := ParseStatusReport(append(tpdu, tt.status))
+		if err != nil {
+			t.Fatalf("ParseStatusReport: %v", err)
+		}
+		if sr.MR != 0x2A || sr.Recipient != "1234" || sr.Delivered() != tt.delivered {
+			t.Errorf("status %#x: MR %d recipient %s delivered %v", tt.status, sr.MR, sr.Recipient, sr.Delivered())
+		}
+		if sr.Timestamp.Year() != 2025 || sr.Discharge.Second() != 56 {
+			t.Errorf("time stamps %v %v", sr.Timestamp, sr.Discharge)
+		}
+	}
+	if _, err := ParseStatusReport(tpdu); err == nil {
+		t.Error("truncated SMS-STATUS-REPORT parsed")
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 
 	"net"
+	"strconv"
 	"strings"
 	"unicode/utf8"
 )
@@ -48,6 +49,23 @@ outer:
 	return IPs, nil
 }
 
+// GetLocalIPv6 returns the first global or unique local IPv6 address - nil when none is configured
+func GetLocalIPv6() net.IP {
+	ifaces, _ := net.Interfaces()
+	for _, i := range ifaces {
+		if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagRunning == 0 {
+			continue
+		}
+		addrs, _ := i.Addrs()
+		for _, addr := range addrs {
+			if v, ok := addr.(*net.IPNet); ok && v.IP.To4() == nil && v.IP.IsGlobalUnicast() {
+				return v.IP
+			}
+		}
+	}
+	return nil
+}
+
 func GetLocalIPv4(getfirst bool) net.IP {
 	fmt.Print("Checking Interfaces...")
 	serverIPs, err := GetLocalIPs()
@@ -129,20 +147,24 @@ func GetUDPortFromConn(conn *net.UDPConn) int {
 }
 
 func BuildUDPAddr(ip string, prt int) (*net.UDPAddr, error) {
-	return net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", ip, prt))
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(ip, strconv.Itoa(prt)))
 }
 
+// BuildUdpAddrSocket parses ip[:port] - IPv6 addresses with a port are enclosed in brackets e.g. [::1]:5060
 func BuildUdpAddrSocket(ipsocket string, defaultport int) (*net.UDPAddr, bool) {
-	part1, part2, ok := strings.Cut(ipsocket, ":")
+	host, part2, err := net.SplitHostPort(ipsocket)
+	if err != nil { // no port
+		host, part2 = strings.TrimSuffix(strings.TrimPrefix(ipsocket, "["), "]"), ""
+	}
 	var prt int
-	if ok {
+	if part2 != "" {
 		prt = Str2Int[int](part2)
 		if prt <= 0 || prt > MaxPort {
 			return nil, false
 		}
 	}
 	prt = cmp.Or(prt, defaultport)
-	ip := net.ParseIP(part1)
+	ip := net.ParseIP(host)
 	if ip == nil {
 		return nil, false
 	}
@@ -150,9 +172,20 @@ func BuildUdpAddrSocket(ipsocket string, defaultport int) (*net.UDPAddr, bool) {
 }
 
 func BuildUDPAddrFromSocketString(sckt string) (*net.UDPAddr, error) {
+	if addr, ok := BuildUdpAddrSocket(sckt, 0); ok && addr.Port != 0 {
+		return addr, nil
+	}
 	return net.ResolveUDPAddr("udp", sckt)
 }
 
+// URIHost returns the IP as used in SIP URI host part - IPv6 references are enclosed in brackets
+func URIHost(ip net.IP) string {
+	if ip.To4() == nil {
+		return "[" + ip.String() + "]"
+	}
+	return ip.String()
+}
+
 func AreUAddrsEqual(addr1, addr2 *net.UDPAddr) bool {
 	if addr1 == nil || addr2 == nil {
 		return addr1 == addr2
@@ -171,17 +204,6 @@ func AreUDPConnsEqual(conn1, conn2 *net.UDPConn) bool {
 	return addr1.String() == addr2.String()
 }
 
-// ============================================================
-
-func GenerateViaWithoutBranch(conn *net.UDPConn) string {
-	udpsocket := GetUDPAddrFromConn(conn)
-	return fmt.Sprintf("SIP/2.0/UDP %s", udpsocket)
-}
-
-func GenerateContact(skt *net.UDPAddr) string {
-	return fmt.Sprintf("<sip:%s;transport=udp>", skt)
-}
-
 // =============================================================
 
 func TrimWithSuffix(s string, sfx string) string {
@@ -2,7 +2,9 @@ package webserver
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"mime"
 	"net"
@@ -13,6 +15,7 @@ import (
 	"sipclientgo/global"
 	"sipclientgo/sip"
 	"sipclientgo/system"
+	"sipclientgo/xcap"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -43,7 +46,21 @@ tryAgain:
 	srv := &http.Server{Addr: ws, Handler: r, ReadTimeout: 5 * time.Second, WriteTimeout: 10 * time.Second, IdleTimeout: 15 * time.Second}
 
 	r.HandleFunc("/api/v1/session", serveSession)
+	r.HandleFunc("/api/v1/session/{callID}/trace", serveSessionTrace)
 	r.HandleFunc("/api/v1/stats", serveStats)
+	r.HandleFunc("/api/v1/scenario", serveScenario)
+	r.HandleFunc("/api/v1/load", serveLoad)
+	r.HandleFunc("/api/v1/cdrs", serveCDRs)
+	r.HandleFunc("/api/v1/pcap", servePcap)
+	r.HandleFunc("/api/v1/recording", serveRecording)
+	r.HandleFunc("/api/v1/playback", servePlayback)
+	r.HandleFunc("/api/v1/dtmf", serveDTMF)
+	r.HandleFunc("/api/v1/transfer", serveTransfer)
+	r.HandleFunc("/api/v1/sms", serveSMS)
+	r.HandleFunc("/api/v1/ussd", serveUSSD)
+	r.HandleFunc("/api/v1/ut", serveUt)
+	r.HandleFunc("/api/v1/media", serveMedia)
+	r.HandleFunc("/api/v1/mrfrepos", serveMRFRepos)
 	r.HandleFunc("/", webHandler)
 
 	global.WtGrp.Add(1)
@@ -129,10 +146,21 @@ func webHandler(w http.ResponseWriter, r *http.Request) {
 			urvalues := r.URL.Query()
 			imsi := urvalues.Get("imsi")
 			cdpn := urvalues.Get("cdpn")
-			if err := sip.UEs.DoCall(imsi, cdpn); err != nil {
+			callID, err := sip.UEs.DoCall(imsi, cdpn, urvalues.Get("preconditions") == "true")
+			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]string{"callID": callID})
+			return
+		} else if r.URL.Path == "/answerPolicy" {
+			urvalues := r.URL.Query()
+			if err := sip.UEs.SetAnswerPolicy(urvalues.Get("imsi"), urvalues.Get("policy")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			saveDataLocally()
 			w.WriteHeader(http.StatusOK)
 			return
 		}
@@ -179,7 +207,8 @@ func handlePortalData(w http.ResponseWriter, r *http.Request) {
 
 func servePortalData(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(buildDataJson()); err != nil {
+	view := portalView{portalData: buildDataJson(), Clients: sip.UEs.GetUEViews()}
+	if err := json.NewEncoder(w).Encode(view); err != nil {
 		http.Error(w, "Error encoding response", http.StatusInternalServerError)
 		return
 	}
@@ -204,7 +233,7 @@ func servePortalPost(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 
-	response := sip.UEs.GetUEs()
+	response := sip.UEs.GetUEViews()
 
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		http.Error(w, "Error encoding response", http.StatusInternalServerError)
@@ -257,6 +286,23 @@ func serveSession(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// serveSessionTrace returns the ordered sent and received SIP messages of a session
+func serveSessionTrace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	trc, ok := sip.GetSessionTrace(r.PathValue("callID"))
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(trc); err != nil {
+		system.LogError(system.LTWebserver, err.Error())
+	}
+}
+
 func serveStats(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -274,12 +320,14 @@ func serveStats(w http.ResponseWriter, r *http.Request) {
 		System          uint64
 		GCCycles        uint32
 		WaitGroupLength int32
+		Load            *sip.LoadStats `json:",omitempty"`
 	}{CPUCount: runtime.NumCPU(),
 		GoRoutinesCount: runtime.NumGoroutine(),
 		Alloc:           BToMB(m.Alloc),
 		System:          BToMB(m.Sys),
 		GCCycles:        m.NumGC,
 		WaitGroupLength: atomic.LoadInt32(&global.WtGrpC),
+		Load:            sip.GetLoadStats(),
 	}
 
 	response, _ := json.Marshal(data)
@@ -289,10 +337,109 @@ func serveStats(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// serveScenario runs a scenario posted in the body (YAML or JSON) or named by file under the scenario directory
+// GET returns all reports or the one given by id
+func serveScenario(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		var response any
+		if id := r.URL.Query().Get("id"); id != "" {
+			rpt, ok := sip.GetScenarioReport(id)
+			if !ok {
+				http.Error(w, "Scenario run not found", http.StatusNotFound)
+				return
+			}
+			response = rpt
+		} else {
+			response = sip.GetScenarioReports()
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			system.LogError(system.LTWebserver, err.Error())
+		}
+	case http.MethodPost:
+		var data []byte
+		var err error
+		if fn := r.URL.Query().Get("file"); fn != "" {
+			data, err = os.ReadFile(filepath.Join(global.ScenarioPath, filepath.Base(fn)))
+		} else {
+			data, err = io.ReadAll(r.Body)
+		}
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sc, err := sip.ParseScenario(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id, err := sip.RunScenario(sc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(map[string]string{"id": id})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveLoad starts (POST with load profile), stops (DELETE) or reports (GET) the load generator
+func serveLoad(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var prfl sip.LoadProfile
+		err := json.NewDecoder(r.Body).Decode(&prfl)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := sip.StartLoad(prfl); err != nil {
+			sc := http.StatusBadRequest
+			if errors.Is(err, sip.ErrLoadRunning) {
+				sc = http.StatusConflict
+			}
+			http.Error(w, err.Error(), sc)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodDelete:
+		if err := sip.StopLoad(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		stats := sip.GetLoadStats()
+		if stats == nil {
+			http.Error(w, "No load run", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			system.LogError(system.LTWebserver, err.Error())
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 type portalData struct {
-	PcscfSocket string               `json:"pcscfSocket"`
-	ImsDomain   string               `json:"imsDomain"`
-	Clients     []*sip.UserEquipment `json:"clients"`
+	PcscfSocket    string               `json:"pcscfSocket"`
+	PcscfTransport string               `json:"pcscfTransport"`
+	ImsDomain      string               `json:"imsDomain"`
+	Clients        []*sip.UserEquipment `json:"clients"`
+}
+
+// portalView is portalData as served to the portal - data.json keeps the UE configuration only
+type portalView struct {
+	portalData
+	Clients []sip.UEView `json:"clients"`
 }
 
 var savemu sync.Mutex
@@ -346,7 +493,17 @@ func loadData(pd *portalData) error {
 		return err
 	}
 
+	transport := global.TransportUDP
+	if pd.PcscfTransport != "" {
+		tp, ok := global.ParseTransport(pd.PcscfTransport)
+		if !ok {
+			return fmt.Errorf("invalid P-CSCF transport: %s", pd.PcscfTransport)
+		}
+		transport = tp
+	}
+
 	global.PCSCFSocket = udpaddr
+	global.PCSCFTransport = transport
 	global.ImsDomain = pd.ImsDomain
 
 	if pd.Clients != nil {
@@ -364,8 +521,9 @@ func buildDataJson() portalData {
 	}
 
 	data := portalData{PcscfSocket: pcscfSocket,
-		ImsDomain: global.ImsDomain,
-		Clients:   sip.UEs.GetUEs(),
+		PcscfTransport: string(global.PCSCFTransport),
+		ImsDomain:      global.ImsDomain,
+		Clients:        sip.UEs.GetUEs(),
 	}
 
 	return data
@@ -424,6 +582,10 @@ func listenToWS(ws *websocket.Conn) {
 
 		fmt.Printf("Source: %s - Received: %v - Type: %s\n", ws.RemoteAddr().String(), string(bytes), msgtypes[msgtype])
 
+		if msgtype == websocket.TextMessage && len(bytes) > 0 && bytes[0] == '{' {
+			handleWSAction(bytes)
+		}
+
 		// Send the received message back to the client
 		// err = ws.WriteJSON(msg)
 		// if err != nil {
@@ -441,3 +603,426 @@ func serveCalls(w http.ResponseWriter) {
 		return
 	}
 }
+
+// serveCDRs returns the call detail records filtered by from/to (RFC 3339 setup time), imsi and result
+func serveCDRs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	qry := r.URL.Query()
+	fltr := sip.CDRFilter{Imsi: qry.Get("imsi"), Result: qry.Get("result")}
+	for prm, tm := range map[string]*time.Time{"from": &fltr.From, "to": &fltr.To} {
+		if v := qry.Get(prm); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s time: %v", prm, err), http.StatusBadRequest)
+				return
+			}
+			*tm = t
+		}
+	}
+
+	cdrs, err := sip.QueryCDRs(fltr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(cdrs); err != nil {
+		system.LogError(system.LTWebserver, err.Error())
+	}
+}
+
+// servePcap starts (POST) or stops (DELETE) the packet capture, or downloads (GET) the global or a per call (callID) capture
+func servePcap(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		fn, ok := sip.CaptureFile(r.URL.Query().Get("callID"))
+		if !ok {
+			http.Error(w, "Capture not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(fn)))
+		http.ServeFile(w, r, fn)
+	case http.MethodPost:
+		fn, err := sip.StartCapture()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]string{"file": fn})
+	case http.MethodDelete:
+		if err := sip.StopCapture(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveRecording lists (GET) or downloads (GET with file) recordings, and starts (POST) or stops (DELETE) recording a call
+func serveRecording(w http.ResponseWriter, r *http.Request) {
+	qry := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		if name := qry.Get("file"); name != "" {
+			fn, ok := sip.RecordingFile(name)
+			if !ok {
+				http.Error(w, "Recording not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "audio/wav")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(fn)))
+			http.ServeFile(w, r, fn)
+			return
+		}
+		lst, err := sip.ListRecordings()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(lst); err != nil {
+			system.LogError(system.LTWebserver, err.Error())
+		}
+	case http.MethodPost:
+		mode := global.RecordingStereo
+		if m := qry.Get("mode"); m != "" {
+			var ok bool
+			if mode, ok = global.ParseRecordingMode(m); !ok || mode == global.RecordingNone {
+				http.Error(w, "Invalid recording mode", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := sip.StartRecording(qry.Get("callID"), mode); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		if err := sip.StopRecording(qry.Get("callID")); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type playbackReply struct {
+	Playback *sip.PlaybackState `json:"playback,omitempty"`
+	Error    string             `json:"playbackError,omitempty"`
+}
+
+// handleWSAction applies playback actions sent by the portal - the result is pushed back over the websocket
+func handleWSAction(bytes []byte) {
+	var req sip.PlaybackRequest
+	if err := json.Unmarshal(bytes, &req); err != nil || req.Action == "" {
+		return
+	}
+	st, err := sip.ControlPlayback(req)
+	if err != nil {
+		global.WriteJSONToWebSocket(playbackReply{Error: err.Error()})
+		return
+	}
+	global.WriteJSONToWebSocket(playbackReply{Playback: st})
+}
+
+// servePlayback returns the playback state of a call (GET with callID) or applies a playback action (POST)
+func servePlayback(w http.ResponseWriter, r *http.Request) {
+	var req sip.PlaybackRequest
+	switch r.Method {
+	case http.MethodGet:
+		req = sip.PlaybackRequest{Action: sip.PlaybackStatus, CallID: r.URL.Query().Get("callID")}
+	case http.MethodPost:
+		err := json.NewDecoder(r.Body).Decode(&req)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st, err := sip.ControlPlayback(req)
+	if err != nil {
+		http.Error(w, err.Error(), callErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		system.LogError(system.LTWebserver, err.Error())
+	}
+}
+
+// callErrorStatus maps the errors of call and UE actions - unknown call or UE, invalid request or a state not allowing the action
+func callErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, sip.ErrCallNotFound), errors.Is(err, sip.ErrUENotFound):
+		return http.StatusNotFound
+	case errors.Is(err, sip.ErrInvalidRequest):
+		return http.StatusBadRequest
+	}
+	return http.StatusConflict
+}
+
+// serveDTMF sends digits on an established call (POST) - they are sent in the background once the request is validated
+func serveDTMF(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req sip.DTMFRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := sip.SendDTMF(req); err != nil {
+		http.Error(w, err.Error(), callErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// serveTransfer refers the peer of an established call (POST) - to a target (blind) or to the peer of a consultation call (attended)
+func serveTransfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req sip.TransferRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := sip.TransferCall(req); err != nil {
+		http.Error(w, err.Error(), callErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// serveSMS lists the sent and received messages (GET, optional imsi) or submits a message (POST) - progress is pushed on the websocket
+func serveSMS(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(sip.ListSMS(r.URL.Query().Get("imsi"))); err != nil {
+			system.LogError(system.LTWebserver, err.Error())
+		}
+	case http.MethodPost:
+		var req sip.SMSRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rec, err := sip.SendSMS(req)
+		if err != nil {
+			http.Error(w, err.Error(), callErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(rec); err != nil {
+			system.LogError(system.LTWebserver, err.Error())
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveUSSD lists the USSI sessions (GET, optional callID), starts one with a service code (POST), answers a network menu (PUT)
+// or ends the session (DELETE callID) - menus and results are pushed on the websocket
+func serveUSSD(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		sessions, err := sip.GetUSSD(r.URL.Query().Get("callID"))
+		if err != nil {
+			http.Error(w, err.Error(), callErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(sessions); err != nil {
+			system.LogError(system.LTWebserver, err.Error())
+		}
+	case http.MethodPost:
+		var req sip.USSDRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ussd, err := sip.StartUSSD(req)
+		if err != nil {
+			http.Error(w, err.Error(), callErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(ussd); err != nil {
+			system.LogError(system.LTWebserver, err.Error())
+		}
+	case http.MethodPut:
+		var req sip.USSDReply
+		err := json.NewDecoder(r.Body).Decode(&req)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := sip.ReplyUSSD(req); err != nil {
+			http.Error(w, err.Error(), callErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodDelete:
+		if err := sip.EndUSSD(r.URL.Query().Get("callID")); err != nil {
+			http.Error(w, err.Error(), callErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveUt reads (GET) or updates (PUT) the supplementary services of the UE (imsi) in its simservs document on the XCAP server
+// only the services present in the PUT body are changed - the resulting services are returned
+func serveUt(w http.ResponseWriter, r *http.Request) {
+	imsi := r.URL.Query().Get("imsi")
+	if sip.UEs.GetUE(imsi) == nil {
+		http.Error(w, "UE not found", http.StatusNotFound)
+		return
+	}
+	var (
+		simservs *xcap.SimServs
+		err      error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		simservs, err = sip.GetSimServs(imsi)
+	case http.MethodPut:
+		var changes xcap.SimServs
+		err = json.NewDecoder(r.Body).Decode(&changes)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		simservs, err = sip.SetSimServs(imsi, changes)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		code := http.StatusBadGateway
+		switch {
+		case errors.Is(err, sip.ErrUENotFound):
+			code = http.StatusNotFound
+		case errors.Is(err, xcap.ErrInvalidSetting):
+			code = http.StatusBadRequest
+		case errors.Is(err, xcap.ErrConflict):
+			code = http.StatusConflict
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(simservs); err != nil {
+		system.LogError(system.LTWebserver, err.Error())
+	}
+}
+
+const maxMediaUpload = 64 << 20
+
+// serveMedia lists (GET), uploads (POST multipart file, optional name), renames (PUT name, newName) or deletes (DELETE name) MRF audio files
+// repo selects the MRF repository - the default one when omitted, a new one is created on upload
+func serveMedia(w http.ResponseWriter, r *http.Request) {
+	qry := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		lst, err := sip.ListMedia(qry.Get("repo"))
+		if err != nil {
+			sc := http.StatusInternalServerError
+			if errors.Is(err, sip.ErrRepoNotFound) {
+				sc = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), sc)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(lst); err != nil {
+			system.LogError(system.LTWebserver, err.Error())
+		}
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, maxMediaUpload)
+		file, hdr, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		name := qry.Get("name")
+		if name == "" {
+			name = hdr.Filename
+		}
+		info, err := sip.SaveMedia(qry.Get("repo"), name, file)
+		if err != nil {
+			system.LogError(system.LTFileUpload, fmt.Sprintf("Failed to upload media file [%s]: %v", name, err))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(info)
+	case http.MethodPut:
+		if err := sip.RenameMedia(qry.Get("repo"), qry.Get("name"), qry.Get("newName")); err != nil {
+			http.Error(w, err.Error(), mediaErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		if err := sip.DeleteMedia(qry.Get("repo"), qry.Get("name")); err != nil {
+			http.Error(w, err.Error(), mediaErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func mediaErrorStatus(err error) int {
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, sip.ErrRepoNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+// serveMRFRepos lists the MRF repositories with their file count and inbound call policy
+func serveMRFRepos(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sip.ListMRFRepos()); err != nil {
+		system.LogError(system.LTWebserver, err.Error())
+	}
+}
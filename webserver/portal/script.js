@@ -1,6 +1,7 @@
 const recordForm = document.getElementById('recordForm');
 const dataTable = document.getElementById('dataTable').getElementsByTagName('tbody')[0];
 const callsTable = document.getElementById('callsTable').getElementsByTagName('tbody')[0];
+const smsTable = document.getElementById('smsTable').getElementsByTagName('tbody')[0];
 const updatebtn = document.getElementById('updatebtn');
 const deleteSelected = document.getElementById('deleteSelected');
 const refresh = document.getElementById('refresh');
@@ -8,12 +9,22 @@ const submitButton = recordForm.querySelector('button[type="submit"]');
 const editData = document.getElementById('editData');
 const saveData = document.getElementById('saveData');
 const pcscfSocket = document.getElementById('pcscfSocket');
+const pcscfTransport = document.getElementById('pcscfTransport');
 const imsDomain = document.getElementById('imsDomain');
 const ringingSound = document.getElementById('ringingSound');
 const ws = new WebSocket(`ws://${location.host}/ws`);
 
 const btnRefreshCalls = document.getElementById('btnRefreshCalls');
 const btnClearCalls = document.getElementById('btnClearCalls');
+const btnClearTrace = document.getElementById('btnClearTrace');
+const btnSendSMS = document.getElementById('btnSendSMS');
+const btnUSSD = document.getElementById('btnUSSD');
+const btnRefreshSMS = document.getElementById('btnRefreshSMS');
+const btnClearSMS = document.getElementById('btnClearSMS');
+const ladder = document.getElementById('ladder');
+const ladderTitle = document.getElementById('ladderTitle');
+
+const ueColumns = ['enabled', 'imsi', 'ki', 'opc', 'msisdn', 'regStatus', 'expires', 'udpPort', 'transport', 'ipFamily', 'secAgree', 'nextRefresh', 'bindingExpiry', 'recording', 'answerPolicy'];
 
 const animationProperty1 = 'flashButton 1s infinite'
 const animationProperty = 'flash 0.5s infinite alternate'
@@ -31,6 +42,7 @@ document.addEventListener('DOMContentLoaded', function () {
     loadData()
     editData.textContent = editData.dataset.actionEdit
     pcscfSocket.disabled = true;
+    pcscfTransport.disabled = true;
     imsDomain.disabled = true;
 });
 
@@ -45,12 +57,14 @@ async function loadData() {
 
     const data = await response.json();
     pcscfSocket.value = data.pcscfSocket;
+    pcscfTransport.value = data.pcscfTransport || 'udp';
     imsDomain.value = data.imsDomain;
     populateTable(data.clients);
 }
 
 function stopEditing() {
     pcscfSocket.disabled = true;
+    pcscfTransport.disabled = true;
     imsDomain.disabled = true;
     saveData.disabled = true;
     editData.textContent = editData.dataset.actionEdit;
@@ -59,6 +73,7 @@ function stopEditing() {
 editData.addEventListener('click', () => {
     if (editData.textContent === editData.dataset.actionEdit) {
         pcscfSocket.disabled = false;
+        pcscfTransport.disabled = false;
         imsDomain.disabled = false;
         saveData.disabled = false;
         editData.textContent = editData.dataset.actionCancel;
@@ -72,6 +87,7 @@ saveData.addEventListener('click', async event => {
 
     const jsonData = {
         pcscfSocket: pcscfSocket.value,
+        pcscfTransport: pcscfTransport.value,
         imsDomain: imsDomain.value
     };
 
@@ -113,7 +129,12 @@ recordForm.addEventListener('submit', async event => {
         ki: document.getElementById('ki').value,
         opc: document.getElementById('opc').value,
         expires: document.getElementById('expires').value,
-        udpPort: udpPortValue
+        udpPort: udpPortValue,
+        transport: document.getElementById('transport').value,
+        ipFamily: document.getElementById('ipFamily').value,
+        secAgree: document.getElementById('secAgree').value,
+        recording: document.getElementById('recording').value,
+        answerPolicy: document.getElementById('answerPolicy').value || 'manual'
     };
 
     if (Object.values(jsonData).some(value => value === "")) {
@@ -158,9 +179,16 @@ function populateTable(data) {
         selectCheckbox.type = 'checkbox';
         selectCell.appendChild(selectCheckbox);
 
-        Object.entries(record).forEach(([key, value]) => {
+        ueColumns.forEach(key => {
+            const value = record[key];
             const newCell = newRow.insertCell();
-            newCell.textContent = key === 'enabled' ? (value ? 'True' : 'False') : value;
+            if (key === 'enabled') newCell.textContent = value ? 'True' : 'False';
+            else if (key === 'secAgree') newCell.textContent = value || 'none';
+            else if (key === 'transport') newCell.textContent = value || 'pcscf';
+            else if (key === 'ipFamily') newCell.textContent = value || 'pcscf';
+            else if (key === 'recording') newCell.textContent = value || 'none';
+            else if (key === 'answerPolicy') newCell.textContent = value || 'manual';
+            else newCell.textContent = value;
         });
 
         const actionCell = newRow.insertCell();
@@ -189,6 +217,18 @@ function populateTable(data) {
         callButton.title = 'Call';
         callButton.addEventListener('click', () => performCall(newRow));
 
+        const policyButton = document.createElement('button');
+        policyButton.classList.add('actions');
+        policyButton.textContent = '🤖';
+        policyButton.title = 'Answer Policy';
+        policyButton.addEventListener('click', () => performAnswerPolicy(newRow));
+
+        const utButton = document.createElement('button');
+        utButton.classList.add('actions');
+        utButton.textContent = '⚙️';
+        utButton.title = 'Supplementary Services';
+        utButton.addEventListener('click', () => performSimServs(newRow));
+
         const deleteButton = document.createElement('button');
         deleteButton.classList.add('actions');
         deleteButton.textContent = '❌';
@@ -199,6 +239,8 @@ function populateTable(data) {
         actionCell.appendChild(regButton);
         actionCell.appendChild(unRegButton);
         actionCell.appendChild(callButton);
+        actionCell.appendChild(policyButton);
+        actionCell.appendChild(utButton);
         actionCell.appendChild(deleteButton);
     });
 }
@@ -218,6 +260,11 @@ updatebtn.addEventListener('click', event => {
     cells[4].textContent = document.getElementById('opc').value;
     cells[7].textContent = document.getElementById('expires').value;
     cells[8].textContent = document.getElementById('udpPort').value;
+    cells[9].textContent = document.getElementById('transport').value;
+    cells[10].textContent = document.getElementById('ipFamily').value;
+    cells[11].textContent = document.getElementById('secAgree').value;
+    cells[14].textContent = document.getElementById('recording').value;
+    cells[15].textContent = document.getElementById('answerPolicy').value;
 })
 
 deleteSelected.addEventListener('click', event => {
@@ -254,6 +301,11 @@ function editRecord(row) {
     // document.getElementById('registration').value = cells[6].textContent;
     document.getElementById('expires').value = cells[7].textContent;
     document.getElementById('udpPort').value = cells[8].textContent;
+    document.getElementById('transport').value = cells[9].textContent;
+    document.getElementById('ipFamily').value = cells[10].textContent;
+    document.getElementById('secAgree').value = cells[11].textContent;
+    document.getElementById('recording').value = cells[14].textContent;
+    document.getElementById('answerPolicy').value = cells[15].textContent;
     // row.remove();
 }
 
@@ -309,6 +361,43 @@ async function performCall(row) {
     if (!response.ok) alert('Error: ' + response.statusText);
 }
 
+async function performAnswerPolicy(row) {
+    const policy = prompt('Answer policy for inbound calls:\nmanual | auto[:delay] | reject[:sip[:q850[:delay]]] | ring | early:audio | announce:audio[:delay]', row.cells[15].textContent);
+    if (policy === null) return;
+    const params = { imsi: row.cells[2].textContent, policy: policy };
+    const queryString = new URLSearchParams(params).toString();
+
+    const response = await fetch(`/answerPolicy?${queryString}`, {
+        method: 'PUT',
+    });
+    if (!response.ok) {
+        alert('Error: ' + await response.text());
+        return;
+    }
+    loadData();
+}
+
+// performSimServs shows the supplementary services of the UE read over Ut - the edited services are written back
+async function performSimServs(row) {
+    const url = `/api/v1/ut?imsi=${encodeURIComponent(row.cells[2].textContent)}`;
+    let response = await fetch(url, { method: 'GET' });
+    if (!response.ok) {
+        alert('Supplementary Services: ' + await response.text());
+        return;
+    }
+    const input = prompt('Supplementary services (clir, cw, cdiv, icb, ocb) - edit to update', JSON.stringify(await response.json()));
+    if (input === null) return;
+    let changes;
+    try {
+        changes = JSON.parse(input);
+    } catch (error) {
+        alert('Supplementary Services: ' + error.message);
+        return;
+    }
+    response = await fetch(url, { method: 'PUT', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(changes) });
+    if (!response.ok) alert('Supplementary Services: ' + await response.text());
+}
+
 btnRefreshCalls.addEventListener('click', async event => {
     btnRefreshCalls.disabled = true;
 
@@ -401,9 +490,37 @@ function populateCallsRecord(msg) {
     btn3.title = 'HoldCall';
     btn3.addEventListener('click', () => actionRecord(row, btn3.title));
 
+    const btn4 = document.createElement('button');
+    btn4.classList.add('actions');
+    btn4.textContent = "☰";
+    btn4.title = 'SIP Trace';
+    btn4.addEventListener('click', () => showTrace(row));
+
+    const btn5 = document.createElement('button');
+    btn5.classList.add('actions');
+    btn5.textContent = "♫";
+    btn5.title = 'Play Audio';
+    btn5.addEventListener('click', () => playbackAction(row));
+
+    const btn6 = document.createElement('button');
+    btn6.classList.add('actions');
+    btn6.textContent = "#";
+    btn6.title = 'Send Digits';
+    btn6.addEventListener('click', () => sendDigits(row));
+
+    const btn7 = document.createElement('button');
+    btn7.classList.add('actions');
+    btn7.textContent = "⇄";
+    btn7.title = 'Transfer';
+    btn7.addEventListener('click', () => transferCall(row));
+
     actionCell.appendChild(btn1);
     actionCell.appendChild(btn2);
     actionCell.appendChild(btn3);
+    actionCell.appendChild(btn4);
+    actionCell.appendChild(btn5);
+    actionCell.appendChild(btn6);
+    actionCell.appendChild(btn7);
 
     if (msg.flashAnswer) {
         btn1.style.animation = animationProperty;
@@ -422,6 +539,21 @@ ws.onopen = () => {
 ws.onmessage = (event) => {
     const msg = JSON.parse(event.data);
 
+    if (msg.playback || msg.playbackError) {
+        showPlayback(msg);
+        return
+    }
+
+    if (msg.ussd) {
+        showUSSD(msg.ussd);
+        return
+    }
+
+    if (msg.sms) {
+        populateSMSRecord(msg.sms);
+        return
+    }
+
     if (msg.callID) {
         populateCallsRecord(msg)
         return
@@ -433,6 +565,8 @@ ws.onmessage = (event) => {
         cells[5].textContent = msg.msisdn;
         cells[6].textContent = msg.regStatus;
         cells[7].textContent = msg.expires;
+        cells[12].textContent = msg.nextRefresh;
+        cells[13].textContent = msg.bindingExpiry;
 
         ws.send("Line record updated!");
     }
@@ -448,6 +582,163 @@ async function actionRecord(row, action) {
 }
 
 
+// playbackAction sends the playback request over the websocket - e.g. "welcome loop", "welcome hangup", "barge on" or empty to stop
+function playbackAction(row) {
+    const input = prompt('Audio key to play (add "loop" and/or "hangup"), "barge on"/"barge off", or leave empty to stop');
+    if (input === null) return;
+    const words = input.trim().split(/\s+/).filter(Boolean);
+    const req = { callID: row.cells[5].textContent };
+    if (words.length === 0) req.action = 'stop';
+    else if (words[0] === 'barge') Object.assign(req, { action: 'barge', bargeIn: words[1] !== 'off' });
+    else Object.assign(req, { action: 'play', audio: words[0], loop: words.includes('loop'), hangup: words.includes('hangup') });
+    ws.send(JSON.stringify(req));
+}
+
+// sendDigits posts the digits with an optional method - e.g. "123#", "123# info" or "*9 inband"
+async function sendDigits(row) {
+    const input = prompt('Digits to send, optionally followed by the method: rfc4733, info or inband');
+    if (input === null) return;
+    const words = input.trim().split(/\s+/).filter(Boolean);
+    if (words.length === 0) return;
+    const req = { callID: row.cells[5].textContent, digits: words[0], method: words[1] || '' };
+    const response = await fetch('/api/v1/dtmf', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(req) });
+    if (!response.ok) alert('Send Digits: ' + (await response.text()));
+}
+
+// transferCall refers the peer to a number (blind) or to the peer of another established call of the UE (attended)
+async function transferCall(row) {
+    const input = prompt('Number to transfer to, or Call-ID of the established consultation call');
+    if (input === null || input.trim() === '') return;
+    const target = input.trim();
+    const req = { callID: row.cells[5].textContent };
+    const consult = Array.from(callsTable.rows).some(r => r !== row && r.cells[5] && r.cells[5].textContent === target);
+    if (consult) req.consultCallID = target;
+    else req.target = target;
+    const response = await fetch('/api/v1/transfer', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(req) });
+    if (!response.ok) alert('Transfer: ' + (await response.text()));
+}
+
+btnSendSMS.addEventListener('click', async () => {
+    const imsi = prompt('IMSI of the sending UE');
+    if (!imsi) return;
+    const to = prompt('Destination number');
+    if (!to) return;
+    const text = prompt('Text');
+    if (!text) return;
+    const req = { imsi: imsi.trim(), to: to.trim(), text, statusReport: confirm('Request a status report?') };
+    const response = await fetch('/api/v1/sms', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(req) });
+    if (!response.ok) alert('Send SMS: ' + (await response.text()));
+});
+
+btnRefreshSMS.addEventListener('click', async () => {
+    const response = await fetch('/api/v1/sms', { method: 'GET' });
+    if (!response.ok) {
+        alert('Error: ' + response.statusText);
+        return;
+    }
+    smsTable.innerHTML = '';
+    (await response.json()).forEach(rec => populateSMSRecord(rec));
+});
+
+btnClearSMS.addEventListener('click', () => { smsTable.innerHTML = '' });
+
+function populateSMSRecord(rec) {
+    let row = Array.from(smsTable.rows).find(row => row.dataset.id === rec.id);
+    if (!row) {
+        row = smsTable.insertRow(0);
+        row.dataset.id = rec.id;
+        for (let i = 0; i < 7; i++) row.insertCell();
+    }
+    const values = [rec.imsi, rec.time, rec.direction, rec.peer, rec.text, rec.parts, rec.cause ? `${rec.status} (${rec.cause})` : rec.status];
+    values.forEach((v, i) => row.cells[i].textContent = v);
+    row.cells[4].title = rec.encoding;
+}
+
+btnUSSD.addEventListener('click', async () => {
+    const imsi = prompt('IMSI of the UE');
+    if (!imsi) return;
+    const code = prompt('Service code, e.g. *100#');
+    if (!code) return;
+    const response = await fetch('/api/v1/ussd', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ imsi: imsi.trim(), code: code.trim() }) });
+    if (!response.ok) alert('USSD: ' + (await response.text()));
+});
+
+// showUSSD shows the last network text - an answer is prompted for when the network awaits one, cancelling ends the session
+async function showUSSD(ussd) {
+    const last = ussd.exchanges.length ? ussd.exchanges[ussd.exchanges.length - 1] : null;
+    if (!last || last.direction !== 'INBOUND') {
+        if (ussd.state === 'failed') alert(`USSD ${ussd.code}: ${ussd.error || 'failed'}`);
+        return;
+    }
+    if (!ussd.prompt) {
+        if (ussd.state !== 'active') alert(`USSD ${ussd.code}:\n${last.text}`);
+        return;
+    }
+    const answer = prompt(`USSD ${ussd.code}:\n${last.text}`);
+    const response = answer
+        ? await fetch('/api/v1/ussd', { method: 'PUT', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ callID: ussd.callID, text: answer }) })
+        : await fetch(`/api/v1/ussd?callID=${encodeURIComponent(ussd.callID)}`, { method: 'DELETE' });
+    if (!response.ok) alert('USSD: ' + (await response.text()));
+}
+
+function showPlayback(msg) {
+    if (msg.playbackError) {
+        alert('Playback: ' + msg.playbackError);
+        return;
+    }
+    const st = msg.playback;
+    const row = Array.from(callsTable.rows).find(row => row.cells[5].textContent === st.callID);
+    if (!row) return;
+    const btn = row.getElementsByTagName('button')[4];
+    btn.title = st.playing ? `Playing ${st.audio} (${st.positionMs}/${st.durationMs} ms)${st.loop ? ' - loop' : ''}` : 'Play Audio';
+    btn.title += st.bargeIn ? ' - barge-in on' : '';
+}
+
+async function showTrace(row) {
+    const callID = row.cells[5].textContent;
+    const response = await fetch(`/api/v1/session/${encodeURIComponent(callID)}/trace`, { method: 'GET' });
+    if (!response.ok) {
+        alert('Error: ' + response.statusText);
+        return;
+    }
+    renderLadder(callID, await response.json());
+}
+
+// renderLadder draws one lane for the UE and one per remote socket with an arrow per message - click an arrow for the raw message
+function renderLadder(callID, entries) {
+    ladderTitle.textContent = `SIP Trace - ${callID}`;
+    ladder.innerHTML = '';
+    const lanes = ['UE', ...new Set(entries.map(e => e.remote))];
+    ladder.style.gridTemplateColumns = `140px repeat(${lanes.length}, minmax(220px, 1fr))`;
+
+    const addCell = (cls, text) => {
+        const div = document.createElement('div');
+        div.className = cls;
+        div.textContent = text;
+        ladder.appendChild(div);
+        return div;
+    };
+
+    addCell('ladderHead', 'Time');
+    lanes.forEach((lane, i) => addCell('ladderHead', i === 0 && entries.length ? `UE (${entries[0].local})` : lane));
+
+    entries.forEach(entry => {
+        addCell('ladderTime', entry.time.substring(11, 23));
+        const lane = lanes.indexOf(entry.remote);
+        const arrow = addCell(`ladderArrow ${entry.direction === 'OUTBOUND' ? 'right' : 'left'}`, `${entry.startLine} [${entry.transport}]`);
+        arrow.style.gridColumn = `2 / ${lane + 3}`;
+        arrow.title = 'Show message';
+        const raw = addCell('ladderRaw', entry.message);
+        raw.style.gridColumn = '1 / -1';
+        arrow.addEventListener('click', () => raw.classList.toggle('shown'));
+    });
+}
+
+btnClearTrace.addEventListener('click', () => {
+    ladder.innerHTML = '';
+    ladderTitle.textContent = 'SIP Trace';
+});
+
 ws.onclose = () => {
     console.log('Disconnected from server');
 };
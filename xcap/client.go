@@ -0,0 +1,130 @@
+package xcap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// XCAP client (RFC 4825) for the simservs document of a user - HTTP digest authenticated without GBA (3GPP TS 33.222 Annex)
+
+const (
+	SimServsContentType = "application/vnd.etsi.simservs+xml"
+
+	auid        = "simservs.ngn.etsi.org"
+	docName     = "simservs.xml"
+	maxDocument = 1 << 20
+	timeout     = 10 * time.Second
+)
+
+// ErrConflict is returned when the document has been changed since it was fetched
+var ErrConflict = errors.New("document changed on the server")
+
+// Authorizer answers the digest challenges of the server
+type Authorizer interface {
+	// Authorization returns the credentials of the request - empty until a challenge has been received
+	Authorization(method, uri string) string
+	// Challenge processes the WWW-Authenticate header of a 401 response
+	Challenge(wwwauth string) error
+}
+
+type Client struct {
+	Root     string // XCAP root URI e.g. http://xcap.ims.example.com:8080
+	XUI      string // XCAP user identity - the public user identity
+	Identity string // X-3GPP-Intended-Identity
+	Auth     Authorizer
+
+	HTTP *http.Client
+}
+
+// DocumentURL returns the URL of the simservs document of the user
+func (c *Client) DocumentURL() string {
+	return fmt.Sprintf("%s/%s/users/%s/%s", strings.TrimRight(c.Root, "/"), auid, c.XUI, docName)
+}
+
+// Get fetches the document and its entity tag - nil when the user has no document yet
+func (c *Client) Get() ([]byte, string, error) {
+	rsp, body, err := c.do(http.MethodGet, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	switch rsp.StatusCode {
+	case http.StatusOK:
+		return body, rsp.Header.Get("ETag"), nil
+	case http.StatusNotFound:
+		return nil, "", nil
+	}
+	return nil, "", statusError(rsp, body)
+}
+
+// Put stores the document - conditional on the entity tag when known so as not to overwrite concurrent changes
+func (c *Client) Put(doc []byte, etag string) (string, error) {
+	hdrs := http.Header{"Content-Type": {SimServsContentType}}
+	if etag != "" {
+		hdrs.Set("If-Match", etag)
+	} else {
+		hdrs.Set("If-None-Match", "*")
+	}
+	rsp, body, err := c.do(http.MethodPut, doc, hdrs)
+	if err != nil {
+		return "", err
+	}
+	switch rsp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return rsp.Header.Get("ETag"), nil
+	case http.StatusPreconditionFailed:
+		return "", ErrConflict
+	}
+	return "", statusError(rsp, body)
+}
+
+// do sends the request - sent again once with credentials when challenged
+func (c *Client) do(method string, body []byte, hdrs http.Header) (*http.Response, []byte, error) {
+	httpc := c.HTTP
+	if httpc == nil {
+		httpc = &http.Client{Timeout: timeout}
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, c.DocumentURL(), bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		for k, vs := range hdrs {
+			req.Header[k] = vs
+		}
+		if c.Identity != "" {
+			req.Header.Set("X-3GPP-Intended-Identity", fmt.Sprintf(`"%s"`, c.Identity))
+		}
+		if c.Auth != nil {
+			if auth := c.Auth.Authorization(method, req.URL.RequestURI()); auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+		}
+		rsp, err := httpc.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(rsp.Body, maxDocument))
+		rsp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if rsp.StatusCode != http.StatusUnauthorized || c.Auth == nil || attempt > 0 {
+			return rsp, data, nil
+		}
+		if err := c.Auth.Challenge(rsp.Header.Get("WWW-Authenticate")); err != nil {
+			return nil, nil, fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+}
+
+func statusError(rsp *http.Response, body []byte) error {
+	if msg := strings.TrimSpace(string(body)); msg != "" && len(msg) < 200 {
+		return fmt.Errorf("XCAP server replied %s: %s", rsp.Status, msg)
+	}
+	return fmt.Errorf("XCAP server replied %s", rsp.Status)
+}
@@ -0,0 +1,350 @@
+package xcap
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// simservs document (3GPP TS 24.623, ETSI TS 183 023) - supplementary services configured by the subscriber over Ut
+
+const (
+	NSSimServs     = "http://uri.etsi.org/ngn/params/xml/simservs/xcap"
+	NSCommonPolicy = "urn:ietf:params:xml:ns:common-policy"
+
+	elemOIR  = "originating-identity-presentation-restriction"
+	elemCW   = "communication-waiting"
+	elemCDIV = "communication-diversion"
+	elemICB  = "incoming-communication-barring"
+	elemOCB  = "outgoing-communication-barring"
+
+	clirRestricted    = "presentation-restricted"
+	clirNotRestricted = "presentation-not-restricted"
+)
+
+// ErrInvalidSetting is returned when a service to update is not valid
+var ErrInvalidSetting = errors.New("invalid setting")
+
+var (
+	// conditions of the rules - no condition means unconditional
+	cdivConditions = []string{"busy", "no-answer", "not-reachable", "not-registered", "anonymous"}
+	icbConditions  = []string{"roaming", "anonymous", "international"}
+	ocbConditions  = []string{"roaming", "international", "international-exHC"}
+)
+
+// SimServs holds the services of the document - only the services set are changed on update
+type SimServs struct {
+	CLIR *CLIRSetting `json:"clir,omitempty"`
+	CW   *CWSetting   `json:"cw,omitempty"`
+	CDIV *CDIVSetting `json:"cdiv,omitempty"`
+	ICB  *CBSetting   `json:"icb,omitempty"`
+	OCB  *CBSetting   `json:"ocb,omitempty"`
+}
+
+type CLIRSetting struct {
+	Active     bool `json:"active"`
+	Restricted bool `json:"restricted"` // identity withheld by default
+}
+
+type CWSetting struct {
+	Active bool `json:"active"`
+}
+
+type CDIVSetting struct {
+	Active       bool       `json:"active"`
+	NoReplyTimer int        `json:"noReplyTimer,omitempty"` // seconds
+	Rules        []CDIVRule `json:"rules"`
+}
+
+type CDIVRule struct {
+	ID           string   `json:"id"`
+	Conditions   []string `json:"conditions"` // busy, no-answer, not-reachable, not-registered, anonymous - none for unconditional
+	Deactivated  bool     `json:"deactivated"`
+	Target       string   `json:"target"`
+	NotifyCaller bool     `json:"notifyCaller"`
+}
+
+type CBSetting struct {
+	Active bool     `json:"active"`
+	Rules  []CBRule `json:"rules"`
+}
+
+type CBRule struct {
+	ID          string   `json:"id"`
+	Conditions  []string `json:"conditions"` // roaming, international, international-exHC, anonymous - none for all
+	Deactivated bool     `json:"deactivated"`
+	Allow       bool     `json:"allow"`
+}
+
+// ---------------------------------------------------------------------------
+// parsing - elements are matched on local names whatever their prefixes
+
+type xmlSimServs struct {
+	XMLName xml.Name `xml:"simservs"`
+	OIR     *struct {
+		Active           *bool  `xml:"active,attr"`
+		DefaultBehaviour string `xml:"default-behaviour"`
+	} `xml:"originating-identity-presentation-restriction"`
+	CW *struct {
+		Active *bool `xml:"active,attr"`
+	} `xml:"communication-waiting"`
+	CDIV *struct {
+		Active       *bool     `xml:"active,attr"`
+		NoReplyTimer int       `xml:"NoReplyTimer"`
+		Rules        []xmlRule `xml:"ruleset>rule"`
+	} `xml:"communication-diversion"`
+	ICB *xmlBarring `xml:"incoming-communication-barring"`
+	OCB *xmlBarring `xml:"outgoing-communication-barring"`
+}
+
+type xmlBarring struct {
+	Active *bool     `xml:"active,attr"`
+	Rules  []xmlRule `xml:"ruleset>rule"`
+}
+
+type xmlRule struct {
+	ID         string `xml:"id,attr"`
+	Conditions struct {
+		Any []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"conditions"`
+	Actions struct {
+		Allow     *bool `xml:"allow"`
+		ForwardTo *struct {
+			Target       string `xml:"target"`
+			NotifyCaller *bool  `xml:"notify-caller"`
+		} `xml:"forward-to"`
+	} `xml:"actions"`
+}
+
+// active attributes default to true
+func isActive(active *bool) bool {
+	return active == nil || *active
+}
+
+func (r *xmlRule) conditions() ([]string, bool) {
+	var conds []string
+	deactivated := false
+	for _, c := range r.Conditions.Any {
+		if c.XMLName.Local == "rule-deactivated" {
+			deactivated = true
+			continue
+		}
+		conds = append(conds, c.XMLName.Local)
+	}
+	return conds, deactivated
+}
+
+func (x *xmlBarring) setting() *CBSetting {
+	cb := &CBSetting{Active: isActive(x.Active), Rules: []CBRule{}}
+	for _, r := range x.Rules {
+		rule := CBRule{ID: r.ID, Allow: r.Actions.Allow != nil && *r.Actions.Allow}
+		rule.Conditions, rule.Deactivated = r.conditions()
+		cb.Rules = append(cb.Rules, rule)
+	}
+	return cb
+}
+
+// Parse returns the services configured in the document
+func Parse(doc []byte) (*SimServs, error) {
+	var x xmlSimServs
+	if err := xml.Unmarshal(doc, &x); err != nil {
+		return nil, err
+	}
+	ss := &SimServs{}
+	if x.OIR != nil {
+		ss.CLIR = &CLIRSetting{Active: isActive(x.OIR.Active), Restricted: strings.TrimSpace(x.OIR.DefaultBehaviour) == clirRestricted}
+	}
+	if x.CW != nil {
+		ss.CW = &CWSetting{Active: isActive(x.CW.Active)}
+	}
+	if x.CDIV != nil {
+		ss.CDIV = &CDIVSetting{Active: isActive(x.CDIV.Active), NoReplyTimer: x.CDIV.NoReplyTimer, Rules: []CDIVRule{}}
+		for _, r := range x.CDIV.Rules {
+			rule := CDIVRule{ID: r.ID, NotifyCaller: true}
+			rule.Conditions, rule.Deactivated = r.conditions()
+			if fwd := r.Actions.ForwardTo; fwd != nil {
+				rule.Target = strings.TrimSpace(fwd.Target)
+				rule.NotifyCaller = fwd.NotifyCaller == nil || *fwd.NotifyCaller
+			}
+			ss.CDIV.Rules = append(ss.CDIV.Rules, rule)
+		}
+	}
+	if x.ICB != nil {
+		ss.ICB = x.ICB.setting()
+	}
+	if x.OCB != nil {
+		ss.OCB = x.OCB.setting()
+	}
+	return ss, nil
+}
+
+// ---------------------------------------------------------------------------
+// updating - the elements of the changed services replace those of the document, anything else is kept as received
+
+// EmptyDocument is the document created when the server has none for the user
+func EmptyDocument() []byte {
+	return fmt.Appendf(nil, `%s<simservs xmlns="%s" xmlns:cp="%s">`+"\n</simservs>\n", xml.Header, NSSimServs, NSCommonPolicy)
+}
+
+// Apply returns the document with the elements of the services set in changes
+func Apply(doc []byte, changes *SimServs) ([]byte, error) {
+	type element struct {
+		name  string
+		build func() (string, error)
+	}
+	var elems []element
+	if c := changes.CLIR; c != nil {
+		elems = append(elems, element{elemOIR, c.element})
+	}
+	if c := changes.CW; c != nil {
+		elems = append(elems, element{elemCW, c.element})
+	}
+	if c := changes.CDIV; c != nil {
+		elems = append(elems, element{elemCDIV, c.element})
+	}
+	if c := changes.ICB; c != nil {
+		elems = append(elems, element{elemICB, func() (string, error) { return c.element(elemICB, icbConditions) }})
+	}
+	if c := changes.OCB; c != nil {
+		elems = append(elems, element{elemOCB, func() (string, error) { return c.element(elemOCB, ocbConditions) }})
+	}
+	if len(elems) == 0 {
+		return nil, fmt.Errorf("%w: no service to update", ErrInvalidSetting)
+	}
+	for _, e := range elems {
+		xmlstr, err := e.build()
+		if err != nil {
+			return nil, err
+		}
+		start, end, err := locate(doc, e.name)
+		if err != nil {
+			return nil, err
+		}
+		updated := make([]byte, 0, len(doc)+len(xmlstr))
+		updated = append(updated, doc[:start]...)
+		updated = append(updated, xmlstr...)
+		if start == end { // inserted before the end tag of the root
+			updated = append(updated, '\n')
+		}
+		doc = append(updated, doc[end:]...)
+	}
+	return doc, nil
+}
+
+// locate returns the byte range of the child element of the root - or an empty range before the end tag of the root when absent
+func locate(doc []byte, local string) (int, int, error) {
+	dec := xml.NewDecoder(bytes.NewReader(doc))
+	depth := 0
+	for {
+		off := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return 0, 0, errors.New("missing simservs root element")
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 1 && t.Name.Local != "simservs" {
+				return 0, 0, fmt.Errorf("unexpected root element [%s]", t.Name.Local)
+			}
+			if depth == 2 && t.Name.Local == local {
+				if err := dec.Skip(); err != nil {
+					return 0, 0, err
+				}
+				return off, int(dec.InputOffset()), nil
+			}
+		case xml.EndElement:
+			if depth == 1 {
+				return off, off, nil
+			}
+			depth--
+		}
+	}
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func (s *CLIRSetting) element() (string, error) {
+	behaviour := clirNotRestricted
+	if s.Restricted {
+		behaviour = clirRestricted
+	}
+	return fmt.Sprintf(`<%s xmlns="%s" active="%t"><default-behaviour>%s</default-behaviour></%s>`, elemOIR, NSSimServs, s.Active, behaviour, elemOIR), nil
+}
+
+func (s *CWSetting) element() (string, error) {
+	return fmt.Sprintf(`<%s xmlns="%s" active="%t"/>`, elemCW, NSSimServs, s.Active), nil
+}
+
+func (s *CDIVSetting) element() (string, error) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<%s xmlns="%s" xmlns:cp="%s" active="%t">`, elemCDIV, NSSimServs, NSCommonPolicy, s.Active)
+	if s.NoReplyTimer > 0 {
+		fmt.Fprintf(&sb, "<NoReplyTimer>%d</NoReplyTimer>", s.NoReplyTimer)
+	}
+	sb.WriteString("<cp:ruleset>")
+	for i, r := range s.Rules {
+		if r.Target == "" {
+			return "", fmt.Errorf("%w: diversion rule %d without target", ErrInvalidSetting, i+1)
+		}
+		conds, err := conditions(r.Conditions, r.Deactivated, cdivConditions)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&sb, `<cp:rule id="%s">%s<cp:actions><forward-to><target>%s</target><notify-caller>%t</notify-caller></forward-to></cp:actions></cp:rule>`,
+			escape(ruleID(r.ID, "cdiv", i)), conds, escape(r.Target), r.NotifyCaller)
+	}
+	fmt.Fprintf(&sb, "</cp:ruleset></%s>", elemCDIV)
+	return sb.String(), nil
+}
+
+func (s *CBSetting) element(name string, allowed []string) (string, error) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<%s xmlns="%s" xmlns:cp="%s" active="%t"><cp:ruleset>`, name, NSSimServs, NSCommonPolicy, s.Active)
+	for i, r := range s.Rules {
+		conds, err := conditions(r.Conditions, r.Deactivated, allowed)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&sb, `<cp:rule id="%s">%s<cp:actions><allow>%t</allow></cp:actions></cp:rule>`, escape(ruleID(r.ID, "cb", i)), conds, r.Allow)
+	}
+	fmt.Fprintf(&sb, "</cp:ruleset></%s>", name)
+	return sb.String(), nil
+}
+
+func ruleID(id, prefix string, idx int) string {
+	if id != "" {
+		return id
+	}
+	return fmt.Sprintf("%s%d", prefix, idx+1)
+}
+
+// conditions builds the conditions element - the names being element names, only the known ones are accepted
+func conditions(conds []string, deactivated bool, allowed []string) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("<cp:conditions>")
+	for _, c := range conds {
+		if !slices.Contains(allowed, c) {
+			return "", fmt.Errorf("%w: unsupported condition [%s]", ErrInvalidSetting, c)
+		}
+		fmt.Fprintf(&sb, "<%s/>", c)
+	}
+	if deactivated {
+		sb.WriteString("<rule-deactivated/>")
+	}
+	sb.WriteString("</cp:conditions>")
+	return sb.String(), nil
+}
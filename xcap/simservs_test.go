@@ -0,0 +1,190 @@
+package xcap
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// operator document with prefixed elements and elements this client does not handle
+const operatorDoc = `<?xml version="1.0" encoding="UTF-8"?>
+<ss:simservs xmlns:ss="http://uri.etsi.org/ngn/params/xml/simservs/xcap" xmlns:cp="urn:ietf:params:xml:ns:common-policy" xmlns:op="urn:example:operator">
+  <ss:originating-identity-presentation active="true"/>
+  <ss:originating-identity-presentation-restriction active="false">
+    <ss:default-behaviour>presentation-restricted</ss:default-behaviour>
+  </ss:originating-identity-presentation-restriction>
+  <ss:communication-diversion>
+    <ss:NoReplyTimer>25</ss:NoReplyTimer>
+    <cp:ruleset>
+      <cp:rule id="cfb">
+        <cp:conditions><ss:busy/></cp:conditions>
+        <cp:actions><ss:forward-to><ss:target>tel:+4930123</ss:target><ss:notify-caller>false</ss:notify-caller></ss:forward-to></cp:actions>
+      </cp:rule>
+      <cp:rule id="cfu">
+        <cp:conditions><ss:rule-deactivated/></cp:conditions>
+        <cp:actions><ss:forward-to><ss:target> sip:voicemail@ims.example.com </ss:target></ss:forward-to></cp:actions>
+      </cp:rule>
+    </cp:ruleset>
+  </ss:communication-diversion>
+  <op:vendor-service enabled="yes"><op:setting>42</op:setting></op:vendor-service>
+  <ss:outgoing-communication-barring active="true">
+    <cp:ruleset>
+      <cp:rule id="boic">
+        <cp:conditions><ss:international/><ss:roaming/></cp:conditions>
+        <cp:actions><ss:allow>false</ss:allow></cp:actions>
+      </cp:rule>
+    </cp:ruleset>
+  </ss:outgoing-communication-barring>
+</ss:simservs>
+`
+
+func TestParse(t *testing.T) {
+	ss, err := Parse([]byte(operatorDoc))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := &SimServs{
+		CLIR: &CLIRSetting{Active: false, Restricted: true},
+		CDIV: &CDIVSetting{Active: true, NoReplyTimer: 25, Rules: []CDIVRule{
+			{ID: "cfb", Conditions: []string{"busy"}, Target: "tel:+4930123", NotifyCaller: false},
+			{ID: "cfu", Deactivated: true, Target: "sip:voicemail@ims.example.com", NotifyCaller: true},
+		}},
+		OCB: &CBSetting{Active: true, Rules: []CBRule{{ID: "boic", Conditions: []string{"international", "roaming"}}}},
+	}
+	if !reflect.DeepEqual(ss, want) {
+		t.Errorf("Parse =\n%+v\nwant\n%+v", ss, want)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for name, doc := range map[string]string{
+		"empty":       "",
+		"not XML":     "simservs",
+		"unclosed":    `<simservs xmlns="` + NSSimServs + `"><communication-waiting>`,
+		"wrong root":  `<services/>`,
+		"bad NoReply": `<simservs><communication-diversion><NoReplyTimer>soon</NoReplyTimer></communication-diversion></simservs>`,
+		"bad boolean": `<simservs><communication-waiting active="maybe"/></simservs>`,
+	} {
+		if ss, err := Parse([]byte(doc)); err == nil {
+			t.Errorf("%s: Parse = %+v, want an error", name, ss)
+		}
+	}
+}
+
+func TestApplyRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		changes SimServs
+		want    SimServs // services expected after parsing the updated document
+	}{
+		{
+			name: "replace diversion and insert waiting",
+			doc:  operatorDoc,
+			changes: SimServs{
+				CW: &CWSetting{Active: true},
+				CDIV: &CDIVSetting{Active: true, NoReplyTimer: 20, Rules: []CDIVRule{
+					{ID: "cfnr", Conditions: []string{"no-answer"}, Target: "tel:+49301&2", NotifyCaller: true},
+					{Conditions: []string{"not-reachable", "not-registered"}, Deactivated: true, Target: "tel:+4930999"},
+				}},
+			},
+			want: SimServs{
+				CLIR: &CLIRSetting{Active: false, Restricted: true},
+				CW:   &CWSetting{Active: true},
+				CDIV: &CDIVSetting{Active: true, NoReplyTimer: 20, Rules: []CDIVRule{
+					{ID: "cfnr", Conditions: []string{"no-answer"}, Target: "tel:+49301&2", NotifyCaller: true},
+					{ID: "cdiv2", Conditions: []string{"not-reachable", "not-registered"}, Deactivated: true, Target: "tel:+4930999"},
+				}},
+				OCB: &CBSetting{Active: true, Rules: []CBRule{{ID: "boic", Conditions: []string{"international", "roaming"}}}},
+			},
+		},
+		{
+			name: "all services on an empty document",
+			doc:  string(EmptyDocument()),
+			changes: SimServs{
+				CLIR: &CLIRSetting{Active: true, Restricted: false},
+				CW:   &CWSetting{Active: false},
+				CDIV: &CDIVSetting{Active: false, Rules: []CDIVRule{}},
+				ICB:  &CBSetting{Active: true, Rules: []CBRule{{ID: "acr", Conditions: []string{"anonymous"}}}},
+				OCB:  &CBSetting{Active: true, Rules: []CBRule{{Conditions: []string{"international-exHC"}, Allow: true}}},
+			},
+			want: SimServs{
+				CLIR: &CLIRSetting{Active: true, Restricted: false},
+				CW:   &CWSetting{Active: false},
+				CDIV: &CDIVSetting{Active: false, Rules: []CDIVRule{}},
+				ICB:  &CBSetting{Active: true, Rules: []CBRule{{ID: "acr", Conditions: []string{"anonymous"}}}},
+				OCB:  &CBSetting{Active: true, Rules: []CBRule{{ID: "cb1", Conditions: []string{"international-exHC"}, Allow: true}}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := Apply([]byte(tt.doc), &tt.changes)
+			if err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			got, err := Parse(doc)
+			if err != nil {
+				t.Fatalf("Parse of the updated document: %v\n%s", err, doc)
+			}
+			if !reflect.DeepEqual(got, &tt.want) {
+				t.Errorf("services =\n%+v\nwant\n%+v\ndocument:\n%s", got, &tt.want, doc)
+			}
+		})
+	}
+}
+
+func TestApplyKeepsUnknownElements(t *testing.T) {
+	doc, err := Apply([]byte(operatorDoc), &SimServs{CDIV: &CDIVSetting{Active: true, Rules: []CDIVRule{}}, ICB: &CBSetting{Active: false, Rules: []CBRule{}}})
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	updated := string(doc)
+	for _, kept := range []string{
+		`<?xml version="1.0" encoding="UTF-8"?>`,
+		`<ss:originating-identity-presentation active="true"/>`,
+		`<op:vendor-service enabled="yes"><op:setting>42</op:setting></op:vendor-service>`,
+		operatorDoc[strings.Index(operatorDoc, "  <ss:originating-identity-presentation-restriction"):strings.Index(operatorDoc, "  <ss:communication-diversion>")],
+		operatorDoc[strings.Index(operatorDoc, "  <ss:outgoing-communication-barring"):strings.Index(operatorDoc, "</ss:simservs>")],
+	} {
+		if !strings.Contains(updated, kept) {
+			t.Errorf("updated document lost\n%s\ndocument:\n%s", kept, updated)
+		}
+	}
+	if strings.Contains(updated, "cfb") || strings.Count(updated, "communication-diversion ") != 1 {
+		t.Errorf("diversion not replaced:\n%s", updated)
+	}
+	if i, j := strings.Index(updated, "incoming-communication-barring"), strings.Index(updated, "</ss:simservs>"); i < 0 || i > j {
+		t.Errorf("barring not inserted in the root:\n%s", updated)
+	}
+}
+
+func TestApplyInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		changes SimServs
+		invalid bool // ErrInvalidSetting expected
+	}{
+		{"no service", operatorDoc, SimServs{}, true},
+		{"diversion without target", operatorDoc, SimServs{CDIV: &CDIVSetting{Rules: []CDIVRule{{Conditions: []string{"busy"}}}}}, true},
+		{"diversion condition unknown", operatorDoc, SimServs{CDIV: &CDIVSetting{Rules: []CDIVRule{{Conditions: []string{"weekend"}, Target: "tel:1"}}}}, true},
+		{"barring condition of diversion", operatorDoc, SimServs{OCB: &CBSetting{Rules: []CBRule{{Conditions: []string{"busy"}}}}}, true},
+		{"condition injecting XML", operatorDoc, SimServs{ICB: &CBSetting{Rules: []CBRule{{Conditions: []string{"anonymous/><x"}}}}}, true},
+		{"wrong root", `<services/>`, SimServs{CW: &CWSetting{}}, false},
+		{"not XML", `simservs`, SimServs{CW: &CWSetting{}}, false},
+		{"truncated", `<simservs xmlns="` + NSSimServs + `"><communication-waiting>`, SimServs{CW: &CWSetting{}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := Apply([]byte(tt.doc), &tt.changes)
+			if err == nil {
+				t.Fatalf("Apply = %s, want an error", doc)
+			}
+			if errors.Is(err, ErrInvalidSetting) != tt.invalid {
+				t.Errorf("err = %v, ErrInvalidSetting expected %v", err, tt.invalid)
+			}
+		})
+	}
+}